@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrSelfAdminAction is returned when an admin deactivates, logs out or revokes the admin role of itself,
+	// so that it cannot lock itself out
+	ErrSelfAdminAction = errors.New("admin action on self")
+)
+
+const (
+	// defaultPageSize is the page size of listings that do not ask for one
+	defaultPageSize = 20
+
+	// ActivateCustomerAction is the audit log action of activating a customer
+	ActivateCustomerAction = "activate_customer"
+	// DeactivateCustomerAction is the audit log action of deactivating a customer
+	DeactivateCustomerAction = "deactivate_customer"
+	// LogoutCustomerAction is the audit log action of logging out a customer everywhere
+	LogoutCustomerAction = "logout_customer"
+	// UnlockCustomerLoginAction is the audit log action of unlocking the logins of a customer
+	UnlockCustomerLoginAction = "unlock_customer_login"
+	// SetCustomerRolesAction is the audit log action of changing the roles of a customer
+	SetCustomerRolesAction = "set_customer_roles"
+)
+
+// AdminService manages customers on behalf of admins
+// every change is recorded in the audit log with the admin who made it
+type AdminService interface {
+	ListCustomers(ctx context.Context, query *CustomerQuery) (*CustomerPage, error)
+	GetCustomer(ctx context.Context, customerID uint64) (*AdminCustomer, error)
+	ActivateCustomer(ctx context.Context, actorID uint64, customerID uint64) error
+	DeactivateCustomer(ctx context.Context, actorID uint64, customerID uint64) error
+	LogoutCustomer(ctx context.Context, actorID uint64, customerID uint64) error
+	UnlockCustomerLogin(ctx context.Context, actorID uint64, customerID uint64) error
+	SetCustomerRoles(ctx context.Context, actorID uint64, customerID uint64, roles []string) ([]string, error)
+	ListAuditLogs(ctx context.Context, query *AuditLogQuery) (*AuditLogPage, error)
+}
+
+// AdminServiceImpl implements AdminService interface
+type AdminServiceImpl struct {
+	adminRepo AdminRepository
+	authSvc   JWTAuthService
+	sf        IDGenerator
+}
+
+// NewAdminService is the factory of AdminService
+func NewAdminService(config *Config, adminRepo AdminRepository, authSvc JWTAuthService, sf IDGenerator) AdminService {
+	return &AdminServiceImpl{
+		adminRepo: adminRepo,
+		authSvc:   authSvc,
+		sf:        sf,
+	}
+}
+
+// ListCustomers lists a page of customers, newest first
+func (svc *AdminServiceImpl) ListCustomers(ctx context.Context, query *CustomerQuery) (*CustomerPage, error) {
+	page, pageSize := query.pageOrDefault()
+	customers, total, err := svc.adminRepo.ListCustomers(ctx, query.Search, (page-1)*pageSize, pageSize)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	return &CustomerPage{
+		Customers: customers,
+		Total:     total,
+		Page:      page,
+		PageSize:  pageSize,
+	}, nil
+}
+
+// GetCustomer finds a customer by customer id
+func (svc *AdminServiceImpl) GetCustomer(ctx context.Context, customerID uint64) (*AdminCustomer, error) {
+	customer, err := svc.adminRepo.GetCustomer(ctx, customerID)
+	if err != nil {
+		if err != ErrCustomerNotFound {
+			log.Error(err.Error())
+		}
+		return nil, err
+	}
+	return customer, nil
+}
+
+// ActivateCustomer lets a deactivated customer log in again
+func (svc *AdminServiceImpl) ActivateCustomer(ctx context.Context, actorID uint64, customerID uint64) error {
+	if _, err := svc.GetCustomer(ctx, customerID); err != nil {
+		return err
+	}
+	if err := svc.adminRepo.SetCustomerActive(ctx, customerID, true); err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	return svc.audit(ctx, actorID, ActivateCustomerAction, customerID, "")
+}
+
+// DeactivateCustomer stops a customer from logging in, and revokes every token it holds
+func (svc *AdminServiceImpl) DeactivateCustomer(ctx context.Context, actorID uint64, customerID uint64) error {
+	if actorID == customerID {
+		return ErrSelfAdminAction
+	}
+	if _, err := svc.GetCustomer(ctx, customerID); err != nil {
+		return err
+	}
+	if err := svc.adminRepo.SetCustomerActive(ctx, customerID, false); err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	if err := svc.authSvc.LogoutAll(ctx, customerID); err != nil {
+		return err
+	}
+	return svc.audit(ctx, actorID, DeactivateCustomerAction, customerID, "")
+}
+
+// LogoutCustomer revokes every token of a customer
+func (svc *AdminServiceImpl) LogoutCustomer(ctx context.Context, actorID uint64, customerID uint64) error {
+	if actorID == customerID {
+		return ErrSelfAdminAction
+	}
+	if _, err := svc.GetCustomer(ctx, customerID); err != nil {
+		return err
+	}
+	if err := svc.authSvc.LogoutAll(ctx, customerID); err != nil {
+		return err
+	}
+	return svc.audit(ctx, actorID, LogoutCustomerAction, customerID, "")
+}
+
+// UnlockCustomerLogin lets a customer locked out by failed logins log in again before its lockout expires
+func (svc *AdminServiceImpl) UnlockCustomerLogin(ctx context.Context, actorID uint64, customerID uint64) error {
+	if err := svc.authSvc.UnlockLogin(ctx, customerID); err != nil {
+		return err
+	}
+	return svc.audit(ctx, actorID, UnlockCustomerLoginAction, customerID, "")
+}
+
+// SetCustomerRoles replaces the roles granted to a customer and returns its resulting roles
+// granted roles apply from the next token refresh, while revoking a role logs the customer out everywhere
+// so that it loses the role at once; an admin cannot revoke its own admin role
+func (svc *AdminServiceImpl) SetCustomerRoles(ctx context.Context, actorID uint64, customerID uint64, roles []string) ([]string, error) {
+	customer, err := svc.GetCustomer(ctx, customerID)
+	if err != nil {
+		return nil, err
+	}
+	// the member role is implied, so only the other roles are stored
+	granted := customerRoles(roles)[1:]
+	newRoles := customerRoles(granted)
+	if actorID == customerID && !containsString(newRoles, AdminRole) {
+		return nil, ErrSelfAdminAction
+	}
+	if err := svc.adminRepo.SetCustomerRoles(ctx, customerID, granted); err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	for _, role := range customer.Roles {
+		if !containsString(newRoles, role) {
+			if err := svc.authSvc.LogoutAll(ctx, customerID); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	if err := svc.audit(ctx, actorID, SetCustomerRolesAction, customerID, strings.Join(newRoles, ",")); err != nil {
+		return nil, err
+	}
+	return newRoles, nil
+}
+
+// ListAuditLogs lists a page of admin actions, newest first
+func (svc *AdminServiceImpl) ListAuditLogs(ctx context.Context, query *AuditLogQuery) (*AuditLogPage, error) {
+	page, pageSize := query.pageOrDefault()
+	records, total, err := svc.adminRepo.ListAuditLogs(ctx, query.CustomerID, (page-1)*pageSize, pageSize)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	return &AuditLogPage{
+		AuditLogs: records,
+		Total:     total,
+		Page:      page,
+		PageSize:  pageSize,
+	}, nil
+}
+
+// audit records an admin action that already took effect, with an optional detail such as the new value
+func (svc *AdminServiceImpl) audit(ctx context.Context, actorID uint64, action string, customerID uint64, detail string) error {
+	log.Infof("admin %d: %s %d %s", actorID, action, customerID, detail)
+	id, err := svc.sf.NextID()
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	if err := svc.adminRepo.CreateAuditLog(ctx, &AuditLogRecord{
+		ID:         id,
+		ActorID:    actorID,
+		Action:     action,
+		CustomerID: customerID,
+		Detail:     detail,
+	}); err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+func (p *Pagination) pageOrDefault() (int, int) {
+	page, pageSize := p.Page, p.PageSize
+	if page == 0 {
+		page = 1
+	}
+	if pageSize == 0 {
+		pageSize = defaultPageSize
+	}
+	return page, pageSize
+}
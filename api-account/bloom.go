@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"math"
+)
+
+// bloomFilter tells whether a SHA-1 hash was added to it, with no false negatives and a bounded rate of false positives
+// since SHA-1 hashes are uniformly distributed, their bytes are used as the hash functions of the filter
+type bloomFilter struct {
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+// newBloomFilter sizes a filter for n hashes at the given false positive rate
+func newBloomFilter(n uint64, falsePositiveRate float64) *bloomFilter {
+	if n == 0 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	// every bit of the last word is used
+	m = (m + 63) / 64 * 64
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k == 0 {
+		k = 1
+	}
+	return &bloomFilter{
+		bits: make([]uint64, m/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+func (f *bloomFilter) add(hash [sha1.Size]byte) {
+	h1, h2 := bloomHashes(hash)
+	for i := uint64(0); i < f.k; i++ {
+		bit := h1 % f.m
+		f.bits[bit/64] |= 1 << (bit % 64)
+		h1, h2 = h1+h2, h2+i
+	}
+}
+
+func (f *bloomFilter) contains(hash [sha1.Size]byte) bool {
+	h1, h2 := bloomHashes(hash)
+	for i := uint64(0); i < f.k; i++ {
+		bit := h1 % f.m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+		h1, h2 = h1+h2, h2+i
+	}
+	return true
+}
+
+// bloomHashes returns the two hashes the k bit positions of a hash are derived from by enhanced double hashing,
+// which keeps the positions apart even when h2 shares a factor with the size of the filter
+func bloomHashes(hash [sha1.Size]byte) (uint64, uint64) {
+	return binary.BigEndian.Uint64(hash[0:8]), binary.BigEndian.Uint64(hash[8:16])
+}
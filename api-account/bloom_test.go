@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/sha1"
+	"strconv"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	tests := []struct {
+		n                 int
+		falsePositiveRate float64
+	}{
+		{1, 0.001},
+		{1000, 0.01},
+		{10000, 0.001},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.n), func(t *testing.T) {
+			filter := newBloomFilter(uint64(tt.n), tt.falsePositiveRate)
+			for i := 0; i < tt.n; i++ {
+				filter.add(sha1.Sum([]byte("added" + strconv.Itoa(i))))
+			}
+			for i := 0; i < tt.n; i++ {
+				if !filter.contains(sha1.Sum([]byte("added" + strconv.Itoa(i)))) {
+					t.Fatalf("contains() = false for added hash %d", i)
+				}
+			}
+			const probes = 100000
+			falsePositives := 0
+			for i := 0; i < probes; i++ {
+				if filter.contains(sha1.Sum([]byte("other" + strconv.Itoa(i)))) {
+					falsePositives++
+				}
+			}
+			// twice the configured rate leaves room for the variance of a random sample
+			if rate := float64(falsePositives) / probes; rate > 2*tt.falsePositiveRate {
+				t.Errorf("false positive rate = %f, want at most %f", rate, tt.falsePositiveRate)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	value     interface{}
+	expiresAt time.Time
+}
+
+// TTLCache is an in-memory cache whose entries expire a fixed duration after they are set
+type TTLCache struct {
+	mu      sync.RWMutex
+	ttl     time.Duration
+	entries map[string]cacheEntry
+}
+
+// NewTTLCache is the factory of TTLCache
+// expired entries are purged in the background every ttl
+func NewTTLCache(ttl time.Duration) *TTLCache {
+	cache := &TTLCache{
+		ttl:     ttl,
+		entries: make(map[string]cacheEntry),
+	}
+	if ttl > 0 {
+		go cache.purge()
+	}
+	return cache
+}
+
+// Get returns the value of an unexpired entry
+func (c *TTLCache) Get(key string) (interface{}, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// Set stores a value, a cache with a zero ttl stores nothing
+func (c *TTLCache) Set(key string, value interface{}) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = cacheEntry{
+		value:     value,
+		expiresAt: time.Now().Add(c.ttl),
+	}
+}
+
+// Increment adds one to an integer entry and returns the new value
+// a missing or expired entry starts from zero, and incrementing does not extend the expiry
+func (c *TTLCache) Increment(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	entry, ok := c.entries[key]
+	if !ok || now.After(entry.expiresAt) {
+		entry = cacheEntry{
+			value:     0,
+			expiresAt: now.Add(c.ttl),
+		}
+	}
+	entry.value = entry.value.(int) + 1
+	c.entries[key] = entry
+	return entry.value.(int)
+}
+
+// Delete removes an entry
+func (c *TTLCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+func (c *TTLCache) purge() {
+	ticker := time.NewTicker(c.ttl)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		c.mu.Lock()
+		for key, entry := range c.entries {
+			if now.After(entry.expiresAt) {
+				delete(c.entries, key)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
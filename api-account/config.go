@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
 
 	"github.com/kelseyhightower/envconfig"
@@ -15,19 +17,67 @@ var (
 	JWTAuthHeader = "Authorization"
 	// CustomerKey is the key name for retrieving jwt-decoded customer id in a http request context
 	CustomerKey HTTPContextKey = "customer_key"
+	// AuthKey is the key name for retrieving the jwt auth result in a http request context
+	AuthKey HTTPContextKey = "auth_key"
 )
 
 type Config struct {
 	HTTPPort  string     `yaml:"httpPort" envconfig:"HTTP_PORT"`
 	JWTConfig *JWTConfig `yaml:"jwtConfig"`
 	DBConfig  *DBConfig  `yaml:"dbConfig"`
+	// MailConfig configures how mails to customers are sent
+	MailConfig *MailConfig `yaml:"mailConfig"`
+	// PasswordResetConfig configures the forgot password flow
+	PasswordResetConfig *PasswordResetConfig `yaml:"passwordResetConfig"`
+	// EmailVerificationConfig configures email verification and what unverified customers can access
+	EmailVerificationConfig *EmailVerificationConfig `yaml:"emailVerificationConfig"`
+	// MFAConfig configures two-factor authentication
+	MFAConfig *MFAConfig `yaml:"mfaConfig"`
+	// OIDCConfig configures sign-in with external identity providers
+	OIDCConfig *OIDCConfig `yaml:"oidcConfig"`
+	// LoginThrottleConfig configures brute-force protection of logins
+	LoginThrottleConfig *LoginThrottleConfig `yaml:"loginThrottleConfig"`
+	// AdminConfig configures who administers customers
+	AdminConfig *AdminConfig `yaml:"adminConfig"`
+	// PersonalTokenConfig configures personal access tokens and bots
+	PersonalTokenConfig *PersonalTokenConfig `yaml:"personalTokenConfig"`
+	// PasswordHashConfig configures how passwords are hashed
+	PasswordHashConfig *PasswordHashConfig `yaml:"passwordHashConfig"`
+	// PasswordPolicyConfig configures which passwords customers may choose
+	PasswordPolicyConfig *PasswordPolicyConfig `yaml:"passwordPolicyConfig"`
+	// TrustedProxies are the IPs or CIDRs of the reverse proxies whose X-Forwarded-For is trusted for the client IP;
+	// without any, the client IP is the address of the connection
+	TrustedProxies []string `yaml:"trustedProxies" envconfig:"TRUSTED_PROXIES"`
 }
 
 // JWTConfig is jwt config type
+// tokens are signed with the key ActiveKeyID, and verified with any of Keys;
+// Keys can also be set with JWT_KEYS as a JSON array of key configs;
+// AllowEphemeralKey generates a key at startup when Keys is empty, which only suits development
 type JWTConfig struct {
-	Secret                   string `yaml:"secret" envconfig:"JWT_SECRET"`
-	AccessTokenExpireSecond  int64  `yaml:"accessTokenExpireSecond" envconfig:"JWT_ACCESS_TOKEN_EXPIRE_SECOND"`
-	RefreshTokenExpireSecond int64  `yaml:"refreshTokenExpireSecond" envconfig:"JWT_REFRESH_TOKEN_EXPIRE_SECOND"`
+	ActiveKeyID              string        `yaml:"activeKeyID" envconfig:"JWT_ACTIVE_KEY_ID"`
+	Keys                     JWTKeyConfigs `yaml:"keys" envconfig:"JWT_KEYS"`
+	AllowEphemeralKey        bool          `yaml:"allowEphemeralKey" envconfig:"JWT_ALLOW_EPHEMERAL_KEY"`
+	AccessTokenExpireSecond  int64         `yaml:"accessTokenExpireSecond" envconfig:"JWT_ACCESS_TOKEN_EXPIRE_SECOND"`
+	RefreshTokenExpireSecond int64         `yaml:"refreshTokenExpireSecond" envconfig:"JWT_REFRESH_TOKEN_EXPIRE_SECOND"`
+	RevocationCacheSecond    int64         `yaml:"revocationCacheSecond" envconfig:"JWT_REVOCATION_CACHE_SECOND"`
+}
+
+// JWTKeyConfig is the config of a token signing key
+// Algorithm is either "RS256" or "EdDSA"; a retired key that only verifies tokens sets PublicKeyFile instead of PrivateKeyFile
+type JWTKeyConfig struct {
+	ID             string `yaml:"id" json:"id"`
+	Algorithm      string `yaml:"algorithm" json:"algorithm"`
+	PrivateKeyFile string `yaml:"privateKeyFile" json:"privateKeyFile"`
+	PublicKeyFile  string `yaml:"publicKeyFile" json:"publicKeyFile"`
+}
+
+// JWTKeyConfigs are the keys of JWTConfig
+type JWTKeyConfigs []*JWTKeyConfig
+
+// Decode reads JWT_KEYS, e.g. [{"id":"2024-01","algorithm":"EdDSA","privateKeyFile":"/etc/sendify/jwt-ed25519.pem"}]
+func (k *JWTKeyConfigs) Decode(value string) error {
+	return json.Unmarshal([]byte(value), k)
 }
 
 // DBConfig is database config type
@@ -37,6 +87,139 @@ type DBConfig struct {
 	MaxOpenConns int    `yaml:"maxOpenConns" envconfig:"DB_MAX_OPEN_CONNS"`
 }
 
+// MailConfig is mail config type
+// Driver is either "smtp" or "log"
+type MailConfig struct {
+	Driver       string `yaml:"driver" envconfig:"MAIL_DRIVER"`
+	From         string `yaml:"from" envconfig:"MAIL_FROM"`
+	SMTPHost     string `yaml:"smtpHost" envconfig:"MAIL_SMTP_HOST"`
+	SMTPPort     string `yaml:"smtpPort" envconfig:"MAIL_SMTP_PORT"`
+	SMTPUsername string `yaml:"smtpUsername" envconfig:"MAIL_SMTP_USERNAME"`
+	SMTPPassword string `yaml:"smtpPassword" envconfig:"MAIL_SMTP_PASSWORD"`
+	FilePath     string `yaml:"filePath" envconfig:"MAIL_FILE_PATH"`
+}
+
+// PasswordResetConfig is password reset config type
+// the reset token is appended to URL as the token query parameter
+type PasswordResetConfig struct {
+	TokenExpireSecond int64  `yaml:"tokenExpireSecond" envconfig:"PASSWORD_RESET_TOKEN_EXPIRE_SECOND"`
+	URL               string `yaml:"url" envconfig:"PASSWORD_RESET_URL"`
+}
+
+// EmailVerificationConfig is email verification config type
+// UnverifiedAccess is the policy for unverified customers behind forwardauth:
+// "full" grants full access, "restricted" grants read-only access to channels and "none" denies access
+// at most ResendLimit verification mails are sent to a customer within ResendWindowSecond
+type EmailVerificationConfig struct {
+	UnverifiedAccess   string `yaml:"unverifiedAccess" envconfig:"EMAIL_VERIFICATION_UNVERIFIED_ACCESS"`
+	TokenExpireSecond  int64  `yaml:"tokenExpireSecond" envconfig:"EMAIL_VERIFICATION_TOKEN_EXPIRE_SECOND"`
+	URL                string `yaml:"url" envconfig:"EMAIL_VERIFICATION_URL"`
+	ResendLimit        int64  `yaml:"resendLimit" envconfig:"EMAIL_VERIFICATION_RESEND_LIMIT"`
+	ResendWindowSecond int64  `yaml:"resendWindowSecond" envconfig:"EMAIL_VERIFICATION_RESEND_WINDOW_SECOND"`
+}
+
+const (
+	// FullUnverifiedAccess lets unverified customers access everything
+	FullUnverifiedAccess = "full"
+	// RestrictedUnverifiedAccess lets unverified customers read channels they can see, but not write to them
+	RestrictedUnverifiedAccess = "restricted"
+	// NoUnverifiedAccess denies unverified customers access to every service behind forwardauth
+	NoUnverifiedAccess = "none"
+)
+
+// MFAConfig is two-factor authentication config type
+// Issuer names the service in authenticator apps, and a pending token of a two-step login
+// accepts at most MaxAttempts codes within PendingTokenExpireSecond;
+// Required denies customers without 2FA access to every service behind forwardauth
+type MFAConfig struct {
+	Issuer                   string `yaml:"issuer" envconfig:"MFA_ISSUER"`
+	PendingTokenExpireSecond int64  `yaml:"pendingTokenExpireSecond" envconfig:"MFA_PENDING_TOKEN_EXPIRE_SECOND"`
+	MaxAttempts              int    `yaml:"maxAttempts" envconfig:"MFA_MAX_ATTEMPTS"`
+	Required                 bool   `yaml:"required" envconfig:"MFA_REQUIRED"`
+}
+
+// OIDCConfig is OpenID Connect config type
+// a login has to return from the identity provider within StateExpireSecond
+type OIDCConfig struct {
+	StateExpireSecond int64                 `yaml:"stateExpireSecond" envconfig:"OIDC_STATE_EXPIRE_SECOND"`
+	Providers         []*OIDCProviderConfig `yaml:"providers" ignored:"true"`
+}
+
+// OIDCProviderConfig is the config of an OpenID Connect identity provider
+// Name identifies the provider in the login and callback paths, and RedirectURL must point to its callback path;
+// AutoProvision creates a customer for an identity whose email matches no customer
+type OIDCProviderConfig struct {
+	Name          string   `yaml:"name"`
+	Issuer        string   `yaml:"issuer"`
+	ClientID      string   `yaml:"clientID"`
+	ClientSecret  string   `yaml:"clientSecret"`
+	RedirectURL   string   `yaml:"redirectURL"`
+	Scopes        []string `yaml:"scopes"`
+	AutoProvision bool     `yaml:"autoProvision"`
+}
+
+// LoginThrottleConfig is login brute-force protection config type
+// failed logins are counted per account and per client IP, and forgotten WindowSecond after the last one;
+// from the backoff threshold on, each failure doubles the wait before the next login from BackoffBaseSecond
+// up to BackoffMaxSecond, and the lockout threshold locks logins for LockoutSecond, after which they unlock by themselves
+// UniformError answers every failed login with the same error, so that logins cannot tell which emails have an account
+type LoginThrottleConfig struct {
+	UniformError            bool  `yaml:"uniformError" envconfig:"LOGIN_THROTTLE_UNIFORM_ERROR"`
+	WindowSecond            int64 `yaml:"windowSecond" envconfig:"LOGIN_THROTTLE_WINDOW_SECOND"`
+	AccountBackoffThreshold int   `yaml:"accountBackoffThreshold" envconfig:"LOGIN_THROTTLE_ACCOUNT_BACKOFF_THRESHOLD"`
+	AccountLockoutThreshold int   `yaml:"accountLockoutThreshold" envconfig:"LOGIN_THROTTLE_ACCOUNT_LOCKOUT_THRESHOLD"`
+	IPBackoffThreshold      int   `yaml:"ipBackoffThreshold" envconfig:"LOGIN_THROTTLE_IP_BACKOFF_THRESHOLD"`
+	IPLockoutThreshold      int   `yaml:"ipLockoutThreshold" envconfig:"LOGIN_THROTTLE_IP_LOCKOUT_THRESHOLD"`
+	BackoffBaseSecond       int64 `yaml:"backoffBaseSecond" envconfig:"LOGIN_THROTTLE_BACKOFF_BASE_SECOND"`
+	BackoffMaxSecond        int64 `yaml:"backoffMaxSecond" envconfig:"LOGIN_THROTTLE_BACKOFF_MAX_SECOND"`
+	LockoutSecond           int64 `yaml:"lockoutSecond" envconfig:"LOGIN_THROTTLE_LOCKOUT_SECOND"`
+}
+
+// AdminConfig is admin config type
+// the customers with Emails, once verified, are made admins on startup
+type AdminConfig struct {
+	Emails []string `yaml:"emails" envconfig:"ADMIN_EMAILS"`
+}
+
+// PersonalTokenConfig is personal access token config type
+// a customer holds at most MaxTokens unrevoked tokens, and owns at most MaxBots bots, each with MaxTokens tokens of its own
+type PersonalTokenConfig struct {
+	MaxTokens int64 `yaml:"maxTokens" envconfig:"PERSONAL_TOKEN_MAX_TOKENS"`
+	MaxBots   int64 `yaml:"maxBots" envconfig:"PERSONAL_TOKEN_MAX_BOTS"`
+}
+
+// PasswordHashConfig is password hashing config type
+// Algorithm is either "argon2id" or "bcrypt"; passwords hashed with another algorithm or other parameters
+// keep working, and are rehashed with the configured ones on the next successful login
+type PasswordHashConfig struct {
+	Algorithm  string          `yaml:"algorithm" envconfig:"PASSWORD_HASH_ALGORITHM"`
+	Argon2id   *Argon2idConfig `yaml:"argon2id"`
+	BcryptCost int             `yaml:"bcryptCost" envconfig:"PASSWORD_HASH_BCRYPT_COST"`
+}
+
+// Argon2idConfig is argon2id parameters config type
+// Memory is in KiB, and SaltLength and KeyLength are in bytes
+type Argon2idConfig struct {
+	Memory      uint32 `yaml:"memory" envconfig:"PASSWORD_HASH_ARGON2ID_MEMORY"`
+	Iterations  uint32 `yaml:"iterations" envconfig:"PASSWORD_HASH_ARGON2ID_ITERATIONS"`
+	Parallelism uint8  `yaml:"parallelism" envconfig:"PASSWORD_HASH_ARGON2ID_PARALLELISM"`
+	SaltLength  uint32 `yaml:"saltLength" envconfig:"PASSWORD_HASH_ARGON2ID_SALT_LENGTH"`
+	KeyLength   uint32 `yaml:"keyLength" envconfig:"PASSWORD_HASH_ARGON2ID_KEY_LENGTH"`
+}
+
+// PasswordPolicyConfig is password policy config type
+// MinScore is the minimum estimated strength from 0 (guessable) to 4 (very strong); ForbidPersonalInfo rejects
+// passwords containing the name or email of the customer, and BreachedCorpusFile lists the SHA-1 hashes of breached
+// passwords, one HASH[:COUNT] per line as the Have I Been Pwned downloader writes them, with no breached password check
+// if empty; the corpus is loaded at startup into a bloom filter that takes BreachedFalsePositiveRate, 0.001 by default,
+// of never breached passwords for breached ones
+type PasswordPolicyConfig struct {
+	MinScore                  int     `yaml:"minScore" envconfig:"PASSWORD_POLICY_MIN_SCORE"`
+	ForbidPersonalInfo        bool    `yaml:"forbidPersonalInfo" envconfig:"PASSWORD_POLICY_FORBID_PERSONAL_INFO"`
+	BreachedCorpusFile        string  `yaml:"breachedCorpusFile" envconfig:"PASSWORD_POLICY_BREACHED_CORPUS_FILE"`
+	BreachedFalsePositiveRate float64 `yaml:"breachedFalsePositiveRate" envconfig:"PASSWORD_POLICY_BREACHED_FALSE_POSITIVE_RATE"`
+}
+
 // NewConfig is the factory of Config instance
 func NewConfig() (*Config, error) {
 	var config Config
@@ -46,6 +229,11 @@ func NewConfig() (*Config, error) {
 	if err := readEnv(&config); err != nil {
 		return nil, err
 	}
+	switch config.EmailVerificationConfig.UnverifiedAccess {
+	case FullUnverifiedAccess, RestrictedUnverifiedAccess, NoUnverifiedAccess:
+	default:
+		return nil, fmt.Errorf("unknown unverified access policy: %s", config.EmailVerificationConfig.UnverifiedAccess)
+	}
 	log.SetOutput(os.Stderr)
 
 	return &config, nil
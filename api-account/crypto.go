@@ -1,17 +1,226 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// HashPassword hashed the real password
-func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+var (
+	// ErrUnknownPasswordHash is returned for password hashes of an unsupported algorithm
+	ErrUnknownPasswordHash = errors.New("unknown password hash")
+	// ErrMalformedPasswordHash is returned for password hashes that cannot be parsed
+	ErrMalformedPasswordHash = errors.New("malformed password hash")
+)
+
+const (
+	// Argon2idAlgorithm is the PHC identifier of argon2id
+	Argon2idAlgorithm = "argon2id"
+	// BcryptAlgorithm names bcrypt, whose hashes are identified by their 2a, 2b or 2y version
+	BcryptAlgorithm = "bcrypt"
+)
+
+// passwordAlgorithm hashes passwords into encoded strings of the form $id$...
+type passwordAlgorithm interface {
+	hash(password string) (string, error)
+	verify(password string, encoded string) (bool, error)
+	// outdated tells whether encoded was hashed with other parameters than the configured ones
+	outdated(encoded string) bool
+}
+
+// PasswordHasher hashes passwords with the configured algorithm,
+// and verifies passwords against hashes of every supported algorithm, so that the algorithm can change over time
+type PasswordHasher struct {
+	current    passwordAlgorithm
+	algorithms map[string]passwordAlgorithm
+	// dummyHash is verified against when a login names no customer, so that such logins take as long as others
+	dummyHash string
+}
+
+// NewPasswordHasher is the factory of PasswordHasher
+func NewPasswordHasher(config *Config) (*PasswordHasher, error) {
+	hashConfig := config.PasswordHashConfig
+	argon2id := &argon2idAlgorithm{
+		memory:      hashConfig.Argon2id.Memory,
+		iterations:  hashConfig.Argon2id.Iterations,
+		parallelism: hashConfig.Argon2id.Parallelism,
+		saltLength:  hashConfig.Argon2id.SaltLength,
+		keyLength:   hashConfig.Argon2id.KeyLength,
+	}
+	bcryptAlg := &bcryptAlgorithm{
+		cost: hashConfig.BcryptCost,
+	}
+	hasher := &PasswordHasher{
+		algorithms: map[string]passwordAlgorithm{
+			Argon2idAlgorithm: argon2id,
+			"2a":              bcryptAlg,
+			"2b":              bcryptAlg,
+			"2y":              bcryptAlg,
+		},
+	}
+	switch hashConfig.Algorithm {
+	case Argon2idAlgorithm:
+		if argon2id.memory == 0 || argon2id.iterations == 0 || argon2id.parallelism == 0 || argon2id.saltLength == 0 || argon2id.keyLength == 0 {
+			return nil, errors.New("argon2id parameters must be positive")
+		}
+		hasher.current = argon2id
+	case BcryptAlgorithm:
+		if bcryptAlg.cost < bcrypt.MinCost || bcryptAlg.cost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		hasher.current = bcryptAlg
+	default:
+		return nil, fmt.Errorf("unknown password hash algorithm: %s", hashConfig.Algorithm)
+	}
+	dummyHash, err := hasher.current.hash("")
+	if err != nil {
+		return nil, err
+	}
+	hasher.dummyHash = dummyHash
+	return hasher, nil
+}
+
+// Hash hashes a password with the configured algorithm and parameters
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	return h.current.hash(password)
+}
+
+// Verify checks a password against its hash
+// rehash tells whether a matching hash should be replaced by a hash of the configured algorithm and parameters;
+// an empty hash belongs to a customer without a password, and never matches
+func (h *PasswordHasher) Verify(password string, encoded string) (ok bool, rehash bool, err error) {
+	if encoded == "" {
+		return false, false, nil
+	}
+	algorithm, err := h.algorithm(encoded)
+	if err != nil {
+		return false, false, err
+	}
+	ok, err = algorithm.verify(password, encoded)
+	if err != nil || !ok {
+		return false, false, err
+	}
+	return true, algorithm != h.current || algorithm.outdated(encoded), nil
+}
+
+// VerifyDummy takes as long as verifying a password against a hash of the configured algorithm, and never matches
+func (h *PasswordHasher) VerifyDummy(password string) {
+	h.current.verify(password, h.dummyHash)
+}
+
+// algorithm finds the algorithm of a hash by the identifier between its first two $
+func (h *PasswordHasher) algorithm(encoded string) (passwordAlgorithm, error) {
+	parts := strings.SplitN(encoded, "$", 3)
+	if len(parts) < 3 || parts[0] != "" {
+		return nil, ErrMalformedPasswordHash
+	}
+	algorithm, ok := h.algorithms[parts[1]]
+	if !ok {
+		return nil, ErrUnknownPasswordHash
+	}
+	return algorithm, nil
+}
+
+// argon2idAlgorithm hashes into the PHC string format $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<key>
+// memory is in KiB, and salt and key are unpadded base64
+type argon2idAlgorithm struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	saltLength  uint32
+	keyLength   uint32
+}
+
+type argon2idHash struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+func (a *argon2idAlgorithm) hash(password string) (string, error) {
+	salt := make([]byte, a.saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.iterations, a.memory, a.parallelism, a.keyLength)
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", Argon2idAlgorithm, argon2.Version, a.memory, a.iterations, a.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (a *argon2idAlgorithm) verify(password string, encoded string) (bool, error) {
+	h, err := parseArgon2idHash(encoded)
+	if err != nil {
+		return false, err
+	}
+	key := argon2.IDKey([]byte(password), h.salt, h.iterations, h.memory, h.parallelism, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(key, h.key) == 1, nil
+}
+
+func (a *argon2idAlgorithm) outdated(encoded string) bool {
+	h, err := parseArgon2idHash(encoded)
+	if err != nil {
+		return true
+	}
+	return h.memory != a.memory || h.iterations != a.iterations || h.parallelism != a.parallelism ||
+		uint32(len(h.salt)) != a.saltLength || uint32(len(h.key)) != a.keyLength
+}
+
+func parseArgon2idHash(encoded string) (*argon2idHash, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != Argon2idAlgorithm {
+		return nil, ErrMalformedPasswordHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, ErrMalformedPasswordHash
+	}
+	var h argon2idHash
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.iterations, &h.parallelism); err != nil {
+		return nil, ErrMalformedPasswordHash
+	}
+	if h.memory == 0 || h.iterations == 0 || h.parallelism == 0 {
+		return nil, ErrMalformedPasswordHash
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, ErrMalformedPasswordHash
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, ErrMalformedPasswordHash
+	}
+	return &h, nil
+}
+
+// bcryptAlgorithm hashes into the modular crypt format of bcrypt, $2a$<cost>$<salt and hash>
+type bcryptAlgorithm struct {
+	cost int
+}
+
+func (b *bcryptAlgorithm) hash(password string) (string, error) {
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), b.cost)
 	return string(bytes), err
 }
 
-// CheckPasswordHash compares the real password and its hashed value
-func CheckPasswordHash(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
+func (b *bcryptAlgorithm) verify(password string, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	if err != nil {
+		return false, ErrMalformedPasswordHash
+	}
+	return true, nil
+}
+
+func (b *bcryptAlgorithm) outdated(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != b.cost
 }
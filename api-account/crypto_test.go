@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestPasswordHasher(t *testing.T, algorithm string, argon2id Argon2idConfig, bcryptCost int) *PasswordHasher {
+	t.Helper()
+	hasher, err := NewPasswordHasher(&Config{
+		PasswordHashConfig: &PasswordHashConfig{
+			Algorithm:  algorithm,
+			Argon2id:   &argon2id,
+			BcryptCost: bcryptCost,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hasher
+}
+
+// testArgon2idConfig keeps argon2id cheap, tests only care about the encoding
+var testArgon2idConfig = Argon2idConfig{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestParseArgon2idHash(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+		wantErr bool
+	}{
+		{"valid", "$argon2id$v=19$m=65536,t=3,p=2$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG", false},
+		{"other algorithm", "$argon2i$v=19$m=65536,t=3,p=2$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG", true},
+		{"other version", "$argon2id$v=16$m=65536,t=3,p=2$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG", true},
+		{"missing parameter", "$argon2id$v=19$m=65536,t=3$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG", true},
+		{"zero memory", "$argon2id$v=19$m=0,t=3,p=2$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG", true},
+		{"padded salt", "$argon2id$v=19$m=65536,t=3,p=2$c29tZXNhbHQ=$RdescudvJCsgt3ub+b+dWRWJTmaaJObG", true},
+		{"empty key", "$argon2id$v=19$m=65536,t=3,p=2$c29tZXNhbHQ$", true},
+		{"missing key", "$argon2id$v=19$m=65536,t=3,p=2$c29tZXNhbHQ", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := parseArgon2idHash(tt.encoded)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseArgon2idHash() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (h.memory != 65536 || h.iterations != 3 || h.parallelism != 2 || string(h.salt) != "somesalt") {
+				t.Errorf("parseArgon2idHash() = %+v", h)
+			}
+		})
+	}
+}
+
+func TestPasswordHasherVerify(t *testing.T) {
+	argon2idHasher := newTestPasswordHasher(t, Argon2idAlgorithm, testArgon2idConfig, bcrypt.MinCost)
+	argon2idHash, err := argon2idHasher.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHasher := newTestPasswordHasher(t, BcryptAlgorithm, testArgon2idConfig, bcrypt.MinCost)
+	bcryptHash, err := bcryptHasher.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	strongerArgon2id := testArgon2idConfig
+	strongerArgon2id.Iterations++
+
+	tests := []struct {
+		name       string
+		hasher     *PasswordHasher
+		password   string
+		encoded    string
+		wantOk     bool
+		wantRehash bool
+		wantErr    error
+	}{
+		{"argon2id", argon2idHasher, "secret", argon2idHash, true, false, nil},
+		{"argon2id wrong password", argon2idHasher, "wrong", argon2idHash, false, false, nil},
+		{"argon2id other parameters", newTestPasswordHasher(t, Argon2idAlgorithm, strongerArgon2id, bcrypt.MinCost), "secret", argon2idHash, true, true, nil},
+		{"argon2id hash with bcrypt configured", bcryptHasher, "secret", argon2idHash, true, true, nil},
+		{"bcrypt", bcryptHasher, "secret", bcryptHash, true, false, nil},
+		{"bcrypt wrong password", bcryptHasher, "wrong", bcryptHash, false, false, nil},
+		{"bcrypt other cost", newTestPasswordHasher(t, BcryptAlgorithm, testArgon2idConfig, bcrypt.MinCost+1), "secret", bcryptHash, true, true, nil},
+		{"bcrypt hash with argon2id configured", argon2idHasher, "secret", bcryptHash, true, true, nil},
+		{"bcrypt 2y", argon2idHasher, "secret", strings.Replace(bcryptHash, "$2a$", "$2y$", 1), true, true, nil},
+		{"no password", argon2idHasher, "", "", false, false, nil},
+		{"unknown algorithm", argon2idHasher, "secret", "$scrypt$ln=15,r=8,p=1$c29tZXNhbHQ$aGFzaA", false, false, ErrUnknownPasswordHash},
+		{"not a hash", argon2idHasher, "secret", "secret", false, false, ErrMalformedPasswordHash},
+		{"malformed argon2id", argon2idHasher, "secret", "$argon2id$v=19$m=64", false, false, ErrMalformedPasswordHash},
+		{"malformed bcrypt", argon2idHasher, "secret", "$2a$04$short", false, false, ErrMalformedPasswordHash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, rehash, err := tt.hasher.Verify(tt.password, tt.encoded)
+			if ok != tt.wantOk || rehash != tt.wantRehash || err != tt.wantErr {
+				t.Errorf("Verify() = (%v, %v, %v), want (%v, %v, %v)", ok, rehash, err, tt.wantOk, tt.wantRehash, tt.wantErr)
+			}
+		})
+	}
+}
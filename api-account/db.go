@@ -3,17 +3,129 @@ package main
 import (
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type DBCustomer struct {
-	ID               uint64 `gorm:"primaryKey"`
-	Active           bool   `gorm:"default:true"`
-	FirstName        string `gorm:"type:varchar(50);not null"`
-	LastName         string `gorm:"type:varchar(50);not null"`
-	Email            string `gorm:"type:varchar(320);unique;not null"`
-	BcryptedPassword string `gorm:"type:binary(60);not null"`
-	UpdatedAt        int64  `gorm:"autoUpdateTime:milli"`
-	CreatedAt        int64  `gorm:"autoCreateTime:milli"`
+	ID                uint64 `gorm:"primaryKey"`
+	Active            bool   `gorm:"default:true"`
+	FirstName         string `gorm:"type:varchar(50);not null"`
+	LastName          string `gorm:"type:varchar(50);not null"`
+	Email             string `gorm:"type:varchar(320);unique;not null"`
+	PasswordHash      string `gorm:"type:varchar(255);not null"`
+	EmailVerified     bool   `gorm:"not null;default:false"`
+	TokensValidAfter  int64  `gorm:"not null;default:0"`
+	PasswordChangedAt int64  `gorm:"not null;default:0"`
+	TOTPSecret        string `gorm:"type:varchar(64);not null;default:''"`
+	TOTPEnabled       bool   `gorm:"not null;default:false"`
+	TOTPLastStep      int64  `gorm:"not null;default:0"`
+	FailedLogins      int    `gorm:"not null;default:0"`
+	LastFailedLoginAt int64  `gorm:"not null;default:0"`
+	LockedUntil       int64  `gorm:"not null;default:0"`
+	Bot               bool   `gorm:"not null;default:false"`
+	OwnerID           uint64 `gorm:"index;not null;default:0"`
+	UpdatedAt         int64  `gorm:"autoUpdateTime:milli"`
+	CreatedAt         int64  `gorm:"autoCreateTime:milli"`
+}
+
+type DBAuditLog struct {
+	ID         uint64 `gorm:"primaryKey;autoIncrement:false"`
+	ActorID    uint64 `gorm:"index;not null"`
+	Action     string `gorm:"type:varchar(50);not null"`
+	CustomerID uint64 `gorm:"index;not null"`
+	Detail     string `gorm:"type:varchar(255);not null;default:''"`
+	CreatedAt  int64  `gorm:"autoCreateTime:milli"`
+}
+
+type DBPersonalToken struct {
+	ID         uint64 `gorm:"primaryKey;autoIncrement:false"`
+	CustomerID uint64 `gorm:"index;not null"`
+	Name       string `gorm:"type:varchar(100);not null"`
+	TokenHash  []byte `gorm:"type:binary(32);unique;not null"`
+	Scopes     string `gorm:"type:varchar(255);not null"`
+	ExpiresAt  int64  `gorm:"not null"`
+	Revoked    bool   `gorm:"not null;default:false"`
+	LastUsedAt int64  `gorm:"not null;default:0"`
+	CreatedAt  int64  `gorm:"autoCreateTime:milli"`
+}
+
+type DBCustomerRole struct {
+	CustomerID uint64 `gorm:"primaryKey;autoIncrement:false"`
+	Role       string `gorm:"primaryKey;type:varchar(20)"`
+	CreatedAt  int64  `gorm:"autoCreateTime:milli"`
+}
+
+type DBRefreshToken struct {
+	ID         uint64 `gorm:"primaryKey;autoIncrement:false"`
+	FamilyID   uint64 `gorm:"index;not null"`
+	CustomerID uint64 `gorm:"index;not null"`
+	Used       bool   `gorm:"not null;default:false"`
+	Revoked    bool   `gorm:"not null;default:false"`
+	ExpiresAt  int64  `gorm:"not null"`
+	UpdatedAt  int64  `gorm:"autoUpdateTime:milli"`
+	CreatedAt  int64  `gorm:"autoCreateTime:milli"`
+}
+
+type DBSession struct {
+	ID              uint64 `gorm:"primaryKey;autoIncrement:false"`
+	CustomerID      uint64 `gorm:"index;not null"`
+	UserAgent       string `gorm:"type:varchar(255);not null"`
+	IP              string `gorm:"type:varchar(45);not null"`
+	LastRefreshedAt int64  `gorm:"not null;default:0"`
+	CreatedAt       int64  `gorm:"autoCreateTime:milli"`
+}
+
+type DBRevokedToken struct {
+	ID         uint64 `gorm:"primaryKey;autoIncrement:false"`
+	CustomerID uint64 `gorm:"index;not null"`
+	ExpiresAt  int64  `gorm:"index;not null"`
+	CreatedAt  int64  `gorm:"autoCreateTime:milli"`
+}
+
+type DBPasswordResetToken struct {
+	ID         uint64 `gorm:"primaryKey;autoIncrement:false"`
+	CustomerID uint64 `gorm:"index;not null"`
+	TokenHash  []byte `gorm:"type:binary(32);unique;not null"`
+	Used       bool   `gorm:"not null"`
+	ExpiresAt  int64  `gorm:"not null"`
+	UpdatedAt  int64  `gorm:"autoUpdateTime:milli"`
+	CreatedAt  int64  `gorm:"autoCreateTime:milli"`
+}
+
+type DBEmailVerificationToken struct {
+	ID         uint64 `gorm:"primaryKey;autoIncrement:false"`
+	CustomerID uint64 `gorm:"index;not null"`
+	Email      string `gorm:"type:varchar(320);not null"`
+	TokenHash  []byte `gorm:"type:binary(32);unique;not null"`
+	Used       bool   `gorm:"not null"`
+	ExpiresAt  int64  `gorm:"not null"`
+	UpdatedAt  int64  `gorm:"autoUpdateTime:milli"`
+	CreatedAt  int64  `gorm:"autoCreateTime:milli;index"`
+}
+
+type DBRecoveryCode struct {
+	ID         uint64 `gorm:"primaryKey;autoIncrement:false"`
+	CustomerID uint64 `gorm:"index;not null"`
+	CodeHash   []byte `gorm:"type:binary(32);not null"`
+	Used       bool   `gorm:"not null"`
+	UpdatedAt  int64  `gorm:"autoUpdateTime:milli"`
+	CreatedAt  int64  `gorm:"autoCreateTime:milli"`
+}
+
+type DBOIDCLoginState struct {
+	State        string `gorm:"type:varchar(64);primaryKey"`
+	Provider     string `gorm:"type:varchar(64);not null"`
+	Nonce        string `gorm:"type:varchar(64);not null"`
+	CodeVerifier string `gorm:"type:varchar(64);not null"`
+	ExpiresAt    int64  `gorm:"index;not null"`
+	CreatedAt    int64  `gorm:"autoCreateTime:milli"`
+}
+
+type DBOIDCIdentity struct {
+	Provider   string `gorm:"type:varchar(64);primaryKey"`
+	Subject    string `gorm:"type:varchar(255);primaryKey"`
+	CustomerID uint64 `gorm:"index;not null"`
+	CreatedAt  int64  `gorm:"autoCreateTime:milli"`
 }
 
 // NewDatabaseConnection returns the db connection instance
@@ -38,17 +150,59 @@ func NewDatabaseConnection(config *Config) (*gorm.DB, error) {
 
 // Migrator migrates DB schemas on startup
 type Migrator struct {
-	db *gorm.DB
+	db          *gorm.DB
+	adminEmails []string
 }
 
 // NewMigrator is the factory of Migrator
-func NewMigrator(db *gorm.DB) *Migrator {
+func NewMigrator(config *Config, db *gorm.DB) *Migrator {
 	return &Migrator{
-		db: db,
+		db:          db,
+		adminEmails: config.AdminConfig.Emails,
 	}
 }
 
 // Migrate method migrates db schemas
+// customers created before email verification existed are treated as verified,
+// and bcrypt hashes keep working from the wider password hash column until they are rehashed on login
 func (m *Migrator) Migrate() error {
-	return m.db.AutoMigrate(&DBCustomer{})
+	backfillVerified := m.db.Migrator().HasTable(&DBCustomer{}) && !m.db.Migrator().HasColumn(&DBCustomer{}, "EmailVerified")
+	if m.db.Migrator().HasTable(&DBCustomer{}) && m.db.Migrator().HasColumn(&DBCustomer{}, "bcrypted_password") {
+		if err := m.db.Migrator().RenameColumn(&DBCustomer{}, "bcrypted_password", "password_hash"); err != nil {
+			return err
+		}
+	}
+	if err := m.db.AutoMigrate(&DBCustomer{}, &DBRefreshToken{}, &DBRevokedToken{}, &DBPasswordResetToken{}, &DBEmailVerificationToken{}, &DBRecoveryCode{}, &DBOIDCLoginState{}, &DBOIDCIdentity{}, &DBAuditLog{}, &DBCustomerRole{}, &DBPersonalToken{}, &DBSession{}); err != nil {
+		return err
+	}
+	if backfillVerified {
+		if err := m.db.Model(&DBCustomer{}).Where("1 = 1").Update("email_verified", true).Error; err != nil {
+			return err
+		}
+	}
+	return m.grantAdmins()
+}
+
+// grantAdmins makes the customers with the configured admin emails admins
+// only verified emails are trusted, so that nobody becomes admin by signing up with an admin email first
+func (m *Migrator) grantAdmins() error {
+	if len(m.adminEmails) == 0 {
+		return nil
+	}
+	var customerIDs []uint64
+	if err := m.db.Model(&DBCustomer{}).Where("email IN ? AND email_verified = ?", m.adminEmails, true).
+		Pluck("id", &customerIDs).Error; err != nil {
+		return err
+	}
+	if len(customerIDs) == 0 {
+		return nil
+	}
+	roles := make([]*DBCustomerRole, len(customerIDs))
+	for i, customerID := range customerIDs {
+		roles[i] = &DBCustomerRole{
+			CustomerID: customerID,
+			Role:       AdminRole,
+		}
+	}
+	return m.db.Clauses(clause.OnConflict{DoNothing: true}).Create(roles).Error
 }
@@ -9,23 +9,175 @@ type AuthPayload struct {
 
 // AuthResponse value object
 type AuthResponse struct {
-	CustomerID uint64
-	Expired    bool
+	CustomerID    uint64
+	TokenID       uint64
+	SessionID     uint64
+	ExpiresAt     int64
+	EmailVerified bool
+	MFAEnabled    bool
+	Roles         []string
+	Expired       bool
+	// PersonalToken tells that the request was authenticated by a personal access token limited to Scopes
+	PersonalToken bool
+	Scopes        []string
 }
 
 // JWTClaims defines JWT claim attributes
+// the token ID is carried in the registered jti claim
+// SessionID is the refresh token family both tokens of a pair belong to
+// MFAPending marks the short-lived token of a login that still needs its second factor
+// IssuedAtMilli is when the token was issued in milliseconds, since iat only has seconds
+// and tokens issued right after a logout-all have to be told apart from the revoked ones
 type JWTClaims struct {
-	CustomerID uint64
-	Refresh    bool
+	CustomerID    uint64
+	SessionID     uint64
+	Refresh       bool
+	MFAPending    bool     `json:",omitempty"`
+	Roles         []string `json:",omitempty"`
+	IssuedAtMilli int64    `json:",omitempty"`
 	jwt.RegisteredClaims
 }
 
+// issuedAtMilli returns when the token was issued in milliseconds
+// tokens issued before the IssuedAtMilli claim existed fall back to iat
+func (c *JWTClaims) issuedAtMilli() int64 {
+	if c.IssuedAtMilli != 0 {
+		return c.IssuedAtMilli
+	}
+	return c.IssuedAt.UnixMilli()
+}
+
+// CustomerTokenStatus holds what decides whether a customer's tokens are still accepted
+// tokens issued before TokensValidAfter (in milliseconds) are revoked
+type CustomerTokenStatus struct {
+	Active           bool
+	EmailVerified    bool
+	TOTPEnabled      bool
+	TokensValidAfter int64
+}
+
+// LoginLockout is the failed login state of a customer
+// times are in milliseconds, and logins are rejected until LockedUntil
+type LoginLockout struct {
+	FailedLogins      int   `json:"failed_logins"`
+	LastFailedLoginAt int64 `json:"last_failed_login_at"`
+	LockedUntil       int64 `json:"locked_until"`
+}
+
+// RefreshTokenRecord tracks an issued refresh token and the rotation family it belongs to
+// every refresh token can be used once; presenting a used one again revokes the whole family
+type RefreshTokenRecord struct {
+	ID         uint64
+	FamilyID   uint64
+	CustomerID uint64
+	Used       bool
+	Revoked    bool
+	ExpiresAt  int64
+}
+
+// SessionRecord tracks a login and the device it was made from
+// its id is the id of the refresh token family the login started, so it lasts as long as the family can be refreshed
+type SessionRecord struct {
+	ID              uint64
+	CustomerID      uint64
+	UserAgent       string
+	IP              string
+	LastRefreshedAt int64
+	CreatedAt       int64
+}
+
+// ClientInfo describes the device a request comes from
+type ClientInfo struct {
+	UserAgent string
+	IP        string
+}
+
+// PasswordResetTokenRecord tracks an issued password reset token
+// only the SHA-256 hash of the token is stored
+type PasswordResetTokenRecord struct {
+	ID         uint64
+	CustomerID uint64
+	TokenHash  []byte
+	ExpiresAt  int64
+}
+
+// EmailVerificationTokenRecord tracks an issued email verification token
+// the token only verifies the email it was sent to
+type EmailVerificationTokenRecord struct {
+	ID         uint64
+	CustomerID uint64
+	Email      string
+	TokenHash  []byte
+	ExpiresAt  int64
+}
+
+// CustomerEmail is the email of a customer and whether it is verified
+type CustomerEmail struct {
+	Email         string
+	EmailVerified bool
+}
+
+// CustomerMFA is the two-factor authentication state of a customer
+// TOTPSecret is set while enrolling, and TOTPEnabled once the enrollment is confirmed
+type CustomerMFA struct {
+	Email        string
+	TOTPSecret   string
+	TOTPEnabled  bool
+	TOTPLastStep int64
+}
+
+// RecoveryCodeRecord is an issued one-time recovery code
+// only the SHA-256 hash of the code is stored
+type RecoveryCodeRecord struct {
+	ID       uint64
+	CodeHash []byte
+}
+
+// OIDCLoginState is the state of an authorization code flow between redirecting to the identity provider
+// and its callback
+type OIDCLoginState struct {
+	State        string
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	ExpiresAt    int64
+}
+
+// OIDCIdentity links the subject of an identity provider to a customer
+type OIDCIdentity struct {
+	Provider   string
+	Subject    string
+	CustomerID uint64
+}
+
+// PersonalTokenRecord tracks an issued personal access token
+// ExpiresAt is in seconds and zero for tokens that never expire, LastUsedAt is in milliseconds
+type PersonalTokenRecord struct {
+	ID         uint64
+	CustomerID uint64
+	Name       string
+	TokenHash  []byte
+	Scopes     []string
+	ExpiresAt  int64
+	Revoked    bool
+	LastUsedAt int64
+	CreatedAt  int64
+}
+
+// LoginResult holds either a token pair, or the pending token of a login that needs a TOTP code
+type LoginResult struct {
+	AccessToken  string
+	RefreshToken string
+	MFAToken     string
+}
+
 // Customer entity
 type Customer struct {
-	ID           uint64
-	Active       bool
-	Password     string
-	PersonalInfo *CustomerPersonalInfo
+	ID            uint64
+	Active        bool
+	EmailVerified bool
+	Password      string
+	PersonalInfo  *CustomerPersonalInfo
 }
 
 // CustomerPersonalInfo value object
@@ -55,6 +207,13 @@ type SignUpCustomer struct {
 	Email     string `json:"email" binding:"required,email"`
 }
 
+// ChangePassword request payload
+// NewPassword follows the same rules as the password of SignUpCustomer
+type ChangePassword struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required,min=8,max=128"`
+}
+
 // LoginCustomer request payload
 type LoginCustomer struct {
 	Email    string `json:"email" binding:"required,email"`
@@ -66,8 +225,186 @@ type RefreshToken struct {
 	RefreshToken string `json:"refresh_token" binding:"required"`
 }
 
+// ForgotPassword request payload
+type ForgotPassword struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// ResetPassword request payload
+type ResetPassword struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,min=8,max=128"`
+}
+
+// VerifyEmail request payload
+type VerifyEmail struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// MFACode request payload
+// Code is a TOTP code, or a recovery code where allowed
+type MFACode struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// MFALogin request payload
+type MFALogin struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+// MFAChallenge response payload of a login that needs a TOTP code
+type MFAChallenge struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+}
+
+// TOTPEnrollment response payload
+// URI is the otpauth URI to render as a QR code
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// RecoveryCodes response payload
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
 // TokenPair response payload
 type TokenPair struct {
 	RefreshToken string `json:"refresh_token"`
 	AccessToken  string `json:"access_token"`
 }
+
+// AdminCustomer is a customer as seen by admins
+// times are in milliseconds
+type AdminCustomer struct {
+	ID            uint64   `json:"id,string"`
+	FirstName     string   `json:"firstname"`
+	LastName      string   `json:"lastname"`
+	Email         string   `json:"email"`
+	Active        bool     `json:"active"`
+	EmailVerified bool     `json:"email_verified"`
+	TOTPEnabled   bool     `json:"mfa_enabled"`
+	Bot           bool     `json:"bot"`
+	Roles         []string `json:"roles" gorm:"-"`
+	FailedLogins  int      `json:"failed_logins"`
+	LockedUntil   int64    `json:"locked_until"`
+	CreatedAt     int64    `json:"created_at"`
+}
+
+// AuditLogRecord records an action of an admin on a customer
+type AuditLogRecord struct {
+	ID         uint64 `json:"id,string"`
+	ActorID    uint64 `json:"actor_id,string"`
+	Action     string `json:"action"`
+	CustomerID uint64 `json:"customer_id,string"`
+	Detail     string `json:"detail,omitempty"`
+	CreatedAt  int64  `json:"created_at"`
+}
+
+// Pagination query parameters, pages start from 1
+type Pagination struct {
+	Page     int `form:"page" binding:"omitempty,min=1"`
+	PageSize int `form:"page_size" binding:"omitempty,min=1,max=100"`
+}
+
+// CustomerQuery query parameters of customer listing
+// Search matches part of the email or name
+type CustomerQuery struct {
+	Pagination
+	Search string `form:"q" binding:"max=320"`
+}
+
+// AuditLogQuery query parameters of audit log listing
+// a non-empty CustomerID only lists actions on that customer
+type AuditLogQuery struct {
+	Pagination
+	CustomerID uint64 `form:"customer_id"`
+}
+
+// CustomerPage response payload
+type CustomerPage struct {
+	Customers []*AdminCustomer `json:"customers"`
+	Total     int64            `json:"total"`
+	Page      int              `json:"page"`
+	PageSize  int              `json:"page_size"`
+}
+
+// AuditLogPage response payload
+type AuditLogPage struct {
+	AuditLogs []*AuditLogRecord `json:"audit_logs"`
+	Total     int64             `json:"total"`
+	Page      int               `json:"page"`
+	PageSize  int               `json:"page_size"`
+}
+
+// CustomerRoles request payload
+// the member role is implied, so Roles only lists the roles granted on top of it
+type CustomerRoles struct {
+	Roles []string `json:"roles" binding:"max=8,dive,oneof=admin moderator member"`
+}
+
+// NewPersonalToken request payload
+// ExpiresAt is in seconds, and a token without it never expires
+type NewPersonalToken struct {
+	Name      string   `json:"name" binding:"required,max=100"`
+	Scopes    []string `json:"scopes" binding:"required,min=1,max=5,dive,oneof=profile:read profile:write services:read services:write roles"`
+	ExpiresAt int64    `json:"expires_at" binding:"min=0"`
+}
+
+// PersonalToken response payload
+// the token itself is only returned once, by CreatedPersonalToken
+type PersonalToken struct {
+	ID         uint64   `json:"id,string"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	ExpiresAt  int64    `json:"expires_at"`
+	LastUsedAt int64    `json:"last_used_at"`
+	CreatedAt  int64    `json:"created_at"`
+}
+
+// CreatedPersonalToken response payload
+type CreatedPersonalToken struct {
+	PersonalToken
+	Token string `json:"token"`
+}
+
+// PersonalTokens response payload
+type PersonalTokens struct {
+	Tokens []*PersonalToken `json:"tokens"`
+}
+
+// NewBot request payload
+type NewBot struct {
+	Name string `json:"name" binding:"required,max=50"`
+}
+
+// Bot is a customer owned by another customer, which authenticates with personal access tokens only
+type Bot struct {
+	ID        uint64 `json:"id,string"`
+	Name      string `json:"name"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// Bots response payload
+type Bots struct {
+	Bots []*Bot `json:"bots"`
+}
+
+// Session response payload
+// Current tells the session of the access token the request was made with
+type Session struct {
+	ID              uint64 `json:"id,string"`
+	UserAgent       string `json:"user_agent"`
+	IP              string `json:"ip"`
+	Current         bool   `json:"current"`
+	LastRefreshedAt int64  `json:"last_refreshed_at"`
+	CreatedAt       int64  `json:"created_at"`
+}
+
+// Sessions response payload
+type Sessions struct {
+	Sessions []*Session `json:"sessions"`
+}
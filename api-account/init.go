@@ -5,21 +5,45 @@ func InitializeServer() (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	engine := NewEngine(config)
+	engine, err := NewEngine(config)
+	if err != nil {
+		return nil, err
+	}
 	gormDB, err := NewDatabaseConnection(config)
 	if err != nil {
 		return nil, err
 	}
-	jwtAuthRepository := NewJWTAuthRepository(gormDB)
+	passwordHasher, err := NewPasswordHasher(config)
+	if err != nil {
+		return nil, err
+	}
+	passwordPolicy, err := NewPasswordPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+	jwtAuthRepository := NewJWTAuthRepository(gormDB, passwordHasher)
 	idGenerator, err := NewSonyFlake()
 	if err != nil {
 		return nil, err
 	}
-	jwtAuthService := NewJWTAuthService(config, jwtAuthRepository, idGenerator)
+	mailer, err := NewMailer(config)
+	if err != nil {
+		return nil, err
+	}
+	keySet, err := NewKeySet(config)
+	if err != nil {
+		return nil, err
+	}
+	jwtAuthService := NewJWTAuthService(config, jwtAuthRepository, idGenerator, mailer, keySet, passwordHasher, passwordPolicy)
 	customerRepository := NewCustomerRepository(gormDB)
 	customerService := NewCustomerService(config, customerRepository)
-	router := NewRouter(jwtAuthService, customerService)
-	jwtAuthChecker := NewJWTAuthChecker(config, jwtAuthService)
+	oidcService := NewOIDCService(config, jwtAuthRepository, jwtAuthService, idGenerator)
+	adminRepository := NewAdminRepository(gormDB)
+	adminService := NewAdminService(config, adminRepository, jwtAuthService, idGenerator)
+	personalTokenRepository := NewPersonalTokenRepository(gormDB, passwordHasher)
+	personalTokenService := NewPersonalTokenService(config, personalTokenRepository, jwtAuthRepository, idGenerator)
+	router := NewRouter(config, jwtAuthService, customerService, oidcService, adminService, personalTokenService, keySet)
+	jwtAuthChecker := NewJWTAuthChecker(config, jwtAuthService, personalTokenService)
 	server := NewServer(config, engine, router, jwtAuthChecker)
 	return server, nil
 }
@@ -33,6 +57,6 @@ func InitializeMigrator() (*Migrator, error) {
 	if err != nil {
 		return nil, err
 	}
-	migrator := NewMigrator(gormDB)
+	migrator := NewMigrator(configConfig, gormDB)
 	return migrator, nil
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/golang-jwt/jwt/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// RS256Algorithm signs tokens with RSASSA-PKCS1-v1_5 and SHA-256
+	RS256Algorithm = "RS256"
+	// EdDSAAlgorithm signs tokens with Ed25519
+	EdDSAAlgorithm = "EdDSA"
+
+	// ephemeralKeyID is the kid of the key generated when no key is configured
+	ephemeralKeyID = "ephemeral"
+)
+
+// SigningKey is a key tokens are signed or verified with
+// retired keys only have a public key, so that tokens they signed stay valid until they expire
+type SigningKey struct {
+	ID         string
+	Method     jwt.SigningMethod
+	PrivateKey crypto.Signer
+	PublicKey  crypto.PublicKey
+}
+
+// KeySet holds the keys of the tokens api-account issues
+// the active key signs new tokens, and every key verifies tokens carrying its kid
+type KeySet struct {
+	active *SigningKey
+	keys   map[string]*SigningKey
+	order  []string
+}
+
+// NewKeySet is the factory of KeySet
+// a key has to be configured, unless AllowEphemeralKey lets development setups generate an Ed25519 key at startup,
+// whose tokens do not survive restarts and cannot be verified across instances
+func NewKeySet(config *Config) (*KeySet, error) {
+	keySet := &KeySet{
+		keys: make(map[string]*SigningKey),
+	}
+	if len(config.JWTConfig.Keys) == 0 {
+		if !config.JWTConfig.AllowEphemeralKey {
+			return nil, errors.New("no jwt signing key configured; configure jwtConfig.keys or JWT_KEYS, or set JWT_ALLOW_EPHEMERAL_KEY for development")
+		}
+		log.Warn("no jwt signing key configured, generating an ephemeral key")
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		key := &SigningKey{
+			ID:         ephemeralKeyID,
+			Method:     jwt.SigningMethodEdDSA,
+			PrivateKey: privateKey,
+			PublicKey:  publicKey,
+		}
+		keySet.add(key)
+		keySet.active = key
+		return keySet, nil
+	}
+
+	for _, keyConfig := range config.JWTConfig.Keys {
+		key, err := loadSigningKey(keyConfig)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := keySet.keys[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate jwt key id: %s", key.ID)
+		}
+		keySet.add(key)
+	}
+	active, ok := keySet.keys[config.JWTConfig.ActiveKeyID]
+	if !ok {
+		return nil, fmt.Errorf("active jwt key not found: %s", config.JWTConfig.ActiveKeyID)
+	}
+	if active.PrivateKey == nil {
+		return nil, fmt.Errorf("active jwt key has no private key: %s", active.ID)
+	}
+	keySet.active = active
+	return keySet, nil
+}
+
+func (ks *KeySet) add(key *SigningKey) {
+	ks.keys[key.ID] = key
+	ks.order = append(ks.order, key.ID)
+}
+
+// Sign signs claims with the active key and sets the kid header
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.active.Method, claims)
+	token.Header["kid"] = ks.active.ID
+	return token.SignedString(ks.active.PrivateKey)
+}
+
+// Keyfunc finds the public key of a token by its kid, and rejects tokens whose algorithm does not match the key
+func (ks *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, fmt.Errorf("missing kid")
+	}
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid: %s", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.PublicKey, nil
+}
+
+// JWKS returns the public keys as a JSON Web Key Set
+func (ks *KeySet) JWKS() *jose.JSONWebKeySet {
+	jwks := &jose.JSONWebKeySet{
+		Keys: make([]jose.JSONWebKey, 0, len(ks.order)),
+	}
+	for _, kid := range ks.order {
+		key := ks.keys[kid]
+		jwks.Keys = append(jwks.Keys, jose.JSONWebKey{
+			Key:       key.PublicKey,
+			KeyID:     key.ID,
+			Algorithm: key.Method.Alg(),
+			Use:       "sig",
+		})
+	}
+	return jwks
+}
+
+// loadSigningKey reads a PEM encoded private key, or a public key for retired keys
+func loadSigningKey(keyConfig *JWTKeyConfig) (*SigningKey, error) {
+	if keyConfig.ID == "" {
+		return nil, fmt.Errorf("jwt key without id")
+	}
+	key := &SigningKey{
+		ID: keyConfig.ID,
+	}
+	path := keyConfig.PrivateKeyFile
+	if path == "" {
+		path = keyConfig.PublicKeyFile
+	}
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jwt key %s: %w", keyConfig.ID, err)
+	}
+
+	switch keyConfig.Algorithm {
+	case RS256Algorithm:
+		key.Method = jwt.SigningMethodRS256
+		if keyConfig.PrivateKeyFile != "" {
+			privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse jwt key %s: %w", keyConfig.ID, err)
+			}
+			key.PrivateKey, key.PublicKey = privateKey, &privateKey.PublicKey
+		} else {
+			publicKey, err := jwt.ParseRSAPublicKeyFromPEM(pem)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse jwt key %s: %w", keyConfig.ID, err)
+			}
+			key.PublicKey = publicKey
+		}
+		if key.PublicKey.(*rsa.PublicKey).Size() < 256 {
+			return nil, fmt.Errorf("jwt key %s is shorter than 2048 bits", keyConfig.ID)
+		}
+	case EdDSAAlgorithm:
+		key.Method = jwt.SigningMethodEdDSA
+		if keyConfig.PrivateKeyFile != "" {
+			privateKey, err := jwt.ParseEdPrivateKeyFromPEM(pem)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse jwt key %s: %w", keyConfig.ID, err)
+			}
+			key.PrivateKey, key.PublicKey = privateKey.(ed25519.PrivateKey), privateKey.(ed25519.PrivateKey).Public()
+		} else {
+			publicKey, err := jwt.ParseEdPublicKeyFromPEM(pem)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse jwt key %s: %w", keyConfig.ID, err)
+			}
+			key.PublicKey = publicKey
+		}
+	default:
+		return nil, fmt.Errorf("unsupported algorithm of jwt key %s: %s", keyConfig.ID, keyConfig.Algorithm)
+	}
+	return key, nil
+}
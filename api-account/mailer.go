@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SMTPMailDriver sends mails through an SMTP server
+	SMTPMailDriver = "smtp"
+	// LogMailDriver writes mails to the log, or to a file if one is configured
+	LogMailDriver = "log"
+)
+
+// Mail is an outgoing email
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails to customers
+type Mailer interface {
+	Send(ctx context.Context, mail *Mail) error
+}
+
+// NewMailer is the factory of Mailer
+func NewMailer(config *Config) (Mailer, error) {
+	switch config.MailConfig.Driver {
+	case SMTPMailDriver:
+		return NewSMTPMailer(config), nil
+	case LogMailDriver, "":
+		return NewLogMailer(config), nil
+	default:
+		return nil, fmt.Errorf("unknown mail driver: %s", config.MailConfig.Driver)
+	}
+}
+
+// SMTPMailer implements Mailer with an SMTP server
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPMailer is the factory of SMTPMailer
+// PLAIN authentication is used when a username is configured
+func NewSMTPMailer(config *Config) *SMTPMailer {
+	mailConfig := config.MailConfig
+	mailer := &SMTPMailer{
+		addr: net.JoinHostPort(mailConfig.SMTPHost, mailConfig.SMTPPort),
+		from: mailConfig.From,
+	}
+	if mailConfig.SMTPUsername != "" {
+		mailer.auth = smtp.PlainAuth("", mailConfig.SMTPUsername, mailConfig.SMTPPassword, mailConfig.SMTPHost)
+	}
+	return mailer
+}
+
+// Send sends a mail through the SMTP server
+func (m *SMTPMailer) Send(ctx context.Context, mail *Mail) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{mail.To}, formatMail(m.from, mail))
+}
+
+// LogMailer implements Mailer by logging mails instead of sending them, for local development
+type LogMailer struct {
+	mu       sync.Mutex
+	from     string
+	filePath string
+}
+
+// NewLogMailer is the factory of LogMailer
+// mails are appended to FilePath if it is set, and logged otherwise
+func NewLogMailer(config *Config) *LogMailer {
+	return &LogMailer{
+		from:     config.MailConfig.From,
+		filePath: config.MailConfig.FilePath,
+	}
+}
+
+// Send writes a mail to the log or the mail file
+func (m *LogMailer) Send(ctx context.Context, mail *Mail) error {
+	msg := formatMail(m.from, mail)
+	if m.filePath == "" {
+		log.Infof("mail to %s:\n%s", mail.To, msg)
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(msg, "\r\n"...))
+	return err
+}
+
+func formatMail(from string, mail *Mail) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", mail.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mail.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(mail.Body, "\n", "\r\n"))
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
@@ -37,6 +37,7 @@ func extractToken(r *http.Request) string {
 }
 
 // JWTAuth authorize a request by checking jwt token in the Authentication header
+// a personal access token is accepted in place of a jwt token
 func (m *JWTAuthChecker) JWTAuth() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		accessToken := extractToken(c.Request)
@@ -44,9 +45,15 @@ func (m *JWTAuthChecker) JWTAuth() gin.HandlerFunc {
 			c.AbortWithStatus(http.StatusUnauthorized)
 			return
 		}
-		authResult, err := m.authSvc.Auth(c.Request.Context(), &AuthPayload{
-			AccessToken: accessToken,
-		})
+		var authResult *AuthResponse
+		var err error
+		if isPersonalToken(accessToken) {
+			authResult, err = m.patSvc.Auth(c.Request.Context(), accessToken)
+		} else {
+			authResult, err = m.authSvc.Auth(c.Request.Context(), &AuthPayload{
+				AccessToken: accessToken,
+			})
+		}
 		if err != nil {
 			log.Error(err)
 			c.AbortWithStatus(http.StatusUnauthorized)
@@ -58,7 +65,65 @@ func (m *JWTAuthChecker) JWTAuth() gin.HandlerFunc {
 			})
 			return
 		}
-		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), CustomerKey, authResult.CustomerID))
+		ctx := context.WithValue(c.Request.Context(), CustomerKey, authResult.CustomerID)
+		c.Request = c.Request.WithContext(context.WithValue(ctx, AuthKey, authResult))
+		c.Next()
+	}
+}
+
+// RequireSession rejects requests authenticated by a personal access token
+// it has to run after JWTAuth
+func (m *JWTAuthChecker) RequireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		auth, ok := c.Request.Context().Value(AuthKey).(*AuthResponse)
+		if !ok {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		if auth.PersonalToken {
+			c.AbortWithStatusJSON(http.StatusForbidden, ErrResponse{
+				Message: ErrSessionRequired.Error(),
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireScope rejects requests authenticated by a personal access token without scope
+// it has to run after JWTAuth
+func (m *JWTAuthChecker) RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		auth, ok := c.Request.Context().Value(AuthKey).(*AuthResponse)
+		if !ok {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		if !hasScope(auth, scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, ErrResponse{
+				Message: ErrInsufficientScope.Error(),
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequirePermission only lets customers whose access token carries a role granting permission through
+// it has to run after JWTAuth
+func (m *JWTAuthChecker) RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		auth, ok := c.Request.Context().Value(AuthKey).(*AuthResponse)
+		if !ok {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		if !hasPermission(auth.Roles, permission) {
+			c.AbortWithStatusJSON(http.StatusForbidden, ErrResponse{
+				Message: ErrForbidden.Error(),
+			})
+			return
+		}
 		c.Next()
 	}
 }
@@ -66,11 +131,13 @@ func (m *JWTAuthChecker) JWTAuth() gin.HandlerFunc {
 // JWTAuthChecker is the jwt authorization middleware type
 type JWTAuthChecker struct {
 	authSvc JWTAuthService
+	patSvc  PersonalTokenService
 }
 
 // NewJWTAuthChecker is the factory of JWTAuthChecker
-func NewJWTAuthChecker(config *Config, authSvc JWTAuthService) *JWTAuthChecker {
+func NewJWTAuthChecker(config *Config, authSvc JWTAuthService, patSvc PersonalTokenService) *JWTAuthChecker {
 	return &JWTAuthChecker{
 		authSvc: authSvc,
+		patSvc:  patSvc,
 	}
 }
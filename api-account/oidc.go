@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+var (
+	// ErrOIDCProviderNotFound is unknown OIDC provider error
+	ErrOIDCProviderNotFound = errors.New("oidc provider not found")
+	// ErrInvalidOIDCState is invalid or expired OIDC login state error
+	ErrInvalidOIDCState = errors.New("invalid oidc state")
+	// ErrOIDCAuthentication is failed OIDC code exchange or ID token validation error
+	ErrOIDCAuthentication = errors.New("oidc authentication failed")
+	// ErrOIDCEmailNotVerified is returned when the identity provider does not vouch for the email of the identity
+	ErrOIDCEmailNotVerified = errors.New("oidc email not verified")
+	// ErrOIDCNotLinked is returned when no customer can be linked and auto-provisioning is disabled
+	ErrOIDCNotLinked = errors.New("oidc identity not linked")
+)
+
+const (
+	// oidcRandomBytes is the entropy of states, nonces and PKCE code verifiers
+	oidcRandomBytes = 32
+	// maxNameLength is the length of the first and last name columns
+	maxNameLength = 50
+)
+
+// oidcIDTokenClaims are the ID token claims used to link or provision customers
+type oidcIDTokenClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	GivenName     string `json:"given_name"`
+	FamilyName    string `json:"family_name"`
+}
+
+// OIDCService signs customers in with external OpenID Connect identity providers
+type OIDCService interface {
+	AuthCodeURL(ctx context.Context, providerName string) (string, error)
+	Callback(ctx context.Context, providerName string, code string, state string, client *ClientInfo) (*LoginResult, error)
+}
+
+// OIDCServiceImpl implements OIDCService interface
+type OIDCServiceImpl struct {
+	providers         map[string]*oidcProvider
+	stateExpireSecond int64
+	jwtAuthRepo       JWTAuthRepository
+	authSvc           JWTAuthService
+	sf                IDGenerator
+}
+
+// oidcProvider discovers its provider metadata on first use, so that an unreachable identity provider
+// does not prevent the server from starting
+type oidcProvider struct {
+	config   *OIDCProviderConfig
+	mu       sync.Mutex
+	oauth2   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewOIDCService is the factory of OIDCService
+func NewOIDCService(config *Config, jwtAuthRepo JWTAuthRepository, authSvc JWTAuthService, sf IDGenerator) OIDCService {
+	providers := make(map[string]*oidcProvider)
+	for _, providerConfig := range config.OIDCConfig.Providers {
+		providers[providerConfig.Name] = &oidcProvider{
+			config: providerConfig,
+		}
+	}
+	return &OIDCServiceImpl{
+		providers:         providers,
+		stateExpireSecond: config.OIDCConfig.StateExpireSecond,
+		jwtAuthRepo:       jwtAuthRepo,
+		authSvc:           authSvc,
+		sf:                sf,
+	}
+}
+
+// AuthCodeURL starts an authorization code flow with PKCE and returns the authorization URL of the provider
+func (svc *OIDCServiceImpl) AuthCodeURL(ctx context.Context, providerName string) (string, error) {
+	provider, ok := svc.providers[providerName]
+	if !ok {
+		return "", ErrOIDCProviderNotFound
+	}
+	oauth2Config, _, err := provider.discover(ctx)
+	if err != nil {
+		log.Error(err.Error())
+		return "", err
+	}
+
+	state, err := newOIDCRandom()
+	if err != nil {
+		log.Error(err.Error())
+		return "", err
+	}
+	nonce, err := newOIDCRandom()
+	if err != nil {
+		log.Error(err.Error())
+		return "", err
+	}
+	codeVerifier, err := newOIDCRandom()
+	if err != nil {
+		log.Error(err.Error())
+		return "", err
+	}
+	if err := svc.jwtAuthRepo.CreateOIDCLoginState(ctx, &OIDCLoginState{
+		State:        state,
+		Provider:     providerName,
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		ExpiresAt:    time.Now().Add(time.Duration(svc.stateExpireSecond) * time.Second).Unix(),
+	}); err != nil {
+		log.Error(err.Error())
+		return "", err
+	}
+	return oauth2Config.AuthCodeURL(state,
+		oidc.Nonce(nonce),
+		oauth2.SetAuthURLParam("code_challenge", pkceChallenge(codeVerifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	), nil
+}
+
+// Callback completes an authorization code flow and signs the customer of the identity in
+// an identity is linked to the customer with the same email if the provider verified the email,
+// or to a newly provisioned customer if the provider allows it
+func (svc *OIDCServiceImpl) Callback(ctx context.Context, providerName string, code string, state string, client *ClientInfo) (*LoginResult, error) {
+	provider, ok := svc.providers[providerName]
+	if !ok {
+		return nil, ErrOIDCProviderNotFound
+	}
+	loginState, err := svc.jwtAuthRepo.ConsumeOIDCLoginState(ctx, state, time.Now().Unix())
+	if err != nil {
+		if err == ErrOIDCLoginStateNotFound {
+			return nil, ErrInvalidOIDCState
+		}
+		log.Error(err.Error())
+		return nil, err
+	}
+	if loginState.Provider != providerName {
+		return nil, ErrInvalidOIDCState
+	}
+	oauth2Config, verifier, err := provider.discover(ctx)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	token, err := oauth2Config.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", loginState.CodeVerifier))
+	if err != nil {
+		log.Warnf("oidc code exchange with %s failed: %v", providerName, err)
+		return nil, ErrOIDCAuthentication
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		log.Warnf("oidc token response of %s has no id token", providerName)
+		return nil, ErrOIDCAuthentication
+	}
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		log.Warnf("oidc id token of %s is invalid: %v", providerName, err)
+		return nil, ErrOIDCAuthentication
+	}
+	if idToken.Nonce != loginState.Nonce {
+		log.Warnf("oidc id token of %s has a mismatched nonce", providerName)
+		return nil, ErrOIDCAuthentication
+	}
+	var claims oidcIDTokenClaims
+	if err := idToken.Claims(&claims); err != nil {
+		log.Warnf("oidc id token claims of %s are malformed: %v", providerName, err)
+		return nil, ErrOIDCAuthentication
+	}
+
+	customerID, err := svc.linkCustomer(ctx, provider.config, idToken.Subject, &claims)
+	if err != nil {
+		return nil, err
+	}
+	return svc.authSvc.IssueLogin(ctx, customerID, client)
+}
+
+// linkCustomer finds the customer an identity is linked to, linking or provisioning one on first sign-in
+func (svc *OIDCServiceImpl) linkCustomer(ctx context.Context, providerConfig *OIDCProviderConfig, subject string, claims *oidcIDTokenClaims) (uint64, error) {
+	customerID, err := svc.jwtAuthRepo.GetOIDCIdentity(ctx, providerConfig.Name, subject)
+	switch err {
+	case nil:
+		return customerID, nil
+	case ErrOIDCIdentityNotFound:
+	default:
+		log.Error(err.Error())
+		return 0, err
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return 0, ErrOIDCEmailNotVerified
+	}
+	identity := &OIDCIdentity{
+		Provider: providerConfig.Name,
+		Subject:  subject,
+	}
+	exist, credentials, err := svc.jwtAuthRepo.GetCustomerCredentials(ctx, claims.Email)
+	if err != nil {
+		log.Error(err.Error())
+		return 0, err
+	}
+	if exist {
+		identity.CustomerID = credentials.ID
+		if err := svc.jwtAuthRepo.LinkOIDCIdentity(ctx, identity); err != nil {
+			log.Error(err.Error())
+			return 0, err
+		}
+		log.Infof("linked %s identity %s to customer %d", providerConfig.Name, subject, credentials.ID)
+		return credentials.ID, nil
+	}
+	if !providerConfig.AutoProvision {
+		return 0, ErrOIDCNotLinked
+	}
+
+	customerID, err = svc.sf.NextID()
+	if err != nil {
+		log.Error(err.Error())
+		return 0, err
+	}
+	// the customer signs in through the identity provider, so its password is never handed out
+	password, err := newOIDCRandom()
+	if err != nil {
+		log.Error(err.Error())
+		return 0, err
+	}
+	firstName, lastName := oidcCustomerName(claims)
+	identity.CustomerID = customerID
+	if err := svc.jwtAuthRepo.CreateOIDCCustomer(ctx, &Customer{
+		ID:            customerID,
+		Active:        true,
+		EmailVerified: true,
+		Password:      password,
+		PersonalInfo: &CustomerPersonalInfo{
+			FirstName: firstName,
+			LastName:  lastName,
+			Email:     claims.Email,
+		},
+	}, identity); err != nil {
+		log.Error(err.Error())
+		return 0, err
+	}
+	log.Infof("provisioned customer %d for %s identity %s", customerID, providerConfig.Name, subject)
+	return customerID, nil
+}
+
+// discover fetches the provider metadata and keys on first use
+func (p *oidcProvider) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.oauth2 != nil {
+		return p.oauth2, p.verifier, nil
+	}
+	// the provider keeps using its context to refresh keys, so it must outlive the request
+	provider, err := oidc.NewProvider(context.Background(), p.config.Issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("oidc discovery of %s failed: %w", p.config.Name, err)
+	}
+	scopes := p.config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+	}
+	p.oauth2 = &oauth2.Config{
+		ClientID:     p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		RedirectURL:  p.config.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       scopes,
+	}
+	p.verifier = provider.Verifier(&oidc.Config{
+		ClientID: p.config.ClientID,
+	})
+	return p.oauth2, p.verifier, nil
+}
+
+func newOIDCRandom() (string, error) {
+	buf := make([]byte, oidcRandomBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// pkceChallenge derives the S256 code challenge of a PKCE code verifier
+func pkceChallenge(codeVerifier string) string {
+	hash := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// oidcCustomerName picks the names of a provisioned customer from the ID token claims
+func oidcCustomerName(claims *oidcIDTokenClaims) (string, string) {
+	firstName, lastName := claims.GivenName, claims.FamilyName
+	if firstName == "" && claims.Name != "" {
+		parts := strings.SplitN(claims.Name, " ", 2)
+		firstName = parts[0]
+		if len(parts) == 2 && lastName == "" {
+			lastName = parts[1]
+		}
+	}
+	if firstName == "" {
+		firstName = strings.SplitN(claims.Email, "@", 2)[0]
+	}
+	if lastName == "" {
+		lastName = "-"
+	}
+	return truncateName(firstName), truncateName(lastName)
+}
+
+func truncateName(name string) string {
+	runes := []rune(name)
+	if len(runes) > maxNameLength {
+		return string(runes[:maxNameLength])
+	}
+	return name
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+)
+
+var (
+	// ErrWeakPassword is returned when a password breaks the password policy
+	ErrWeakPassword = errors.New("password rejected by policy")
+)
+
+const (
+	// TooWeakPasswordReason rejects passwords whose strength score is below the minimum
+	TooWeakPasswordReason = "too_weak"
+	// PersonalInfoPasswordReason rejects passwords containing the name or email of the customer
+	PersonalInfoPasswordReason = "contains_personal_info"
+	// BreachedPasswordReason rejects passwords found in the breached password corpus
+	BreachedPasswordReason = "breached"
+
+	// defaultBreachedFalsePositiveRate is the rate at which never breached passwords are taken for breached ones
+	defaultBreachedFalsePositiveRate = 0.001
+	// maxPasswordScore is the score of the strongest passwords
+	maxPasswordScore = 4
+	// minPersonalInfoLength is the shortest part of a name or email that passwords must not contain,
+	// so that initials do not rule out passwords
+	minPersonalInfoLength = 3
+)
+
+// passwordScoreBits are the estimated bits of entropy a password needs to reach each score above 0
+var passwordScoreBits = [maxPasswordScore]float64{28, 36, 60, 80}
+
+// PasswordPolicyError lists every rule a password breaks
+type PasswordPolicyError struct {
+	Reasons  []string
+	Score    int
+	MinScore int
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrWeakPassword.Error(), strings.Join(e.Reasons, ", "))
+}
+
+func (e *PasswordPolicyError) Unwrap() error {
+	return ErrWeakPassword
+}
+
+// PasswordPolicy checks new passwords of customers
+// it applies to passwords customers choose, not to bots, which have none, or to auto-provisioned customers
+type PasswordPolicy struct {
+	minScore           int
+	forbidPersonalInfo bool
+	// breached holds the breached password corpus, or is nil to check no corpus
+	breached *bloomFilter
+}
+
+// NewPasswordPolicy is the factory of PasswordPolicy
+// the breached password corpus is loaded into memory, and a corpus that cannot be read fails startup
+func NewPasswordPolicy(config *Config) (*PasswordPolicy, error) {
+	policyConfig := config.PasswordPolicyConfig
+	if policyConfig.MinScore < 0 || policyConfig.MinScore > maxPasswordScore {
+		return nil, fmt.Errorf("password policy min score must be between 0 and %d", maxPasswordScore)
+	}
+	policy := &PasswordPolicy{
+		minScore:           policyConfig.MinScore,
+		forbidPersonalInfo: policyConfig.ForbidPersonalInfo,
+	}
+	if policyConfig.BreachedCorpusFile != "" {
+		falsePositiveRate := policyConfig.BreachedFalsePositiveRate
+		if falsePositiveRate == 0 {
+			falsePositiveRate = defaultBreachedFalsePositiveRate
+		}
+		if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+			return nil, errors.New("breached password false positive rate must be between 0 and 1")
+		}
+		breached, err := loadBreachedCorpus(policyConfig.BreachedCorpusFile, falsePositiveRate)
+		if err != nil {
+			return nil, err
+		}
+		policy.breached = breached
+	}
+	return policy, nil
+}
+
+// Check returns a *PasswordPolicyError if password breaks the policy for the customer of info, or nil
+func (p *PasswordPolicy) Check(password string, info *CustomerPersonalInfo) error {
+	var reasons []string
+	score := passwordScore(password)
+	if score < p.minScore {
+		reasons = append(reasons, TooWeakPasswordReason)
+	}
+	if p.forbidPersonalInfo && containsPersonalInfo(password, info) {
+		reasons = append(reasons, PersonalInfoPasswordReason)
+	}
+	if p.isBreached(password) {
+		reasons = append(reasons, BreachedPasswordReason)
+	}
+	if len(reasons) == 0 {
+		return nil
+	}
+	return &PasswordPolicyError{
+		Reasons:  reasons,
+		Score:    score,
+		MinScore: p.minScore,
+	}
+}
+
+// isBreached tells whether password is in the breached password corpus
+// a false positive rejects a password that was never breached, at the configured rate
+func (p *PasswordPolicy) isBreached(password string) bool {
+	if p.breached == nil {
+		return false
+	}
+	return p.breached.contains(sha1.Sum([]byte(password)))
+}
+
+// loadBreachedCorpus reads the SHA-1 hashes of breached passwords into a bloom filter
+// the file has one uppercase or lowercase hex HASH[:COUNT] per line, as the Have I Been Pwned downloader writes;
+// it is read twice, first to size the filter for the number of hashes, then to fill it
+func loadBreachedCorpus(path string, falsePositiveRate float64) (*bloomFilter, error) {
+	var n uint64
+	if err := scanBreachedCorpus(path, func([sha1.Size]byte) { n++ }); err != nil {
+		return nil, err
+	}
+	filter := newBloomFilter(n, falsePositiveRate)
+	if err := scanBreachedCorpus(path, filter.add); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+func scanBreachedCorpus(path string, fn func(hash [sha1.Size]byte)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if i := strings.IndexByte(text, ':'); i >= 0 {
+			text = text[:i]
+		}
+		var hash [sha1.Size]byte
+		if len(text) != hex.EncodedLen(sha1.Size) {
+			return fmt.Errorf("malformed breached password hash at %s:%d", path, line)
+		}
+		if _, err := hex.Decode(hash[:], []byte(text)); err != nil {
+			return fmt.Errorf("malformed breached password hash at %s:%d", path, line)
+		}
+		fn(hash)
+	}
+	return scanner.Err()
+}
+
+// passwordScore estimates the strength of a password from 0 to maxPasswordScore
+// the estimate is the entropy of a random password of the same length and character classes,
+// where a character repeating the previous one or continuing a sequence such as abc or 321 counts a quarter
+func passwordScore(password string) int {
+	var lower, upper, digit, symbol, other bool
+	length := 0.0
+	var prev rune
+	step := rune(0)
+	for i, r := range []rune(password) {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+		diff := r - prev
+		switch {
+		case i > 0 && diff == 0:
+			length += 0.25
+		case i > 0 && (diff == 1 || diff == -1) && (i == 1 || diff == step):
+			length += 0.25
+		default:
+			length++
+		}
+		prev, step = r, diff
+	}
+	pool := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+	bits := length * math.Log2(float64(pool))
+	score := 0
+	for score < maxPasswordScore && bits >= passwordScoreBits[score] {
+		score++
+	}
+	return score
+}
+
+// containsPersonalInfo tells whether password contains, regardless of case, the first name, the last name,
+// the email or any word of the local part of the email of a customer
+func containsPersonalInfo(password string, info *CustomerPersonalInfo) bool {
+	if info == nil {
+		return false
+	}
+	password = strings.ToLower(password)
+	email := strings.ToLower(info.Email)
+	parts := []string{strings.ToLower(info.FirstName), strings.ToLower(info.LastName), email}
+	if at := strings.LastIndexByte(email, '@'); at >= 0 {
+		parts = append(parts, email[:at])
+		parts = append(parts, strings.FieldsFunc(email[:at], func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})...)
+	}
+	for _, part := range parts {
+		if len([]rune(part)) >= minPersonalInfoLength && strings.Contains(password, part) {
+			return true
+		}
+	}
+	return false
+}
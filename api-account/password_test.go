@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeBreachedCorpus writes a breached password corpus fixture in the Have I Been Pwned format
+func writeBreachedCorpus(t *testing.T, passwords ...string) string {
+	t.Helper()
+	var corpus strings.Builder
+	for i, password := range passwords {
+		fmt.Fprintf(&corpus, "%X:%d\n", sha1.Sum([]byte(password)), i+1)
+	}
+	path := filepath.Join(t.TempDir(), "pwnedpasswords.txt")
+	if err := os.WriteFile(path, []byte(corpus.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPasswordScore(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		want     int
+	}{
+		{"empty", "", 0},
+		// 8 digits are 26.6 bits and 9 digits 29.9, around the 28 bit threshold of score 1
+		{"8 digits", "90527418", 0},
+		{"9 digits", "905274183", 1},
+		// 7 lowercase letters are 32.9 bits and 8 are 37.6, around the 36 bit threshold of score 2
+		{"7 lowercase", "kqzmfwt", 1},
+		{"8 lowercase", "kqzmfwtx", 2},
+		// 10 letters and digits are 59.5 bits and 11 are 65.5, around the 60 bit threshold of score 3
+		{"10 alphanumerics", "Tr0ub4dXkq", 2},
+		{"11 alphanumerics", "Tr0ub4dXkqz", 3},
+		// 12 of all printable classes are 78.8 bits and 13 are 85.4, around the 80 bit threshold of score 4
+		{"12 mixed", "Tr0ub4d&r3Xq", 3},
+		{"13 mixed", "Tr0ub4d&r3Xqz", 4},
+		{"repeats count a quarter", "aaaaaaaaaaaaaaaa", 0},
+		{"ascending sequence counts a quarter", "abcdefghijklmnop", 0},
+		{"descending sequence counts a quarter", "9876543210987654", 0},
+		{"passphrase", "correct horse battery staple", 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := passwordScore(tt.password); got != tt.want {
+				t.Errorf("passwordScore(%q) = %d, want %d", tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	info := &CustomerPersonalInfo{FirstName: "Ada", LastName: "Lovelace", Email: "ada.lovelace@example.com"}
+	policy, err := NewPasswordPolicy(&Config{
+		PasswordPolicyConfig: &PasswordPolicyConfig{
+			MinScore:           2,
+			ForbidPersonalInfo: true,
+			BreachedCorpusFile: writeBreachedCorpus(t, "password", "123456", "qwerty"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		password    string
+		wantReasons []string
+	}{
+		{"strong", "kqzmfwtx9!", nil},
+		{"too weak", "kqzmfw", []string{TooWeakPasswordReason}},
+		{"contains name", "kqzLovelace9!", []string{PersonalInfoPasswordReason}},
+		{"breached", "password", []string{TooWeakPasswordReason, BreachedPasswordReason}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Check(tt.password, info)
+			if tt.wantReasons == nil {
+				if err != nil {
+					t.Fatalf("Check() error = %v, want nil", err)
+				}
+				return
+			}
+			var policyErr *PasswordPolicyError
+			if !errors.As(err, &policyErr) || !errors.Is(err, ErrWeakPassword) {
+				t.Fatalf("Check() error = %v, want a *PasswordPolicyError", err)
+			}
+			if len(policyErr.Reasons) != len(tt.wantReasons) {
+				t.Fatalf("Check() reasons = %v, want %v", policyErr.Reasons, tt.wantReasons)
+			}
+			for i, reason := range tt.wantReasons {
+				if policyErr.Reasons[i] != reason {
+					t.Errorf("Check() reasons = %v, want %v", policyErr.Reasons, tt.wantReasons)
+				}
+			}
+		})
+	}
+}
+
+func TestNewPasswordPolicyCorpus(t *testing.T) {
+	dir := t.TempDir()
+	malformed := filepath.Join(dir, "malformed.txt")
+	if err := os.WriteFile(malformed, []byte("5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:1\nnot a hash\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name              string
+		file              string
+		falsePositiveRate float64
+		wantErr           bool
+	}{
+		{"no corpus", "", 0, false},
+		{"corpus", writeBreachedCorpus(t, "password"), 0, false},
+		{"missing corpus", filepath.Join(dir, "missing.txt"), 0, true},
+		{"malformed corpus", malformed, 0, true},
+		{"false positive rate out of range", writeBreachedCorpus(t, "password"), 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewPasswordPolicy(&Config{
+				PasswordPolicyConfig: &PasswordPolicyConfig{
+					BreachedCorpusFile:        tt.file,
+					BreachedFalsePositiveRate: tt.falsePositiveRate,
+				},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewPasswordPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
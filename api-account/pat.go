@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrTooManyPersonalTokens is returned when a customer already holds as many tokens as allowed
+	ErrTooManyPersonalTokens = errors.New("too many personal tokens")
+	// ErrTooManyBots is returned when a customer already owns as many bots as allowed
+	ErrTooManyBots = errors.New("too many bots")
+	// ErrInvalidExpiry is returned when a token would expire in the past
+	ErrInvalidExpiry = errors.New("invalid expiry")
+)
+
+const (
+	// personalTokenPrefix tells personal access tokens apart from JWTs in the Authorization header
+	personalTokenPrefix = "sfy_"
+	// botEmailDomain is the reserved domain of the emails bots are created with, as bots receive no mail
+	botEmailDomain = "bots.invalid"
+	// botLastName is the last name of every bot
+	botLastName = "Bot"
+)
+
+const (
+	// ProfileReadScope allows reading the personal info of the token owner
+	ProfileReadScope = "profile:read"
+	// ProfileWriteScope allows updating the personal info of the token owner
+	ProfileWriteScope = "profile:write"
+	// ServicesReadScope allows read-only access to the services behind forwardauth
+	ServicesReadScope = "services:read"
+	// ServicesWriteScope allows full access to the services behind forwardauth
+	ServicesWriteScope = "services:write"
+	// RolesScope lets a token act with the roles of its owner; tokens without it only have the member role
+	RolesScope = "roles"
+)
+
+// PersonalTokenService issues personal access tokens to customers and their bots, and authenticates requests with them
+// tokens and bots can only be managed with a session, never with another personal access token
+type PersonalTokenService interface {
+	Auth(ctx context.Context, token string) (*AuthResponse, error)
+	CreateToken(ctx context.Context, ownerID uint64, customerID uint64, newToken *NewPersonalToken) (*CreatedPersonalToken, error)
+	ListTokens(ctx context.Context, ownerID uint64, customerID uint64) ([]*PersonalToken, error)
+	RevokeToken(ctx context.Context, ownerID uint64, customerID uint64, tokenID uint64) error
+	CreateBot(ctx context.Context, ownerID uint64, name string) (*Bot, error)
+	ListBots(ctx context.Context, ownerID uint64) ([]*Bot, error)
+	DeleteBot(ctx context.Context, ownerID uint64, botID uint64) error
+}
+
+// PersonalTokenServiceImpl implements PersonalTokenService interface
+type PersonalTokenServiceImpl struct {
+	patRepo     PersonalTokenRepository
+	jwtAuthRepo JWTAuthRepository
+	sf          IDGenerator
+	authCache   *TTLCache
+	maxTokens   int64
+	maxBots     int64
+}
+
+// NewPersonalTokenService is the factory of PersonalTokenService
+// authenticated tokens are cached for RevocationCacheSecond, like the revocation state of JWTs
+func NewPersonalTokenService(config *Config, patRepo PersonalTokenRepository, jwtAuthRepo JWTAuthRepository, sf IDGenerator) PersonalTokenService {
+	return &PersonalTokenServiceImpl{
+		patRepo:     patRepo,
+		jwtAuthRepo: jwtAuthRepo,
+		sf:          sf,
+		authCache:   NewTTLCache(time.Duration(config.JWTConfig.RevocationCacheSecond) * time.Second),
+		maxTokens:   config.PersonalTokenConfig.MaxTokens,
+		maxBots:     config.PersonalTokenConfig.MaxBots,
+	}
+}
+
+// isPersonalToken tells whether a bearer token is a personal access token rather than a JWT
+func isPersonalToken(token string) bool {
+	return strings.HasPrefix(token, personalTokenPrefix)
+}
+
+// Auth authenticates a request by a personal access token
+// the last use of a token is recorded whenever it is not cached, so it is accurate to RevocationCacheSecond
+// a token only carries the roles of its owner with RolesScope
+func (svc *PersonalTokenServiceImpl) Auth(ctx context.Context, token string) (*AuthResponse, error) {
+	tokenHash := hashOneTimeToken(token)
+	key := hex.EncodeToString(tokenHash)
+	if cached, ok := svc.authCache.Get(key); ok {
+		auth := cached.(*AuthResponse)
+		if auth.ExpiresAt != 0 && auth.ExpiresAt <= time.Now().Unix() {
+			return nil, ErrInvalidToken
+		}
+		return auth, nil
+	}
+
+	record, err := svc.patRepo.GetPersonalToken(ctx, tokenHash)
+	if err != nil {
+		if err == ErrPersonalTokenNotFound {
+			return nil, ErrInvalidToken
+		}
+		log.Error(err.Error())
+		return nil, err
+	}
+	now := time.Now()
+	if record.Revoked || (record.ExpiresAt != 0 && record.ExpiresAt <= now.Unix()) {
+		return nil, ErrInvalidToken
+	}
+	status, err := svc.jwtAuthRepo.GetCustomerTokenStatus(ctx, record.CustomerID)
+	if err != nil {
+		if err == ErrCustomerNotFound {
+			return nil, ErrInvalidToken
+		}
+		log.Error(err.Error())
+		return nil, err
+	}
+	if !status.Active {
+		return nil, ErrCustomerInactive
+	}
+	// bots have no 2FA of their own, so their tokens stand for their owner
+	mfaEnabled := status.TOTPEnabled
+	ownerID, err := svc.patRepo.GetBotOwner(ctx, record.CustomerID)
+	switch err {
+	case nil:
+		ownerStatus, err := svc.jwtAuthRepo.GetCustomerTokenStatus(ctx, ownerID)
+		if err != nil {
+			if err == ErrCustomerNotFound {
+				return nil, ErrInvalidToken
+			}
+			log.Error(err.Error())
+			return nil, err
+		}
+		if !ownerStatus.Active {
+			return nil, ErrCustomerInactive
+		}
+		mfaEnabled = ownerStatus.TOTPEnabled
+	case ErrBotNotFound:
+	default:
+		log.Error(err.Error())
+		return nil, err
+	}
+	var roles []string
+	if containsString(record.Scopes, RolesScope) {
+		roles, err = svc.jwtAuthRepo.GetCustomerRoles(ctx, record.CustomerID)
+		if err != nil {
+			log.Error(err.Error())
+			return nil, err
+		}
+	}
+	if err := svc.patRepo.TouchPersonalToken(ctx, record.ID, now.UnixMilli()); err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	auth := &AuthResponse{
+		CustomerID:    record.CustomerID,
+		TokenID:       record.ID,
+		ExpiresAt:     record.ExpiresAt,
+		EmailVerified: status.EmailVerified,
+		MFAEnabled:    mfaEnabled,
+		Roles:         customerRoles(roles),
+		PersonalToken: true,
+		Scopes:        record.Scopes,
+	}
+	svc.authCache.Set(key, auth)
+	return auth, nil
+}
+
+// CreateToken issues a personal access token to a customer, or to a bot of the customer
+// the token is only returned here, as only its hash is stored
+func (svc *PersonalTokenServiceImpl) CreateToken(ctx context.Context, ownerID uint64, customerID uint64, newToken *NewPersonalToken) (*CreatedPersonalToken, error) {
+	if err := svc.authorize(ctx, ownerID, customerID); err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	if newToken.ExpiresAt != 0 && newToken.ExpiresAt <= now {
+		return nil, ErrInvalidExpiry
+	}
+	count, err := svc.patRepo.CountPersonalTokens(ctx, customerID, now)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	if count >= svc.maxTokens {
+		return nil, ErrTooManyPersonalTokens
+	}
+
+	tokenID, err := svc.sf.NextID()
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	secret, _, err := newOneTimeToken()
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	token := personalTokenPrefix + secret
+	record := &PersonalTokenRecord{
+		ID:         tokenID,
+		CustomerID: customerID,
+		Name:       newToken.Name,
+		TokenHash:  hashOneTimeToken(token),
+		Scopes:     normalizeScopes(newToken.Scopes),
+		ExpiresAt:  newToken.ExpiresAt,
+	}
+	if err := svc.patRepo.CreatePersonalToken(ctx, record); err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	log.Infof("customer %d issued personal token %d to customer %d", ownerID, tokenID, customerID)
+	record.CreatedAt = time.Now().UnixMilli()
+	return &CreatedPersonalToken{
+		PersonalToken: *newPersonalToken(record),
+		Token:         token,
+	}, nil
+}
+
+// ListTokens lists the usable tokens of a customer, or of a bot of the customer
+func (svc *PersonalTokenServiceImpl) ListTokens(ctx context.Context, ownerID uint64, customerID uint64) ([]*PersonalToken, error) {
+	if err := svc.authorize(ctx, ownerID, customerID); err != nil {
+		return nil, err
+	}
+	records, err := svc.patRepo.ListPersonalTokens(ctx, customerID, time.Now().Unix())
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	tokens := make([]*PersonalToken, len(records))
+	for i, record := range records {
+		tokens[i] = newPersonalToken(record)
+	}
+	return tokens, nil
+}
+
+// RevokeToken revokes a token of a customer, or of a bot of the customer
+func (svc *PersonalTokenServiceImpl) RevokeToken(ctx context.Context, ownerID uint64, customerID uint64, tokenID uint64) error {
+	if err := svc.authorize(ctx, ownerID, customerID); err != nil {
+		return err
+	}
+	tokenHash, err := svc.patRepo.RevokePersonalToken(ctx, customerID, tokenID)
+	if err != nil {
+		if err != ErrPersonalTokenNotFound {
+			log.Error(err.Error())
+		}
+		return err
+	}
+	svc.authCache.Delete(hex.EncodeToString(tokenHash))
+	return nil
+}
+
+// CreateBot creates a bot owned by a customer
+// a bot is a verified customer without a password, so it can only authenticate with personal access tokens
+func (svc *PersonalTokenServiceImpl) CreateBot(ctx context.Context, ownerID uint64, name string) (*Bot, error) {
+	count, err := svc.patRepo.CountBots(ctx, ownerID)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	if count >= svc.maxBots {
+		return nil, ErrTooManyBots
+	}
+	botID, err := svc.sf.NextID()
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	if err := svc.patRepo.CreateBot(ctx, &Customer{
+		ID:            botID,
+		Active:        true,
+		EmailVerified: true,
+		PersonalInfo: &CustomerPersonalInfo{
+			FirstName: name,
+			LastName:  botLastName,
+			Email:     "bot-" + strconv.FormatUint(botID, 10) + "@" + botEmailDomain,
+		},
+	}, ownerID); err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	log.Infof("customer %d created bot %d", ownerID, botID)
+	return &Bot{
+		ID:        botID,
+		Name:      name,
+		CreatedAt: time.Now().UnixMilli(),
+	}, nil
+}
+
+// ListBots lists the bots of a customer
+func (svc *PersonalTokenServiceImpl) ListBots(ctx context.Context, ownerID uint64) ([]*Bot, error) {
+	bots, err := svc.patRepo.ListBots(ctx, ownerID)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	return bots, nil
+}
+
+// DeleteBot deactivates a bot of a customer and revokes its tokens
+func (svc *PersonalTokenServiceImpl) DeleteBot(ctx context.Context, ownerID uint64, botID uint64) error {
+	if ownerID == botID {
+		return ErrBotNotFound
+	}
+	if err := svc.authorize(ctx, ownerID, botID); err != nil {
+		return err
+	}
+	tokenHashes, err := svc.patRepo.DeleteBot(ctx, botID)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	for _, tokenHash := range tokenHashes {
+		svc.authCache.Delete(hex.EncodeToString(tokenHash))
+	}
+	log.Infof("customer %d deleted bot %d", ownerID, botID)
+	return nil
+}
+
+// authorize checks that the tokens of customerID are managed by ownerID, which is either the customer itself or its owner
+func (svc *PersonalTokenServiceImpl) authorize(ctx context.Context, ownerID uint64, customerID uint64) error {
+	if ownerID == customerID {
+		return nil
+	}
+	botOwnerID, err := svc.patRepo.GetBotOwner(ctx, customerID)
+	if err != nil {
+		if err != ErrBotNotFound {
+			log.Error(err.Error())
+		}
+		return err
+	}
+	if botOwnerID != ownerID {
+		return ErrBotNotFound
+	}
+	return nil
+}
+
+// hasScope checks whether a request may use scope
+// requests authenticated by a session are not limited by scopes
+func hasScope(auth *AuthResponse, scope string) bool {
+	if !auth.PersonalToken {
+		return true
+	}
+	return containsString(auth.Scopes, scope)
+}
+
+// normalizeScopes deduplicates scopes, keeping their order
+func normalizeScopes(scopes []string) []string {
+	normalized := []string{}
+	for _, scope := range scopes {
+		if !containsString(normalized, scope) {
+			normalized = append(normalized, scope)
+		}
+	}
+	return normalized
+}
+
+func newPersonalToken(record *PersonalTokenRecord) *PersonalToken {
+	return &PersonalToken{
+		ID:         record.ID,
+		Name:       record.Name,
+		Scopes:     record.Scopes,
+		ExpiresAt:  record.ExpiresAt,
+		LastUsedAt: record.LastUsedAt,
+		CreatedAt:  record.CreatedAt,
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+const (
+	// AdminRole is the role of customers who manage other customers and their roles
+	AdminRole = "admin"
+	// ModeratorRole is the role of customers who moderate channels and messages of others
+	ModeratorRole = "moderator"
+	// MemberRole is the role every customer has
+	MemberRole = "member"
+)
+
+const (
+	// ReadCustomersPermission allows listing customers and their lockout state
+	ReadCustomersPermission = "customers:read"
+	// ManageCustomersPermission allows activating, deactivating, logging out and unlocking customers
+	ManageCustomersPermission = "customers:manage"
+	// ManageRolesPermission allows granting and revoking roles
+	ManageRolesPermission = "roles:manage"
+	// ReadAuditLogsPermission allows listing admin actions
+	ReadAuditLogsPermission = "audit_logs:read"
+)
+
+// rolePermissions are the permissions each role grants
+// moderation of channels and messages is enforced by api-store from the roles themselves
+var rolePermissions = map[string][]string{
+	AdminRole: {
+		ReadCustomersPermission,
+		ManageCustomersPermission,
+		ManageRolesPermission,
+		ReadAuditLogsPermission,
+	},
+	ModeratorRole: {
+		ReadCustomersPermission,
+	},
+	MemberRole: {},
+}
+
+// hasPermission checks whether any of roles grants permission
+func hasPermission(roles []string, permission string) bool {
+	for _, role := range roles {
+		for _, granted := range rolePermissions[role] {
+			if granted == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// customerRoles returns the roles of a customer who was granted roles
+// MemberRole is implied, and granted roles are deduplicated
+func customerRoles(granted []string) []string {
+	roles := []string{MemberRole}
+	for _, role := range granted {
+		if !containsString(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"context"
 	"errors"
+	"strings"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 var (
@@ -13,6 +16,24 @@ var (
 	ErrDuplicateEntry = errors.New("duplicate entry")
 	// ErrCustomerNotFound is customer not found error
 	ErrCustomerNotFound = errors.New("customer not found")
+	// ErrRefreshTokenNotFound is refresh token not found error
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	// ErrPasswordResetTokenNotFound is password reset token not found error
+	ErrPasswordResetTokenNotFound = errors.New("password reset token not found")
+	// ErrMFAStateConflict is returned when the two-factor authentication state of a customer changed concurrently
+	ErrMFAStateConflict = errors.New("mfa state conflict")
+	// ErrOIDCLoginStateNotFound is OIDC login state not found error
+	ErrOIDCLoginStateNotFound = errors.New("oidc login state not found")
+	// ErrOIDCIdentityNotFound is OIDC identity not found error
+	ErrOIDCIdentityNotFound = errors.New("oidc identity not found")
+	// ErrEmailVerificationTokenNotFound is email verification token not found error
+	ErrEmailVerificationTokenNotFound = errors.New("email verification token not found")
+	// ErrSessionNotFound is session not found error
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrPersonalTokenNotFound is personal access token not found error
+	ErrPersonalTokenNotFound = errors.New("personal token not found")
+	// ErrBotNotFound is bot not found error
+	ErrBotNotFound = errors.New("bot not found")
 )
 
 // CustomerRepository is the customer repository interface
@@ -47,16 +68,30 @@ func (repo *CustomerRepositoryImpl) GetCustomerPersonalInfo(ctx context.Context,
 }
 
 // UpdateCustomerInfo updates a customer's personal info
+// changing the email marks the customer as unverified again
 func (repo *CustomerRepositoryImpl) UpdateCustomerPersonalInfo(ctx context.Context, customerID uint64, personalInfo *CustomerPersonalInfo) error {
-	if err := repo.db.Model(&DBCustomer{}).Where("id = ?", customerID).
-		Updates(DBCustomer{
-			FirstName: personalInfo.FirstName,
-			LastName:  personalInfo.LastName,
-			Email:     personalInfo.Email,
-		}).WithContext(ctx).Error; err != nil {
-		return err
-	}
-	return nil
+	return repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var current CustomerEmail
+		if err := tx.Model(&DBCustomer{}).Clauses(clause.Locking{Strength: "UPDATE"}).Select("email", "email_verified").
+			Where("id = ?", customerID).First(&current).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrCustomerNotFound
+			}
+			return err
+		}
+		updates := map[string]interface{}{
+			"first_name": personalInfo.FirstName,
+			"last_name":  personalInfo.LastName,
+			"email":      personalInfo.Email,
+		}
+		if current.Email != personalInfo.Email {
+			updates["email_verified"] = false
+		}
+		if err := tx.Model(&DBCustomer{}).Where("id = ?", customerID).Updates(updates).Error; err != nil {
+			return duplicateEntryError(err)
+		}
+		return nil
+	})
 }
 
 // JWTAuthRepository is the JWTAuth repository interface
@@ -64,18 +99,410 @@ type JWTAuthRepository interface {
 	CheckCustomer(ctx context.Context, customerID uint64) (bool, bool, error)
 	CreateCustomer(ctx context.Context, customer *Customer) error
 	GetCustomerCredentials(ctx context.Context, email string) (bool, *CustomerCredentials, error)
+	GetCustomerCredentialsByID(ctx context.Context, customerID uint64) (*CustomerCredentials, error)
+	ChangePassword(ctx context.Context, customerID uint64, password string, familyID uint64, now int64, check func(info *CustomerPersonalInfo) error) error
+	CreateRefreshToken(ctx context.Context, record *RefreshTokenRecord) error
+	GetRefreshToken(ctx context.Context, tokenID uint64) (*RefreshTokenRecord, error)
+	UseRefreshToken(ctx context.Context, tokenID uint64) (bool, error)
+	RevokeRefreshTokenFamily(ctx context.Context, familyID uint64) error
+	GetCustomerTokenStatus(ctx context.Context, customerID uint64) (*CustomerTokenStatus, error)
+	RevokeToken(ctx context.Context, tokenID uint64, customerID uint64, expiresAt int64) error
+	IsTokenRevoked(ctx context.Context, tokenID uint64) (bool, error)
+	RevokeAllTokens(ctx context.Context, customerID uint64, validAfter int64) error
+	CreatePasswordResetToken(ctx context.Context, record *PasswordResetTokenRecord) error
+	ResetPassword(ctx context.Context, tokenHash []byte, password string, now int64, check func(info *CustomerPersonalInfo) error) (uint64, error)
+	GetCustomerEmail(ctx context.Context, customerID uint64) (*CustomerEmail, error)
+	CreateEmailVerificationToken(ctx context.Context, record *EmailVerificationTokenRecord) error
+	CountEmailVerificationTokens(ctx context.Context, customerID uint64, since int64) (int64, error)
+	VerifyEmail(ctx context.Context, tokenHash []byte, now int64) (uint64, error)
+	GetCustomerMFA(ctx context.Context, customerID uint64) (*CustomerMFA, error)
+	SetTOTPSecret(ctx context.Context, customerID uint64, secret string) error
+	EnableTOTP(ctx context.Context, customerID uint64, step int64, recoveryCodes []*RecoveryCodeRecord) error
+	UseTOTPStep(ctx context.Context, customerID uint64, step int64) (bool, error)
+	UseRecoveryCode(ctx context.Context, customerID uint64, codeHash []byte) (bool, error)
+	ReplaceRecoveryCodes(ctx context.Context, customerID uint64, recoveryCodes []*RecoveryCodeRecord) error
+	DisableTOTP(ctx context.Context, customerID uint64) error
+	CreateOIDCLoginState(ctx context.Context, state *OIDCLoginState) error
+	ConsumeOIDCLoginState(ctx context.Context, state string, now int64) (*OIDCLoginState, error)
+	GetOIDCIdentity(ctx context.Context, provider string, subject string) (uint64, error)
+	LinkOIDCIdentity(ctx context.Context, identity *OIDCIdentity) error
+	CreateOIDCCustomer(ctx context.Context, customer *Customer, identity *OIDCIdentity) error
+	GetCustomerRoles(ctx context.Context, customerID uint64) ([]string, error)
+	GetLoginLockout(ctx context.Context, customerID uint64) (*LoginLockout, error)
+	RecordFailedLogin(ctx context.Context, customerID uint64, fail func(lockout *LoginLockout)) (*LoginLockout, error)
+	ResetFailedLogins(ctx context.Context, customerID uint64) error
+	RehashPassword(ctx context.Context, customerID uint64, currentHash string, password string) error
+	CreateSession(ctx context.Context, session *SessionRecord, now int64) error
+	TouchSession(ctx context.Context, sessionID uint64, now int64) error
+	ListSessions(ctx context.Context, customerID uint64, now int64) ([]*SessionRecord, error)
+	RevokeSession(ctx context.Context, customerID uint64, sessionID uint64, now int64) error
+}
+
+// AdminRepository manages customers on behalf of admins
+type AdminRepository interface {
+	ListCustomers(ctx context.Context, search string, offset int, limit int) ([]*AdminCustomer, int64, error)
+	GetCustomer(ctx context.Context, customerID uint64) (*AdminCustomer, error)
+	SetCustomerActive(ctx context.Context, customerID uint64, active bool) error
+	SetCustomerRoles(ctx context.Context, customerID uint64, roles []string) error
+	CreateAuditLog(ctx context.Context, record *AuditLogRecord) error
+	ListAuditLogs(ctx context.Context, customerID uint64, offset int, limit int) ([]*AuditLogRecord, int64, error)
+}
+
+// AdminRepositoryImpl implements AdminRepository interface
+type AdminRepositoryImpl struct {
+	db *gorm.DB
+}
+
+// NewAdminRepository is the factory of AdminRepository
+func NewAdminRepository(db *gorm.DB) AdminRepository {
+	return &AdminRepositoryImpl{
+		db: db,
+	}
+}
+
+// adminCustomerColumns are the columns of AdminCustomer
+var adminCustomerColumns = []string{"id", "first_name", "last_name", "email", "active", "email_verified", "totp_enabled", "bot", "failed_logins", "locked_until", "created_at"}
+
+// ListCustomers lists customers whose email or name contains search, newest first
+// it also returns how many customers match in total
+func (repo *AdminRepositoryImpl) ListCustomers(ctx context.Context, search string, offset int, limit int) ([]*AdminCustomer, int64, error) {
+	query := repo.db.WithContext(ctx).Model(&DBCustomer{})
+	if search != "" {
+		pattern := "%" + likeEscaper.Replace(search) + "%"
+		query = query.Where("email LIKE ? OR first_name LIKE ? OR last_name LIKE ?", pattern, pattern, pattern)
+	}
+	// a new session lets counting and finding share the conditions
+	query = query.Session(&gorm.Session{})
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	customers := []*AdminCustomer{}
+	if err := query.Select(adminCustomerColumns).Order("created_at DESC, id DESC").
+		Offset(offset).Limit(limit).Find(&customers).Error; err != nil {
+		return nil, 0, err
+	}
+	if err := repo.loadRoles(ctx, customers); err != nil {
+		return nil, 0, err
+	}
+	return customers, total, nil
+}
+
+// loadRoles fills in the roles of customers
+func (repo *AdminRepositoryImpl) loadRoles(ctx context.Context, customers []*AdminCustomer) error {
+	if len(customers) == 0 {
+		return nil
+	}
+	byID := make(map[uint64]*AdminCustomer, len(customers))
+	customerIDs := make([]uint64, len(customers))
+	for i, customer := range customers {
+		byID[customer.ID] = customer
+		customerIDs[i] = customer.ID
+	}
+	var roles []DBCustomerRole
+	if err := repo.db.WithContext(ctx).Where("customer_id IN ?", customerIDs).
+		Order("created_at, role").Find(&roles).Error; err != nil {
+		return err
+	}
+	granted := make(map[uint64][]string, len(customers))
+	for _, role := range roles {
+		granted[role.CustomerID] = append(granted[role.CustomerID], role.Role)
+	}
+	for customerID, customer := range byID {
+		customer.Roles = customerRoles(granted[customerID])
+	}
+	return nil
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns
+var likeEscaper = strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_")
+
+// GetCustomer finds a customer by customer id
+func (repo *AdminRepositoryImpl) GetCustomer(ctx context.Context, customerID uint64) (*AdminCustomer, error) {
+	var customer AdminCustomer
+	if err := repo.db.WithContext(ctx).Model(&DBCustomer{}).Select(adminCustomerColumns).
+		Where("id = ?", customerID).First(&customer).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrCustomerNotFound
+		}
+		return nil, err
+	}
+	if err := repo.loadRoles(ctx, []*AdminCustomer{&customer}); err != nil {
+		return nil, err
+	}
+	return &customer, nil
+}
+
+// SetCustomerActive activates or deactivates a customer
+func (repo *AdminRepositoryImpl) SetCustomerActive(ctx context.Context, customerID uint64, active bool) error {
+	return repo.db.WithContext(ctx).Model(&DBCustomer{}).Where("id = ?", customerID).
+		Update("active", active).Error
+}
+
+// SetCustomerRoles replaces the roles granted to a customer
+func (repo *AdminRepositoryImpl) SetCustomerRoles(ctx context.Context, customerID uint64, roles []string) error {
+	return repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("customer_id = ?", customerID).Delete(&DBCustomerRole{}).Error; err != nil {
+			return err
+		}
+		if len(roles) == 0 {
+			return nil
+		}
+		dbRoles := make([]*DBCustomerRole, len(roles))
+		for i, role := range roles {
+			dbRoles[i] = &DBCustomerRole{
+				CustomerID: customerID,
+				Role:       role,
+			}
+		}
+		return tx.Create(dbRoles).Error
+	})
+}
+
+// CreateAuditLog records an admin action
+func (repo *AdminRepositoryImpl) CreateAuditLog(ctx context.Context, record *AuditLogRecord) error {
+	return repo.db.WithContext(ctx).Create(&DBAuditLog{
+		ID:         record.ID,
+		ActorID:    record.ActorID,
+		Action:     record.Action,
+		CustomerID: record.CustomerID,
+		Detail:     record.Detail,
+	}).Error
+}
+
+// ListAuditLogs lists admin actions, newest first, on a customer or on every customer if customerID is zero
+// it also returns how many actions match in total
+func (repo *AdminRepositoryImpl) ListAuditLogs(ctx context.Context, customerID uint64, offset int, limit int) ([]*AuditLogRecord, int64, error) {
+	query := repo.db.WithContext(ctx).Model(&DBAuditLog{})
+	if customerID != 0 {
+		query = query.Where("customer_id = ?", customerID)
+	}
+	query = query.Session(&gorm.Session{})
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	records := []*AuditLogRecord{}
+	if err := query.Order("created_at DESC, id DESC").Offset(offset).Limit(limit).Find(&records).Error; err != nil {
+		return nil, 0, err
+	}
+	return records, total, nil
+}
+
+// PersonalTokenRepository is the repository of personal access tokens and bots
+type PersonalTokenRepository interface {
+	CreatePersonalToken(ctx context.Context, record *PersonalTokenRecord) error
+	CountPersonalTokens(ctx context.Context, customerID uint64, now int64) (int64, error)
+	ListPersonalTokens(ctx context.Context, customerID uint64, now int64) ([]*PersonalTokenRecord, error)
+	GetPersonalToken(ctx context.Context, tokenHash []byte) (*PersonalTokenRecord, error)
+	RevokePersonalToken(ctx context.Context, customerID uint64, tokenID uint64) ([]byte, error)
+	TouchPersonalToken(ctx context.Context, tokenID uint64, now int64) error
+	CreateBot(ctx context.Context, bot *Customer, ownerID uint64) error
+	CountBots(ctx context.Context, ownerID uint64) (int64, error)
+	ListBots(ctx context.Context, ownerID uint64) ([]*Bot, error)
+	GetBotOwner(ctx context.Context, botID uint64) (uint64, error)
+	DeleteBot(ctx context.Context, botID uint64) ([][]byte, error)
+}
+
+// PersonalTokenRepositoryImpl implements PersonalTokenRepository interface
+type PersonalTokenRepositoryImpl struct {
+	db     *gorm.DB
+	hasher *PasswordHasher
+}
+
+// NewPersonalTokenRepository is the factory of PersonalTokenRepository
+func NewPersonalTokenRepository(db *gorm.DB, hasher *PasswordHasher) PersonalTokenRepository {
+	return &PersonalTokenRepositoryImpl{
+		db:     db,
+		hasher: hasher,
+	}
+}
+
+// CreatePersonalToken records a newly issued personal access token
+func (repo *PersonalTokenRepositoryImpl) CreatePersonalToken(ctx context.Context, record *PersonalTokenRecord) error {
+	return repo.db.WithContext(ctx).Create(&DBPersonalToken{
+		ID:         record.ID,
+		CustomerID: record.CustomerID,
+		Name:       record.Name,
+		TokenHash:  record.TokenHash,
+		Scopes:     strings.Join(record.Scopes, ","),
+		ExpiresAt:  record.ExpiresAt,
+	}).Error
+}
+
+// CountPersonalTokens counts the usable tokens of a customer at now (in seconds)
+func (repo *PersonalTokenRepositoryImpl) CountPersonalTokens(ctx context.Context, customerID uint64, now int64) (int64, error) {
+	var count int64
+	if err := repo.usablePersonalTokens(ctx, customerID, now).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// ListPersonalTokens lists the usable tokens of a customer at now (in seconds), newest first
+func (repo *PersonalTokenRepositoryImpl) ListPersonalTokens(ctx context.Context, customerID uint64, now int64) ([]*PersonalTokenRecord, error) {
+	var dbTokens []DBPersonalToken
+	if err := repo.usablePersonalTokens(ctx, customerID, now).Order("created_at DESC, id DESC").
+		Find(&dbTokens).Error; err != nil {
+		return nil, err
+	}
+	records := make([]*PersonalTokenRecord, len(dbTokens))
+	for i := range dbTokens {
+		records[i] = newPersonalTokenRecord(&dbTokens[i])
+	}
+	return records, nil
+}
+
+func (repo *PersonalTokenRepositoryImpl) usablePersonalTokens(ctx context.Context, customerID uint64, now int64) *gorm.DB {
+	return repo.db.WithContext(ctx).Model(&DBPersonalToken{}).
+		Where("customer_id = ? AND revoked = ? AND (expires_at = 0 OR expires_at > ?)", customerID, false, now)
+}
+
+// GetPersonalToken finds a personal access token by its hash
+func (repo *PersonalTokenRepositoryImpl) GetPersonalToken(ctx context.Context, tokenHash []byte) (*PersonalTokenRecord, error) {
+	var dbToken DBPersonalToken
+	if err := repo.db.WithContext(ctx).Where("token_hash = ?", tokenHash).First(&dbToken).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrPersonalTokenNotFound
+		}
+		return nil, err
+	}
+	return newPersonalTokenRecord(&dbToken), nil
+}
+
+func newPersonalTokenRecord(dbToken *DBPersonalToken) *PersonalTokenRecord {
+	return &PersonalTokenRecord{
+		ID:         dbToken.ID,
+		CustomerID: dbToken.CustomerID,
+		Name:       dbToken.Name,
+		TokenHash:  dbToken.TokenHash,
+		Scopes:     strings.Split(dbToken.Scopes, ","),
+		ExpiresAt:  dbToken.ExpiresAt,
+		Revoked:    dbToken.Revoked,
+		LastUsedAt: dbToken.LastUsedAt,
+		CreatedAt:  dbToken.CreatedAt,
+	}
+}
+
+// RevokePersonalToken revokes an unrevoked token of a customer and returns its hash
+func (repo *PersonalTokenRepositoryImpl) RevokePersonalToken(ctx context.Context, customerID uint64, tokenID uint64) ([]byte, error) {
+	var dbToken DBPersonalToken
+	err := repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND customer_id = ? AND revoked = ?", tokenID, customerID, false).First(&dbToken).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrPersonalTokenNotFound
+			}
+			return err
+		}
+		return tx.Model(&DBPersonalToken{}).Where("id = ?", tokenID).Update("revoked", true).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dbToken.TokenHash, nil
+}
+
+// TouchPersonalToken records now (in milliseconds) as the last use of a token
+func (repo *PersonalTokenRepositoryImpl) TouchPersonalToken(ctx context.Context, tokenID uint64, now int64) error {
+	return repo.db.WithContext(ctx).Model(&DBPersonalToken{}).Where("id = ? AND last_used_at < ?", tokenID, now).
+		Update("last_used_at", now).Error
+}
+
+// CreateBot creates a bot customer owned by another customer
+func (repo *PersonalTokenRepositoryImpl) CreateBot(ctx context.Context, bot *Customer, ownerID uint64) error {
+	dbCustomer, err := newDBCustomer(bot, repo.hasher)
+	if err != nil {
+		return err
+	}
+	dbCustomer.Bot = true
+	dbCustomer.OwnerID = ownerID
+	if err := repo.db.WithContext(ctx).Create(dbCustomer).Error; err != nil {
+		return duplicateEntryError(err)
+	}
+	return nil
+}
+
+// CountBots counts the active bots of a customer
+func (repo *PersonalTokenRepositoryImpl) CountBots(ctx context.Context, ownerID uint64) (int64, error) {
+	var count int64
+	if err := repo.db.WithContext(ctx).Model(&DBCustomer{}).
+		Where("owner_id = ? AND bot = ? AND active = ?", ownerID, true, true).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// ListBots lists the active bots of a customer, oldest first
+func (repo *PersonalTokenRepositoryImpl) ListBots(ctx context.Context, ownerID uint64) ([]*Bot, error) {
+	var dbCustomers []DBCustomer
+	if err := repo.db.WithContext(ctx).Select("id", "first_name", "created_at").
+		Where("owner_id = ? AND bot = ? AND active = ?", ownerID, true, true).
+		Order("created_at, id").Find(&dbCustomers).Error; err != nil {
+		return nil, err
+	}
+	bots := make([]*Bot, len(dbCustomers))
+	for i, dbCustomer := range dbCustomers {
+		bots[i] = &Bot{
+			ID:        dbCustomer.ID,
+			Name:      dbCustomer.FirstName,
+			CreatedAt: dbCustomer.CreatedAt,
+		}
+	}
+	return bots, nil
+}
+
+// GetBotOwner finds the owner of an active bot
+func (repo *PersonalTokenRepositoryImpl) GetBotOwner(ctx context.Context, botID uint64) (uint64, error) {
+	var dbCustomer DBCustomer
+	if err := repo.db.WithContext(ctx).Select("owner_id").
+		Where("id = ? AND bot = ? AND active = ?", botID, true, true).First(&dbCustomer).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, ErrBotNotFound
+		}
+		return 0, err
+	}
+	return dbCustomer.OwnerID, nil
+}
+
+// DeleteBot deactivates a bot and revokes its tokens, and returns the hashes of the revoked tokens
+// the bot customer is kept, so that what it wrote still names it
+func (repo *PersonalTokenRepositoryImpl) DeleteBot(ctx context.Context, botID uint64) ([][]byte, error) {
+	var tokenHashes [][]byte
+	err := repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&DBCustomer{}).Where("id = ? AND bot = ?", botID, true).
+			Update("active", false).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&DBPersonalToken{}).Where("customer_id = ? AND revoked = ?", botID, false).
+			Pluck("token_hash", &tokenHashes).Error; err != nil {
+			return err
+		}
+		return tx.Model(&DBPersonalToken{}).Where("customer_id = ? AND revoked = ?", botID, false).
+			Update("revoked", true).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokenHashes, nil
 }
 
 // JWTAuthRepositoryImpl implements JWTAuthRepository interface
 type JWTAuthRepositoryImpl struct {
-	db *gorm.DB
+	db     *gorm.DB
+	hasher *PasswordHasher
 }
 
 // CustomerCredentials encapsulates customer credentials
+// bots have no password, so their PasswordHash is empty
 type CustomerCredentials struct {
-	ID               uint64
-	Active           bool
-	BcryptedPassword string
+	ID           uint64
+	Active       bool
+	Bot          bool
+	PasswordHash string
+	TOTPEnabled  bool
+	FailedLogins int
+	LockedUntil  int64
 }
 
 type customerCheckStatus struct {
@@ -83,9 +510,10 @@ type customerCheckStatus struct {
 }
 
 // NewJWTAuthRepository is the factory of JWTAuthRepository
-func NewJWTAuthRepository(db *gorm.DB) JWTAuthRepository {
+func NewJWTAuthRepository(db *gorm.DB, hasher *PasswordHasher) JWTAuthRepository {
 	return &JWTAuthRepositoryImpl{
-		db: db,
+		db:     db,
+		hasher: hasher,
 	}
 }
 
@@ -105,31 +533,50 @@ func (repo *JWTAuthRepositoryImpl) CheckCustomer(ctx context.Context, customerID
 // CreateCustomer creates a new customer
 // it returns error if ID or email duplicates
 func (repo *JWTAuthRepositoryImpl) CreateCustomer(ctx context.Context, customer *Customer) error {
-	bcryptedPassword, err := HashPassword(customer.Password)
+	dbCustomer, err := newDBCustomer(customer, repo.hasher)
 	if err != nil {
 		return err
 	}
-	if err := repo.db.Create(&DBCustomer{
-		ID:               customer.ID,
-		Active:           customer.Active,
-		FirstName:        customer.PersonalInfo.FirstName,
-		LastName:         customer.PersonalInfo.LastName,
-		Email:            customer.PersonalInfo.Email,
-		BcryptedPassword: bcryptedPassword,
-	}).WithContext(ctx).Error; err != nil {
-		var mysqlErr *mysql.MySQLError
-		if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
-			return ErrDuplicateEntry
-		}
-		return err
+	if err := repo.db.Create(dbCustomer).WithContext(ctx).Error; err != nil {
+		return duplicateEntryError(err)
 	}
 	return nil
 }
 
+// a customer without a password, such as a bot, gets an empty hash that no password verifies against
+func newDBCustomer(customer *Customer, hasher *PasswordHasher) (*DBCustomer, error) {
+	var passwordHash string
+	if customer.Password != "" {
+		var err error
+		passwordHash, err = hasher.Hash(customer.Password)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &DBCustomer{
+		ID:            customer.ID,
+		Active:        customer.Active,
+		FirstName:     customer.PersonalInfo.FirstName,
+		LastName:      customer.PersonalInfo.LastName,
+		Email:         customer.PersonalInfo.Email,
+		PasswordHash:  passwordHash,
+		EmailVerified: customer.EmailVerified,
+	}, nil
+}
+
+// duplicateEntryError maps MySQL duplicate key errors to ErrDuplicateEntry
+func duplicateEntryError(err error) error {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+		return ErrDuplicateEntry
+	}
+	return err
+}
+
 // GetCustomerCredentials finds customer credentials by customer id
 func (repo *JWTAuthRepositoryImpl) GetCustomerCredentials(ctx context.Context, email string) (bool, *CustomerCredentials, error) {
 	var credentials CustomerCredentials
-	if err := repo.db.Model(&DBCustomer{}).Select("id", "active", "bcrypted_password").
+	if err := repo.db.Model(&DBCustomer{}).Select("id", "active", "bot", "password_hash", "totp_enabled", "failed_logins", "locked_until").
 		Where("email = ?", email).First(&credentials).WithContext(ctx).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return false, nil, nil
@@ -138,3 +585,616 @@ func (repo *JWTAuthRepositoryImpl) GetCustomerCredentials(ctx context.Context, e
 	}
 	return true, &credentials, nil
 }
+
+// GetCustomerCredentialsByID finds customer credentials by customer id
+func (repo *JWTAuthRepositoryImpl) GetCustomerCredentialsByID(ctx context.Context, customerID uint64) (*CustomerCredentials, error) {
+	var credentials CustomerCredentials
+	if err := repo.db.WithContext(ctx).Model(&DBCustomer{}).Select("id", "active", "bot", "password_hash", "totp_enabled", "failed_logins", "locked_until").
+		Where("id = ?", customerID).First(&credentials).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrCustomerNotFound
+		}
+		return nil, err
+	}
+	return &credentials, nil
+}
+
+// RehashPassword replaces the password hash of a customer by a hash of the configured algorithm and parameters
+// the hash is only replaced if it is still currentHash, so that a password changed meanwhile is kept
+func (repo *JWTAuthRepositoryImpl) RehashPassword(ctx context.Context, customerID uint64, currentHash string, password string) error {
+	passwordHash, err := repo.hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	return repo.db.WithContext(ctx).Model(&DBCustomer{}).Where("id = ? AND password_hash = ?", customerID, currentHash).
+		Update("password_hash", passwordHash).Error
+}
+
+// ChangePassword sets a new password of a customer and records now (in milliseconds) as its change time
+// all tokens of the customer issued before now are revoked, and so are the refresh tokens of every other family;
+// the unused refresh tokens of familyID are marked used so that only a pair issued afterwards can continue the session;
+// nothing changes if check rejects the password for the personal info of the customer
+func (repo *JWTAuthRepositoryImpl) ChangePassword(ctx context.Context, customerID uint64, password string, familyID uint64, now int64, check func(info *CustomerPersonalInfo) error) error {
+	passwordHash, err := repo.hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	return repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := checkPassword(tx, customerID, check); err != nil {
+			return err
+		}
+		if err := tx.Model(&DBCustomer{}).Where("id = ?", customerID).Updates(map[string]interface{}{
+			"password_hash":       passwordHash,
+			"password_changed_at": now,
+			"tokens_valid_after":  now,
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&DBRefreshToken{}).
+			Where("customer_id = ? AND family_id <> ? AND revoked = ?", customerID, familyID, false).
+			Update("revoked", true).Error; err != nil {
+			return err
+		}
+		return tx.Model(&DBRefreshToken{}).Where("family_id = ? AND used = ?", familyID, false).
+			Update("used", true).Error
+	})
+}
+
+// CreateRefreshToken records a newly issued refresh token
+func (repo *JWTAuthRepositoryImpl) CreateRefreshToken(ctx context.Context, record *RefreshTokenRecord) error {
+	return repo.db.WithContext(ctx).Create(&DBRefreshToken{
+		ID:         record.ID,
+		FamilyID:   record.FamilyID,
+		CustomerID: record.CustomerID,
+		ExpiresAt:  record.ExpiresAt,
+	}).Error
+}
+
+// GetRefreshToken finds a refresh token record by token id
+func (repo *JWTAuthRepositoryImpl) GetRefreshToken(ctx context.Context, tokenID uint64) (*RefreshTokenRecord, error) {
+	var token DBRefreshToken
+	if err := repo.db.WithContext(ctx).Where("id = ?", tokenID).First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrRefreshTokenNotFound
+		}
+		return nil, err
+	}
+	return &RefreshTokenRecord{
+		ID:         token.ID,
+		FamilyID:   token.FamilyID,
+		CustomerID: token.CustomerID,
+		Used:       token.Used,
+		Revoked:    token.Revoked,
+		ExpiresAt:  token.ExpiresAt,
+	}, nil
+}
+
+// UseRefreshToken marks a refresh token as used
+// it returns false if the token was already used, so that concurrent rotations cannot both succeed
+func (repo *JWTAuthRepositoryImpl) UseRefreshToken(ctx context.Context, tokenID uint64) (bool, error) {
+	result := repo.db.WithContext(ctx).Model(&DBRefreshToken{}).
+		Where("id = ? AND used = ? AND revoked = ?", tokenID, false, false).
+		Update("used", true)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// RevokeRefreshTokenFamily revokes every refresh token rotated from the same login
+func (repo *JWTAuthRepositoryImpl) RevokeRefreshTokenFamily(ctx context.Context, familyID uint64) error {
+	return repo.db.WithContext(ctx).Model(&DBRefreshToken{}).
+		Where("family_id = ?", familyID).
+		Update("revoked", true).Error
+}
+
+// liveSession matches the sessions whose refresh token family still has a token that can be refreshed at now (in seconds)
+// every kind of logout revokes refresh tokens, so this is the only state a session needs
+const liveSession = "EXISTS (SELECT 1 FROM db_refresh_tokens WHERE db_refresh_tokens.family_id = db_sessions.id AND used = ? AND revoked = ? AND expires_at > ?)"
+
+// CreateSession records a new session
+// sessions of the customer that ended before now (in seconds) are purged on the way
+func (repo *JWTAuthRepositoryImpl) CreateSession(ctx context.Context, session *SessionRecord, now int64) error {
+	return repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("customer_id = ?", session.CustomerID).Not(liveSession, false, false, now).
+			Delete(&DBSession{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&DBSession{
+			ID:         session.ID,
+			CustomerID: session.CustomerID,
+			UserAgent:  session.UserAgent,
+			IP:         session.IP,
+		}).Error
+	})
+}
+
+// TouchSession records when a session was last refreshed, in milliseconds
+func (repo *JWTAuthRepositoryImpl) TouchSession(ctx context.Context, sessionID uint64, now int64) error {
+	return repo.db.WithContext(ctx).Model(&DBSession{}).Where("id = ?", sessionID).
+		Update("last_refreshed_at", now).Error
+}
+
+// ListSessions lists the sessions of a customer that can still be refreshed at now (in seconds), newest first
+func (repo *JWTAuthRepositoryImpl) ListSessions(ctx context.Context, customerID uint64, now int64) ([]*SessionRecord, error) {
+	var dbSessions []*DBSession
+	if err := repo.db.WithContext(ctx).Where("customer_id = ?", customerID).Where(liveSession, false, false, now).
+		Order("created_at DESC").Find(&dbSessions).Error; err != nil {
+		return nil, err
+	}
+	sessions := make([]*SessionRecord, len(dbSessions))
+	for i, dbSession := range dbSessions {
+		sessions[i] = &SessionRecord{
+			ID:              dbSession.ID,
+			CustomerID:      dbSession.CustomerID,
+			UserAgent:       dbSession.UserAgent,
+			IP:              dbSession.IP,
+			LastRefreshedAt: dbSession.LastRefreshedAt,
+			CreatedAt:       dbSession.CreatedAt,
+		}
+	}
+	return sessions, nil
+}
+
+// RevokeSession revokes the refresh token family of a session of a customer
+// it returns ErrSessionNotFound if the customer has no such session that can still be refreshed at now (in seconds)
+func (repo *JWTAuthRepositoryImpl) RevokeSession(ctx context.Context, customerID uint64, sessionID uint64, now int64) error {
+	return repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&DBSession{}).Where("id = ? AND customer_id = ?", sessionID, customerID).
+			Where(liveSession, false, false, now).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrSessionNotFound
+		}
+		return tx.Model(&DBRefreshToken{}).Where("family_id = ?", sessionID).
+			Update("revoked", true).Error
+	})
+}
+
+// GetCustomerTokenStatus queries whether a customer is active and since when its tokens are valid
+func (repo *JWTAuthRepositoryImpl) GetCustomerTokenStatus(ctx context.Context, customerID uint64) (*CustomerTokenStatus, error) {
+	var status CustomerTokenStatus
+	if err := repo.db.WithContext(ctx).Model(&DBCustomer{}).Select("active", "email_verified", "totp_enabled", "tokens_valid_after").
+		Where("id = ?", customerID).First(&status).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrCustomerNotFound
+		}
+		return nil, err
+	}
+	return &status, nil
+}
+
+// RevokeToken adds a token to the revocation list until it expires
+// revocations of tokens that already expired are purged on the way
+func (repo *JWTAuthRepositoryImpl) RevokeToken(ctx context.Context, tokenID uint64, customerID uint64, expiresAt int64) error {
+	return repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("expires_at < ?", time.Now().Unix()).Delete(&DBRevokedToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&DBRevokedToken{
+			ID:         tokenID,
+			CustomerID: customerID,
+			ExpiresAt:  expiresAt,
+		}).Error
+	})
+}
+
+// IsTokenRevoked checks whether a token is in the revocation list
+func (repo *JWTAuthRepositoryImpl) IsTokenRevoked(ctx context.Context, tokenID uint64) (bool, error) {
+	var count int64
+	if err := repo.db.WithContext(ctx).Model(&DBRevokedToken{}).Where("id = ?", tokenID).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// RevokeAllTokens rejects every token of a customer issued before validAfter (in milliseconds)
+// and revokes all of its refresh tokens
+func (repo *JWTAuthRepositoryImpl) RevokeAllTokens(ctx context.Context, customerID uint64, validAfter int64) error {
+	return repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&DBCustomer{}).Where("id = ?", customerID).
+			Update("tokens_valid_after", validAfter).Error; err != nil {
+			return err
+		}
+		return tx.Model(&DBRefreshToken{}).Where("customer_id = ? AND revoked = ?", customerID, false).
+			Update("revoked", true).Error
+	})
+}
+
+// CreatePasswordResetToken records a newly issued password reset token
+func (repo *JWTAuthRepositoryImpl) CreatePasswordResetToken(ctx context.Context, record *PasswordResetTokenRecord) error {
+	return repo.db.WithContext(ctx).Create(&DBPasswordResetToken{
+		ID:         record.ID,
+		CustomerID: record.CustomerID,
+		TokenHash:  record.TokenHash,
+		ExpiresAt:  record.ExpiresAt,
+	}).Error
+}
+
+// ResetPassword consumes an unused and unexpired password reset token and sets the new password of its customer
+// every other reset token of the customer is consumed as well, and all its tokens issued before now (in milliseconds) are revoked
+// it returns the customer id, or ErrPasswordResetTokenNotFound if the token cannot be used;
+// the token is not consumed if check rejects the password for the personal info of the customer
+func (repo *JWTAuthRepositoryImpl) ResetPassword(ctx context.Context, tokenHash []byte, password string, now int64, check func(info *CustomerPersonalInfo) error) (uint64, error) {
+	passwordHash, err := repo.hasher.Hash(password)
+	if err != nil {
+		return 0, err
+	}
+	var customerID uint64
+	err = repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var token DBPasswordResetToken
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ? AND used = ? AND expires_at > ?", tokenHash, false, now/1000).
+			First(&token).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrPasswordResetTokenNotFound
+			}
+			return err
+		}
+		customerID = token.CustomerID
+		if err := checkPassword(tx, customerID, check); err != nil {
+			return err
+		}
+		if err := tx.Model(&DBPasswordResetToken{}).Where("customer_id = ? AND used = ?", customerID, false).
+			Update("used", true).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&DBCustomer{}).Where("id = ?", customerID).Updates(map[string]interface{}{
+			"password_hash":      passwordHash,
+			"tokens_valid_after": now,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&DBRefreshToken{}).Where("customer_id = ? AND revoked = ?", customerID, false).
+			Update("revoked", true).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	return customerID, nil
+}
+
+// checkPassword runs check with the personal info of a customer within a password change
+func checkPassword(tx *gorm.DB, customerID uint64, check func(info *CustomerPersonalInfo) error) error {
+	var info CustomerPersonalInfo
+	if err := tx.Model(&DBCustomer{}).Select("first_name", "last_name", "email").
+		Where("id = ?", customerID).First(&info).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrCustomerNotFound
+		}
+		return err
+	}
+	return check(&info)
+}
+
+// GetCustomerEmail queries the email of a customer and whether it is verified
+func (repo *JWTAuthRepositoryImpl) GetCustomerEmail(ctx context.Context, customerID uint64) (*CustomerEmail, error) {
+	var email CustomerEmail
+	if err := repo.db.WithContext(ctx).Model(&DBCustomer{}).Select("email", "email_verified").
+		Where("id = ?", customerID).First(&email).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrCustomerNotFound
+		}
+		return nil, err
+	}
+	return &email, nil
+}
+
+// CreateEmailVerificationToken records a newly issued email verification token
+func (repo *JWTAuthRepositoryImpl) CreateEmailVerificationToken(ctx context.Context, record *EmailVerificationTokenRecord) error {
+	return repo.db.WithContext(ctx).Create(&DBEmailVerificationToken{
+		ID:         record.ID,
+		CustomerID: record.CustomerID,
+		Email:      record.Email,
+		TokenHash:  record.TokenHash,
+		ExpiresAt:  record.ExpiresAt,
+	}).Error
+}
+
+// CountEmailVerificationTokens counts the verification tokens issued to a customer since the given time in milliseconds
+func (repo *JWTAuthRepositoryImpl) CountEmailVerificationTokens(ctx context.Context, customerID uint64, since int64) (int64, error) {
+	var count int64
+	if err := repo.db.WithContext(ctx).Model(&DBEmailVerificationToken{}).
+		Where("customer_id = ? AND created_at >= ?", customerID, since).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// VerifyEmail consumes an unused and unexpired email verification token and marks its customer as verified
+// every other verification token of the customer is consumed as well
+// it returns the customer id, or ErrEmailVerificationTokenNotFound if the token cannot be used
+// or the customer changed its email after the token was sent
+func (repo *JWTAuthRepositoryImpl) VerifyEmail(ctx context.Context, tokenHash []byte, now int64) (uint64, error) {
+	var customerID uint64
+	err := repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var token DBEmailVerificationToken
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ? AND used = ? AND expires_at > ?", tokenHash, false, now/1000).
+			First(&token).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrEmailVerificationTokenNotFound
+			}
+			return err
+		}
+		customerID = token.CustomerID
+		result := tx.Model(&DBCustomer{}).Where("id = ? AND email = ?", customerID, token.Email).
+			Update("email_verified", true)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			var count int64
+			if err := tx.Model(&DBCustomer{}).Where("id = ? AND email = ?", customerID, token.Email).
+				Count(&count).Error; err != nil {
+				return err
+			}
+			if count == 0 {
+				return ErrEmailVerificationTokenNotFound
+			}
+		}
+		return tx.Model(&DBEmailVerificationToken{}).Where("customer_id = ? AND used = ?", customerID, false).
+			Update("used", true).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	return customerID, nil
+}
+
+// GetCustomerMFA queries the two-factor authentication state of a customer
+func (repo *JWTAuthRepositoryImpl) GetCustomerMFA(ctx context.Context, customerID uint64) (*CustomerMFA, error) {
+	var mfa CustomerMFA
+	if err := repo.db.WithContext(ctx).Model(&DBCustomer{}).Select("email", "totp_secret", "totp_enabled", "totp_last_step").
+		Where("id = ?", customerID).First(&mfa).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrCustomerNotFound
+		}
+		return nil, err
+	}
+	return &mfa, nil
+}
+
+// SetTOTPSecret stores the secret of a pending TOTP enrollment, replacing any previous pending one
+// it returns ErrMFAStateConflict if TOTP is already enabled
+func (repo *JWTAuthRepositoryImpl) SetTOTPSecret(ctx context.Context, customerID uint64, secret string) error {
+	result := repo.db.WithContext(ctx).Model(&DBCustomer{}).
+		Where("id = ? AND totp_enabled = ?", customerID, false).
+		Update("totp_secret", secret)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrMFAStateConflict
+	}
+	return nil
+}
+
+// EnableTOTP confirms a pending TOTP enrollment with the time step of its first code and stores new recovery codes
+// it returns ErrMFAStateConflict if TOTP is already enabled
+func (repo *JWTAuthRepositoryImpl) EnableTOTP(ctx context.Context, customerID uint64, step int64, recoveryCodes []*RecoveryCodeRecord) error {
+	return repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&DBCustomer{}).
+			Where("id = ? AND totp_enabled = ? AND totp_secret <> ''", customerID, false).
+			Updates(map[string]interface{}{
+				"totp_enabled":   true,
+				"totp_last_step": step,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrMFAStateConflict
+		}
+		return replaceRecoveryCodes(tx, customerID, recoveryCodes)
+	})
+}
+
+// UseTOTPStep records the time step of an accepted TOTP code
+// it returns false if a code of the same or a later step was already accepted, so that codes cannot be replayed
+func (repo *JWTAuthRepositoryImpl) UseTOTPStep(ctx context.Context, customerID uint64, step int64) (bool, error) {
+	result := repo.db.WithContext(ctx).Model(&DBCustomer{}).
+		Where("id = ? AND totp_enabled = ? AND totp_last_step < ?", customerID, true, step).
+		Update("totp_last_step", step)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// UseRecoveryCode consumes an unused recovery code of a customer
+// it returns false if no such code exists
+func (repo *JWTAuthRepositoryImpl) UseRecoveryCode(ctx context.Context, customerID uint64, codeHash []byte) (bool, error) {
+	result := repo.db.WithContext(ctx).Model(&DBRecoveryCode{}).
+		Where("customer_id = ? AND code_hash = ? AND used = ?", customerID, codeHash, false).
+		Limit(1).
+		Update("used", true)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// ReplaceRecoveryCodes invalidates every recovery code of a customer and stores new ones
+func (repo *JWTAuthRepositoryImpl) ReplaceRecoveryCodes(ctx context.Context, customerID uint64, recoveryCodes []*RecoveryCodeRecord) error {
+	return repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return replaceRecoveryCodes(tx, customerID, recoveryCodes)
+	})
+}
+
+// DisableTOTP turns off two-factor authentication of a customer and drops its secret and recovery codes
+func (repo *JWTAuthRepositoryImpl) DisableTOTP(ctx context.Context, customerID uint64) error {
+	return repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&DBCustomer{}).Where("id = ?", customerID).Updates(map[string]interface{}{
+			"totp_secret":    "",
+			"totp_enabled":   false,
+			"totp_last_step": 0,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Where("customer_id = ?", customerID).Delete(&DBRecoveryCode{}).Error
+	})
+}
+
+func replaceRecoveryCodes(tx *gorm.DB, customerID uint64, recoveryCodes []*RecoveryCodeRecord) error {
+	if err := tx.Where("customer_id = ?", customerID).Delete(&DBRecoveryCode{}).Error; err != nil {
+		return err
+	}
+	codes := make([]*DBRecoveryCode, 0, len(recoveryCodes))
+	for _, code := range recoveryCodes {
+		codes = append(codes, &DBRecoveryCode{
+			ID:         code.ID,
+			CustomerID: customerID,
+			CodeHash:   code.CodeHash,
+		})
+	}
+	return tx.Create(&codes).Error
+}
+
+// CreateOIDCLoginState records the state of a new authorization code flow
+// states of flows that expired are purged on the way
+func (repo *JWTAuthRepositoryImpl) CreateOIDCLoginState(ctx context.Context, state *OIDCLoginState) error {
+	return repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("expires_at < ?", time.Now().Unix()).Delete(&DBOIDCLoginState{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&DBOIDCLoginState{
+			State:        state.State,
+			Provider:     state.Provider,
+			Nonce:        state.Nonce,
+			CodeVerifier: state.CodeVerifier,
+			ExpiresAt:    state.ExpiresAt,
+		}).Error
+	})
+}
+
+// ConsumeOIDCLoginState deletes and returns the state of an unexpired authorization code flow, so that it completes once
+func (repo *JWTAuthRepositoryImpl) ConsumeOIDCLoginState(ctx context.Context, state string, now int64) (*OIDCLoginState, error) {
+	var loginState DBOIDCLoginState
+	err := repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("state = ? AND expires_at > ?", state, now).First(&loginState).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrOIDCLoginStateNotFound
+			}
+			return err
+		}
+		return tx.Where("state = ?", state).Delete(&DBOIDCLoginState{}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &OIDCLoginState{
+		State:        loginState.State,
+		Provider:     loginState.Provider,
+		Nonce:        loginState.Nonce,
+		CodeVerifier: loginState.CodeVerifier,
+		ExpiresAt:    loginState.ExpiresAt,
+	}, nil
+}
+
+// GetOIDCIdentity finds the customer an identity is linked to
+func (repo *JWTAuthRepositoryImpl) GetOIDCIdentity(ctx context.Context, provider string, subject string) (uint64, error) {
+	var identity DBOIDCIdentity
+	if err := repo.db.WithContext(ctx).Where("provider = ? AND subject = ?", provider, subject).
+		First(&identity).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, ErrOIDCIdentityNotFound
+		}
+		return 0, err
+	}
+	return identity.CustomerID, nil
+}
+
+// LinkOIDCIdentity links an identity to an existing customer, whose email the identity provider verified
+func (repo *JWTAuthRepositoryImpl) LinkOIDCIdentity(ctx context.Context, identity *OIDCIdentity) error {
+	return repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&DBOIDCIdentity{
+			Provider:   identity.Provider,
+			Subject:    identity.Subject,
+			CustomerID: identity.CustomerID,
+		}).Error; err != nil {
+			return duplicateEntryError(err)
+		}
+		return tx.Model(&DBCustomer{}).Where("id = ?", identity.CustomerID).Update("email_verified", true).Error
+	})
+}
+
+// CreateOIDCCustomer provisions a customer for an identity and links them
+func (repo *JWTAuthRepositoryImpl) CreateOIDCCustomer(ctx context.Context, customer *Customer, identity *OIDCIdentity) error {
+	dbCustomer, err := newDBCustomer(customer, repo.hasher)
+	if err != nil {
+		return err
+	}
+	return repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(dbCustomer).Error; err != nil {
+			return duplicateEntryError(err)
+		}
+		return tx.Create(&DBOIDCIdentity{
+			Provider:   identity.Provider,
+			Subject:    identity.Subject,
+			CustomerID: identity.CustomerID,
+		}).Error
+	})
+}
+
+// GetCustomerRoles finds the roles granted to a customer, oldest first
+// the implied member role is not stored
+func (repo *JWTAuthRepositoryImpl) GetCustomerRoles(ctx context.Context, customerID uint64) ([]string, error) {
+	var roles []string
+	if err := repo.db.WithContext(ctx).Model(&DBCustomerRole{}).Where("customer_id = ?", customerID).
+		Order("created_at, role").Pluck("role", &roles).Error; err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// GetLoginLockout finds the failed login state of a customer
+func (repo *JWTAuthRepositoryImpl) GetLoginLockout(ctx context.Context, customerID uint64) (*LoginLockout, error) {
+	var lockout LoginLockout
+	if err := repo.db.WithContext(ctx).Model(&DBCustomer{}).Select("failed_logins", "last_failed_login_at", "locked_until").
+		Where("id = ?", customerID).First(&lockout).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrCustomerNotFound
+		}
+		return nil, err
+	}
+	return &lockout, nil
+}
+
+// RecordFailedLogin updates the failed login state of a customer with fail
+// the state is locked meanwhile, so that concurrent failures are all counted
+func (repo *JWTAuthRepositoryImpl) RecordFailedLogin(ctx context.Context, customerID uint64, fail func(lockout *LoginLockout)) (*LoginLockout, error) {
+	var lockout LoginLockout
+	err := repo.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&DBCustomer{}).Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("failed_logins", "last_failed_login_at", "locked_until").
+			Where("id = ?", customerID).First(&lockout).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrCustomerNotFound
+			}
+			return err
+		}
+		fail(&lockout)
+		return tx.Model(&DBCustomer{}).Where("id = ?", customerID).Updates(map[string]interface{}{
+			"failed_logins":        lockout.FailedLogins,
+			"last_failed_login_at": lockout.LastFailedLoginAt,
+			"locked_until":         lockout.LockedUntil,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &lockout, nil
+}
+
+// ResetFailedLogins forgets the failed logins of a customer and unlocks its logins
+func (repo *JWTAuthRepositoryImpl) ResetFailedLogins(ctx context.Context, customerID uint64) error {
+	return repo.db.WithContext(ctx).Model(&DBCustomer{}).Where("id = ?", customerID).Updates(map[string]interface{}{
+		"failed_logins":        0,
+		"last_failed_login_at": 0,
+		"locked_until":         0,
+	}).Error
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -15,8 +18,19 @@ var (
 	ErrUnauthorized = errors.New("unauthorized")
 	// ErrServer is server error
 	ErrServer = errors.New("server error")
+	// ErrEmailNotVerified is email not verified error
+	ErrEmailNotVerified = errors.New("email not verified")
+	// ErrForbidden is insufficient role error
+	ErrForbidden = errors.New("forbidden")
+	// ErrSessionRequired is returned when a personal access token is used where only a session is accepted
+	ErrSessionRequired = errors.New("session required")
+	// ErrInsufficientScope is returned when a personal access token lacks the scope of a request
+	ErrInsufficientScope = errors.New("insufficient scope")
 )
 
+// maxUserAgentLength is the longest user agent recorded in a session
+const maxUserAgentLength = 255
+
 // SuccessMessage is the success response type
 type SuccessMessage struct {
 	Message string `json:"msg" example:"ok"`
@@ -32,17 +46,38 @@ type ErrResponse struct {
 	Message string `json:"msg"`
 }
 
+// PasswordPolicyErrResponse is the error response type of passwords rejected by the password policy
+// Reasons are too_weak, contains_personal_info and breached; Score and MinScore are the strength estimate and its minimum
+type PasswordPolicyErrResponse struct {
+	Message  string   `json:"msg"`
+	Reasons  []string `json:"reasons"`
+	Score    int      `json:"score"`
+	MinScore int      `json:"min_score"`
+}
+
 // Router wraps http handlers
 type Router struct {
-	authSvc     JWTAuthService
-	customerSvc CustomerService
+	authSvc          JWTAuthService
+	customerSvc      CustomerService
+	oidcSvc          OIDCService
+	adminSvc         AdminService
+	patSvc           PersonalTokenService
+	keySet           *KeySet
+	unverifiedAccess string
+	mfaRequired      bool
 }
 
 // NewRouter is a factory for router instance
-func NewRouter(authSvc JWTAuthService, customerSvc CustomerService) *Router {
+func NewRouter(config *Config, authSvc JWTAuthService, customerSvc CustomerService, oidcSvc OIDCService, adminSvc AdminService, patSvc PersonalTokenService, keySet *KeySet) *Router {
 	return &Router{
-		authSvc:     authSvc,
-		customerSvc: customerSvc,
+		authSvc:          authSvc,
+		customerSvc:      customerSvc,
+		oidcSvc:          oidcSvc,
+		adminSvc:         adminSvc,
+		patSvc:           patSvc,
+		keySet:           keySet,
+		unverifiedAccess: config.EmailVerificationConfig.UnverifiedAccess,
+		mfaRequired:      config.MFAConfig.Required,
 	}
 }
 
@@ -60,7 +95,10 @@ func (r *Router) SignUp(c *gin.Context) {
 			LastName:  customer.LastName,
 			Email:     customer.Email,
 		},
-	})
+	}, clientInfo(c))
+	if passwordPolicyResponse(c, err) {
+		return
+	}
 	switch err {
 	case ErrDuplicateEntry:
 		response(c, http.StatusBadRequest, ErrDuplicateEntry)
@@ -82,7 +120,13 @@ func (r *Router) Login(c *gin.Context) {
 		response(c, http.StatusBadRequest, ErrInvalidParam)
 		return
 	}
-	accessToken, refreshToken, err := r.authSvc.Login(c.Request.Context(), customer.Email, customer.Password)
+	result, err := r.authSvc.Login(c.Request.Context(), customer.Email, customer.Password, clientInfo(c))
+	var lockedErr *LoginLockedError
+	if errors.As(err, &lockedErr) {
+		c.Header("Retry-After", strconv.FormatInt(int64(math.Ceil(lockedErr.RetryAfter.Seconds())), 10))
+		response(c, http.StatusTooManyRequests, ErrLoginLocked)
+		return
+	}
 	switch err {
 	case ErrCustomerNotFound:
 		response(c, http.StatusNotFound, ErrCustomerNotFound)
@@ -90,6 +134,103 @@ func (r *Router) Login(c *gin.Context) {
 		response(c, http.StatusUnauthorized, ErrCustomerInactive)
 	case ErrAuthentication:
 		response(c, http.StatusUnauthorized, ErrAuthentication)
+	case nil:
+		if result.MFAToken != "" {
+			c.JSON(http.StatusOK, &MFAChallenge{
+				MFARequired: true,
+				MFAToken:    result.MFAToken,
+			})
+			return
+		}
+		c.JSON(http.StatusOK, &TokenPair{
+			RefreshToken: result.RefreshToken,
+			AccessToken:  result.AccessToken,
+		})
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+		return
+	}
+}
+
+// OIDCLogin redirects to the identity provider to sign in
+func (r *Router) OIDCLogin(c *gin.Context) {
+	authURL, err := r.oidcSvc.AuthCodeURL(c.Request.Context(), c.Param("provider"))
+	switch err {
+	case ErrOIDCProviderNotFound:
+		response(c, http.StatusNotFound, ErrOIDCProviderNotFound)
+	case nil:
+		c.Redirect(http.StatusFound, authURL)
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// OIDCCallback completes a sign-in with an identity provider
+// like Login, it returns a token pair, or a pending token for customers with two-factor authentication
+func (r *Router) OIDCCallback(c *gin.Context) {
+	if c.Query("error") != "" {
+		response(c, http.StatusUnauthorized, ErrOIDCAuthentication)
+		return
+	}
+	code, state := c.Query("code"), c.Query("state")
+	if code == "" || state == "" {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	result, err := r.oidcSvc.Callback(c.Request.Context(), c.Param("provider"), code, state, clientInfo(c))
+	switch err {
+	case ErrOIDCProviderNotFound:
+		response(c, http.StatusNotFound, ErrOIDCProviderNotFound)
+	case ErrInvalidOIDCState:
+		response(c, http.StatusBadRequest, ErrInvalidOIDCState)
+	case ErrOIDCAuthentication:
+		response(c, http.StatusUnauthorized, ErrOIDCAuthentication)
+	case ErrOIDCEmailNotVerified:
+		response(c, http.StatusForbidden, ErrOIDCEmailNotVerified)
+	case ErrOIDCNotLinked:
+		response(c, http.StatusForbidden, ErrOIDCNotLinked)
+	case ErrDuplicateEntry:
+		response(c, http.StatusConflict, ErrDuplicateEntry)
+	case ErrCustomerInactive:
+		response(c, http.StatusUnauthorized, ErrCustomerInactive)
+	case nil:
+		if result.MFAToken != "" {
+			c.JSON(http.StatusOK, &MFAChallenge{
+				MFARequired: true,
+				MFAToken:    result.MFAToken,
+			})
+			return
+		}
+		c.JSON(http.StatusOK, &TokenPair{
+			RefreshToken: result.RefreshToken,
+			AccessToken:  result.AccessToken,
+		})
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// LoginMFA completes a two-step login with a TOTP or recovery code
+func (r *Router) LoginMFA(c *gin.Context) {
+	var mfaLogin MFALogin
+	if err := c.ShouldBindJSON(&mfaLogin); err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	accessToken, refreshToken, err := r.authSvc.LoginMFA(c.Request.Context(), mfaLogin.MFAToken, mfaLogin.Code, clientInfo(c))
+	switch err {
+	case ErrInvalidToken:
+		response(c, http.StatusUnauthorized, ErrInvalidToken)
+	case ErrTokenExpired:
+		response(c, http.StatusUnauthorized, ErrTokenExpired)
+	case ErrTokenRevoked:
+		response(c, http.StatusUnauthorized, ErrTokenRevoked)
+	case ErrCustomerInactive:
+		response(c, http.StatusUnauthorized, ErrCustomerInactive)
+	case ErrInvalidMFACode:
+		response(c, http.StatusUnauthorized, ErrInvalidMFACode)
+	case ErrTooManyRequests:
+		response(c, http.StatusTooManyRequests, ErrTooManyRequests)
 	case nil:
 		c.JSON(http.StatusOK, &TokenPair{
 			RefreshToken: refreshToken,
@@ -97,8 +238,110 @@ func (r *Router) Login(c *gin.Context) {
 		})
 	default:
 		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// EnrollTOTP starts a TOTP enrollment
+func (r *Router) EnrollTOTP(c *gin.Context) {
+	customerID, ok := c.Request.Context().Value(CustomerKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, ErrUnauthorized)
+		return
+	}
+	enrollment, err := r.authSvc.EnrollTOTP(c.Request.Context(), customerID)
+	switch err {
+	case ErrCustomerNotFound:
+		response(c, http.StatusNotFound, ErrCustomerNotFound)
+	case ErrMFAAlreadyEnabled:
+		response(c, http.StatusConflict, ErrMFAAlreadyEnabled)
+	case nil:
+		c.JSON(http.StatusOK, enrollment)
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// ConfirmTOTP enables two-factor authentication and returns the recovery codes
+func (r *Router) ConfirmTOTP(c *gin.Context) {
+	var mfaCode MFACode
+	if err := c.ShouldBindJSON(&mfaCode); err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	customerID, ok := c.Request.Context().Value(CustomerKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, ErrUnauthorized)
+		return
+	}
+	codes, err := r.authSvc.ConfirmTOTP(c.Request.Context(), customerID, mfaCode.Code)
+	r.recoveryCodesResponse(c, codes, err)
+}
+
+// DisableTOTP turns off two-factor authentication
+func (r *Router) DisableTOTP(c *gin.Context) {
+	var mfaCode MFACode
+	if err := c.ShouldBindJSON(&mfaCode); err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	customerID, ok := c.Request.Context().Value(CustomerKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, ErrUnauthorized)
+		return
+	}
+	switch err := r.authSvc.DisableTOTP(c.Request.Context(), customerID, mfaCode.Code); err {
+	case ErrCustomerNotFound:
+		response(c, http.StatusNotFound, ErrCustomerNotFound)
+	case ErrMFANotEnabled:
+		response(c, http.StatusConflict, ErrMFANotEnabled)
+	case ErrInvalidMFACode:
+		response(c, http.StatusForbidden, ErrInvalidMFACode)
+	case ErrTooManyRequests:
+		response(c, http.StatusTooManyRequests, ErrTooManyRequests)
+	case nil:
+		c.JSON(http.StatusOK, OkMsg)
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of a customer
+func (r *Router) RegenerateRecoveryCodes(c *gin.Context) {
+	var mfaCode MFACode
+	if err := c.ShouldBindJSON(&mfaCode); err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
 		return
 	}
+	customerID, ok := c.Request.Context().Value(CustomerKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, ErrUnauthorized)
+		return
+	}
+	codes, err := r.authSvc.RegenerateRecoveryCodes(c.Request.Context(), customerID, mfaCode.Code)
+	r.recoveryCodesResponse(c, codes, err)
+}
+
+func (r *Router) recoveryCodesResponse(c *gin.Context, codes []string, err error) {
+	switch err {
+	case ErrCustomerNotFound:
+		response(c, http.StatusNotFound, ErrCustomerNotFound)
+	case ErrMFAAlreadyEnabled:
+		response(c, http.StatusConflict, ErrMFAAlreadyEnabled)
+	case ErrMFANotEnabled:
+		response(c, http.StatusConflict, ErrMFANotEnabled)
+	case ErrMFANotEnrolled:
+		response(c, http.StatusConflict, ErrMFANotEnrolled)
+	case ErrInvalidMFACode:
+		response(c, http.StatusForbidden, ErrInvalidMFACode)
+	case ErrTooManyRequests:
+		response(c, http.StatusTooManyRequests, ErrTooManyRequests)
+	case nil:
+		c.JSON(http.StatusOK, &RecoveryCodes{
+			RecoveryCodes: codes,
+		})
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
 }
 
 // RefreshToken of a customer
@@ -114,6 +357,8 @@ func (r *Router) RefreshToken(c *gin.Context) {
 		response(c, http.StatusUnauthorized, ErrInvalidToken)
 	case ErrTokenExpired:
 		response(c, http.StatusUnauthorized, ErrTokenExpired)
+	case ErrTokenReused:
+		response(c, http.StatusUnauthorized, ErrTokenReused)
 	case ErrCustomerNotFound:
 		response(c, http.StatusNotFound, ErrCustomerNotFound)
 	case ErrCustomerInactive:
@@ -129,12 +374,145 @@ func (r *Router) RefreshToken(c *gin.Context) {
 	}
 }
 
-func (r *Router) Auth(c *gin.Context) {
+// Logout revokes the access token of the request and its session
+func (r *Router) Logout(c *gin.Context) {
+	auth, ok := c.Request.Context().Value(AuthKey).(*AuthResponse)
+	if !ok {
+		response(c, http.StatusUnauthorized, ErrUnauthorized)
+		return
+	}
+	switch err := r.authSvc.Logout(c.Request.Context(), auth); err {
+	case nil:
+		c.JSON(http.StatusOK, OkMsg)
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// LogoutAll revokes every token of the customer
+func (r *Router) LogoutAll(c *gin.Context) {
 	customerID, ok := c.Request.Context().Value(CustomerKey).(uint64)
 	if !ok {
 		response(c, http.StatusUnauthorized, ErrUnauthorized)
 		return
 	}
+	switch err := r.authSvc.LogoutAll(c.Request.Context(), customerID); err {
+	case nil:
+		c.JSON(http.StatusOK, OkMsg)
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// ForgotPassword sends a password reset link to a customer
+func (r *Router) ForgotPassword(c *gin.Context) {
+	var forgotPassword ForgotPassword
+	if err := c.ShouldBindJSON(&forgotPassword); err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	switch err := r.authSvc.ForgotPassword(c.Request.Context(), forgotPassword.Email); err {
+	case nil:
+		c.JSON(http.StatusOK, OkMsg)
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// ResetPassword sets a new password with a password reset token
+func (r *Router) ResetPassword(c *gin.Context) {
+	var resetPassword ResetPassword
+	if err := c.ShouldBindJSON(&resetPassword); err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	err := r.authSvc.ResetPassword(c.Request.Context(), resetPassword.Token, resetPassword.Password)
+	if passwordPolicyResponse(c, err) {
+		return
+	}
+	switch err {
+	case ErrInvalidResetToken:
+		response(c, http.StatusBadRequest, ErrInvalidResetToken)
+	case nil:
+		c.JSON(http.StatusOK, OkMsg)
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// VerifyEmail with the token of a verification mail
+func (r *Router) VerifyEmail(c *gin.Context) {
+	var verifyEmail VerifyEmail
+	if err := c.ShouldBindJSON(&verifyEmail); err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	switch err := r.authSvc.VerifyEmail(c.Request.Context(), verifyEmail.Token); err {
+	case ErrInvalidVerificationToken:
+		response(c, http.StatusBadRequest, ErrInvalidVerificationToken)
+	case nil:
+		c.JSON(http.StatusOK, OkMsg)
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// ResendVerificationEmail sends another verification mail to the customer
+func (r *Router) ResendVerificationEmail(c *gin.Context) {
+	customerID, ok := c.Request.Context().Value(CustomerKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, ErrUnauthorized)
+		return
+	}
+	switch err := r.authSvc.ResendVerificationEmail(c.Request.Context(), customerID); err {
+	case ErrCustomerNotFound:
+		response(c, http.StatusNotFound, ErrCustomerNotFound)
+	case ErrEmailAlreadyVerified:
+		response(c, http.StatusBadRequest, ErrEmailAlreadyVerified)
+	case ErrTooManyRequests:
+		response(c, http.StatusTooManyRequests, ErrTooManyRequests)
+	case nil:
+		c.JSON(http.StatusOK, OkMsg)
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// JWKS publishes the public keys of issued tokens, so that other services can verify them
+func (r *Router) JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, r.keySet.JWKS())
+}
+
+// Auth is the forwardauth endpoint of the reverse proxy
+// it applies the access policies for unverified customers and customers without 2FA, and tells downstream services
+// whether the customer is restricted through the X-User-Restricted header
+func (r *Router) Auth(c *gin.Context) {
+	auth, ok := c.Request.Context().Value(AuthKey).(*AuthResponse)
+	if !ok {
+		response(c, http.StatusUnauthorized, ErrUnauthorized)
+		return
+	}
+	customerID := auth.CustomerID
+	// personal access tokens are held to the 2FA of the customer who owns them, which is the owner for bot tokens
+	if r.mfaRequired && !auth.MFAEnabled {
+		response(c, http.StatusForbidden, ErrMFANotEnabled)
+		return
+	}
+	if !hasScope(auth, ServicesReadScope) && !hasScope(auth, ServicesWriteScope) {
+		response(c, http.StatusForbidden, ErrInsufficientScope)
+		return
+	}
+	restricted := !hasScope(auth, ServicesWriteScope)
+	if !auth.EmailVerified {
+		switch r.unverifiedAccess {
+		case NoUnverifiedAccess:
+			response(c, http.StatusForbidden, ErrEmailNotVerified)
+			return
+		case RestrictedUnverifiedAccess:
+			restricted = true
+		}
+	}
 	info, err := r.customerSvc.GetCustomerPersonalInfo(c.Request.Context(), customerID)
 	if err != nil {
 		response(c, http.StatusInternalServerError, ErrServer)
@@ -142,6 +520,8 @@ func (r *Router) Auth(c *gin.Context) {
 	}
 	c.Writer.Header().Set("X-User-Id", strconv.FormatUint(customerID, 10))
 	c.Writer.Header().Set("X-Username", info.FirstName)
+	c.Writer.Header().Set("X-User-Restricted", strconv.FormatBool(restricted))
+	c.Writer.Header().Set("X-User-Roles", strings.Join(customerRoles(auth.Roles), ","))
 	c.Status(http.StatusOK)
 }
 
@@ -169,6 +549,79 @@ func (r *Router) GetCustomerPersonalInfoWithId(c *gin.Context) {
 	}
 }
 
+// ChangePassword of a customer
+// the response carries a new token pair for the current session, since every older token is revoked
+func (r *Router) ChangePassword(c *gin.Context) {
+	var changePassword ChangePassword
+	if err := c.ShouldBindJSON(&changePassword); err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	auth, ok := c.Request.Context().Value(AuthKey).(*AuthResponse)
+	if !ok {
+		response(c, http.StatusUnauthorized, ErrUnauthorized)
+		return
+	}
+	accessToken, refreshToken, err := r.authSvc.ChangePassword(c.Request.Context(), auth,
+		changePassword.CurrentPassword, changePassword.NewPassword)
+	if passwordPolicyResponse(c, err) {
+		return
+	}
+	switch err {
+	case ErrCustomerNotFound:
+		response(c, http.StatusNotFound, ErrCustomerNotFound)
+	case ErrAuthentication:
+		response(c, http.StatusForbidden, ErrAuthentication)
+	case nil:
+		c.JSON(http.StatusOK, &TokenPair{
+			RefreshToken: refreshToken,
+			AccessToken:  accessToken,
+		})
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// ListSessions lists the sessions of the customer
+func (r *Router) ListSessions(c *gin.Context) {
+	auth, ok := c.Request.Context().Value(AuthKey).(*AuthResponse)
+	if !ok {
+		response(c, http.StatusUnauthorized, ErrUnauthorized)
+		return
+	}
+	sessions, err := r.authSvc.ListSessions(c.Request.Context(), auth)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, &Sessions{
+			Sessions: sessions,
+		})
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// RevokeSession revokes a session of the customer
+func (r *Router) RevokeSession(c *gin.Context) {
+	auth, ok := c.Request.Context().Value(AuthKey).(*AuthResponse)
+	if !ok {
+		response(c, http.StatusUnauthorized, ErrUnauthorized)
+		return
+	}
+	sessionID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	switch err := r.authSvc.RevokeSession(c.Request.Context(), auth, sessionID); err {
+	case ErrSessionNotFound:
+		response(c, http.StatusNotFound, ErrSessionNotFound)
+	case nil:
+		c.JSON(http.StatusOK, OkMsg)
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
 func (r *Router) GetCustomerName(c *gin.Context) {
 	id := c.Param("id")
 	customerID, err := strconv.ParseUint(id, 10, 64)
@@ -209,6 +662,10 @@ func (r *Router) UpdateCustomerPersonalInfo(c *gin.Context) {
 		Email:     personalInfo.Email,
 	})
 	switch err {
+	case ErrDuplicateEntry:
+		response(c, http.StatusBadRequest, ErrDuplicateEntry)
+	case ErrCustomerNotFound:
+		response(c, http.StatusNotFound, ErrCustomerNotFound)
 	case nil:
 		c.JSON(http.StatusOK, OkMsg)
 		return
@@ -224,3 +681,331 @@ func response(c *gin.Context, httpCode int, err error) {
 		Message: message,
 	})
 }
+
+// ListCustomers lists customers for admins
+func (r *Router) ListCustomers(c *gin.Context) {
+	var query CustomerQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	page, err := r.adminSvc.ListCustomers(c.Request.Context(), &query)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, page)
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// GetCustomer shows a customer to admins
+func (r *Router) GetCustomer(c *gin.Context) {
+	customerID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	customer, err := r.adminSvc.GetCustomer(c.Request.Context(), customerID)
+	switch err {
+	case ErrCustomerNotFound:
+		response(c, http.StatusNotFound, ErrCustomerNotFound)
+	case nil:
+		c.JSON(http.StatusOK, customer)
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// ActivateCustomer lets a deactivated customer log in again
+func (r *Router) ActivateCustomer(c *gin.Context) {
+	r.adminAction(c, r.adminSvc.ActivateCustomer)
+}
+
+// DeactivateCustomer stops a customer from logging in and logs it out everywhere
+func (r *Router) DeactivateCustomer(c *gin.Context) {
+	r.adminAction(c, r.adminSvc.DeactivateCustomer)
+}
+
+// LogoutCustomer logs a customer out everywhere
+func (r *Router) LogoutCustomer(c *gin.Context) {
+	r.adminAction(c, r.adminSvc.LogoutCustomer)
+}
+
+// GetCustomerLoginLockout shows the failed login state of a customer to admins
+func (r *Router) GetCustomerLoginLockout(c *gin.Context) {
+	customerID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	lockout, err := r.authSvc.GetLoginLockout(c.Request.Context(), customerID)
+	switch err {
+	case ErrCustomerNotFound:
+		response(c, http.StatusNotFound, ErrCustomerNotFound)
+	case nil:
+		c.JSON(http.StatusOK, lockout)
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// UnlockCustomerLogin lets a customer locked out by failed logins log in again
+func (r *Router) UnlockCustomerLogin(c *gin.Context) {
+	r.adminAction(c, r.adminSvc.UnlockCustomerLogin)
+}
+
+// SetCustomerRoles replaces the roles granted to a customer
+func (r *Router) SetCustomerRoles(c *gin.Context) {
+	actorID, ok := c.Request.Context().Value(CustomerKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, ErrUnauthorized)
+		return
+	}
+	customerID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	var customerRoles CustomerRoles
+	if err := c.ShouldBindJSON(&customerRoles); err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	roles, err := r.adminSvc.SetCustomerRoles(c.Request.Context(), actorID, customerID, customerRoles.Roles)
+	switch err {
+	case ErrCustomerNotFound:
+		response(c, http.StatusNotFound, ErrCustomerNotFound)
+	case ErrSelfAdminAction:
+		response(c, http.StatusConflict, ErrSelfAdminAction)
+	case nil:
+		c.JSON(http.StatusOK, &CustomerRoles{
+			Roles: roles,
+		})
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// ListAuditLogs lists admin actions
+func (r *Router) ListAuditLogs(c *gin.Context) {
+	var query AuditLogQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	page, err := r.adminSvc.ListAuditLogs(c.Request.Context(), &query)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, page)
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// adminAction runs an action of the signed in admin on the customer of the id path parameter
+func (r *Router) adminAction(c *gin.Context, action func(ctx context.Context, actorID uint64, customerID uint64) error) {
+	actorID, ok := c.Request.Context().Value(CustomerKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, ErrUnauthorized)
+		return
+	}
+	customerID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	switch err := action(c.Request.Context(), actorID, customerID); err {
+	case ErrCustomerNotFound:
+		response(c, http.StatusNotFound, ErrCustomerNotFound)
+	case ErrSelfAdminAction:
+		response(c, http.StatusConflict, ErrSelfAdminAction)
+	case nil:
+		c.JSON(http.StatusOK, OkMsg)
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// CreatePersonalToken issues a personal access token to the customer, or to its bot of the id path parameter
+// a customer without 2FA cannot issue tokens while 2FA is required, as the tokens could not be used anyway
+func (r *Router) CreatePersonalToken(c *gin.Context) {
+	ownerID, customerID, ok := tokenOwner(c)
+	if !ok {
+		return
+	}
+	if r.mfaRequired {
+		auth, ok := c.Request.Context().Value(AuthKey).(*AuthResponse)
+		if !ok {
+			response(c, http.StatusUnauthorized, ErrUnauthorized)
+			return
+		}
+		if !auth.MFAEnabled {
+			response(c, http.StatusForbidden, ErrMFANotEnabled)
+			return
+		}
+	}
+	var newToken NewPersonalToken
+	if err := c.ShouldBindJSON(&newToken); err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	token, err := r.patSvc.CreateToken(c.Request.Context(), ownerID, customerID, &newToken)
+	switch err {
+	case ErrBotNotFound:
+		response(c, http.StatusNotFound, ErrBotNotFound)
+	case ErrInvalidExpiry:
+		response(c, http.StatusBadRequest, ErrInvalidExpiry)
+	case ErrTooManyPersonalTokens:
+		response(c, http.StatusConflict, ErrTooManyPersonalTokens)
+	case nil:
+		c.JSON(http.StatusCreated, token)
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// ListPersonalTokens lists the personal access tokens of the customer, or of its bot of the id path parameter
+func (r *Router) ListPersonalTokens(c *gin.Context) {
+	ownerID, customerID, ok := tokenOwner(c)
+	if !ok {
+		return
+	}
+	tokens, err := r.patSvc.ListTokens(c.Request.Context(), ownerID, customerID)
+	switch err {
+	case ErrBotNotFound:
+		response(c, http.StatusNotFound, ErrBotNotFound)
+	case nil:
+		c.JSON(http.StatusOK, &PersonalTokens{
+			Tokens: tokens,
+		})
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// RevokePersonalToken revokes a personal access token of the customer, or of its bot of the id path parameter
+func (r *Router) RevokePersonalToken(c *gin.Context) {
+	ownerID, customerID, ok := tokenOwner(c)
+	if !ok {
+		return
+	}
+	tokenID, err := strconv.ParseUint(c.Param("token_id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	switch err := r.patSvc.RevokeToken(c.Request.Context(), ownerID, customerID, tokenID); err {
+	case ErrBotNotFound:
+		response(c, http.StatusNotFound, ErrBotNotFound)
+	case ErrPersonalTokenNotFound:
+		response(c, http.StatusNotFound, ErrPersonalTokenNotFound)
+	case nil:
+		c.JSON(http.StatusOK, OkMsg)
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// CreateBot creates a bot owned by the customer
+func (r *Router) CreateBot(c *gin.Context) {
+	ownerID, ok := c.Request.Context().Value(CustomerKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, ErrUnauthorized)
+		return
+	}
+	var newBot NewBot
+	if err := c.ShouldBindJSON(&newBot); err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	bot, err := r.patSvc.CreateBot(c.Request.Context(), ownerID, newBot.Name)
+	switch err {
+	case ErrTooManyBots:
+		response(c, http.StatusConflict, ErrTooManyBots)
+	case nil:
+		c.JSON(http.StatusCreated, bot)
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// ListBots lists the bots of the customer
+func (r *Router) ListBots(c *gin.Context) {
+	ownerID, ok := c.Request.Context().Value(CustomerKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, ErrUnauthorized)
+		return
+	}
+	bots, err := r.patSvc.ListBots(c.Request.Context(), ownerID)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, &Bots{
+			Bots: bots,
+		})
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// DeleteBot deactivates a bot of the customer and revokes its tokens
+func (r *Router) DeleteBot(c *gin.Context) {
+	ownerID, customerID, ok := tokenOwner(c)
+	if !ok {
+		return
+	}
+	switch err := r.patSvc.DeleteBot(c.Request.Context(), ownerID, customerID); err {
+	case ErrBotNotFound:
+		response(c, http.StatusNotFound, ErrBotNotFound)
+	case nil:
+		c.JSON(http.StatusOK, OkMsg)
+	default:
+		response(c, http.StatusInternalServerError, ErrServer)
+	}
+}
+
+// tokenOwner returns the signed in customer, and the customer whose tokens are managed:
+// the bot of the id path parameter if there is one, or the signed in customer itself
+func tokenOwner(c *gin.Context) (uint64, uint64, bool) {
+	ownerID, ok := c.Request.Context().Value(CustomerKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, ErrUnauthorized)
+		return 0, 0, false
+	}
+	id := c.Param("id")
+	if id == "" {
+		return ownerID, ownerID, true
+	}
+	customerID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return 0, 0, false
+	}
+	return ownerID, customerID, true
+}
+
+// clientInfo describes the device of a request, as recorded in sessions
+func clientInfo(c *gin.Context) *ClientInfo {
+	userAgent := []rune(c.Request.UserAgent())
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	return &ClientInfo{
+		UserAgent: string(userAgent),
+		IP:        c.ClientIP(),
+	}
+}
+
+// passwordPolicyResponse responds with the reasons a password was rejected for, if err is a *PasswordPolicyError
+func passwordPolicyResponse(c *gin.Context, err error) bool {
+	var policyErr *PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		return false
+	}
+	c.JSON(http.StatusBadRequest, PasswordPolicyErrResponse{
+		Message:  ErrWeakPassword.Error(),
+		Reasons:  policyErr.Reasons,
+		Score:    policyErr.Score,
+		MinScore: policyErr.MinScore,
+	})
+	return true
+}
@@ -18,13 +18,18 @@ type Server struct {
 	jwtAuthChecker *JWTAuthChecker
 }
 
-func NewEngine(config *Config) *gin.Engine {
+// NewEngine is the factory of gin engine
+// client IPs, which logins are throttled by and sessions record, are only taken from headers of trusted proxies
+func NewEngine(config *Config) (*gin.Engine, error) {
 	gin.SetMode(gin.DebugMode)
 	engine := gin.New()
+	if err := engine.SetTrustedProxies(config.TrustedProxies); err != nil {
+		return nil, err
+	}
 	engine.Use(gin.Recovery())
 	engine.Use(CORSMiddleware())
 
-	return engine
+	return engine, nil
 }
 
 // NewServer is the factory for server instance
@@ -39,6 +44,7 @@ func NewServer(config *Config, engine *gin.Engine, router *Router, jwtAuthChecke
 
 // RegisterRoutes method register all endpoints
 func (s *Server) RegisterRoutes() {
+	s.Engine.GET("/.well-known/jwks.json", s.Router.JWKS)
 	apiGroup := s.Engine.Group("/api/account")
 	apiGroup.GET("/name/:id", s.Router.GetCustomerName)
 	{
@@ -52,12 +58,60 @@ func (s *Server) RegisterRoutes() {
 			authGroup.POST("/signup", s.Router.SignUp)
 			authGroup.POST("/login", s.Router.Login)
 			authGroup.POST("/refresh", s.Router.RefreshToken)
+			authGroup.POST("/password/forgot", s.Router.ForgotPassword)
+			authGroup.POST("/password/reset", s.Router.ResetPassword)
+			authGroup.POST("/email/verify", s.Router.VerifyEmail)
+			authGroup.POST("/mfa/login", s.Router.LoginMFA)
+			authGroup.GET("/oidc/:provider/login", s.Router.OIDCLogin)
+			authGroup.GET("/oidc/:provider/callback", s.Router.OIDCCallback)
+		}
+		authWithJWT := apiGroup.Group("/auth")
+		authWithJWT.Use(s.jwtAuthChecker.JWTAuth(), s.jwtAuthChecker.RequireSession())
+		{
+			authWithJWT.POST("/logout", s.Router.Logout)
+			authWithJWT.POST("/logout-all", s.Router.LogoutAll)
+			authWithJWT.POST("/email/resend", s.Router.ResendVerificationEmail)
+			authWithJWT.POST("/mfa/totp/enroll", s.Router.EnrollTOTP)
+			authWithJWT.POST("/mfa/totp/confirm", s.Router.ConfirmTOTP)
+			authWithJWT.POST("/mfa/totp/disable", s.Router.DisableTOTP)
+			authWithJWT.POST("/mfa/recovery-codes", s.Router.RegenerateRecoveryCodes)
 		}
 		withJWT := apiGroup.Group("/info")
 		withJWT.Use(s.jwtAuthChecker.JWTAuth())
 		{
-			withJWT.GET("/person", s.Router.GetCustomerPersonalInfoWithId)
-			withJWT.PUT("/person", s.Router.UpdateCustomerPersonalInfo)
+			withJWT.GET("/person", s.jwtAuthChecker.RequireScope(ProfileReadScope), s.Router.GetCustomerPersonalInfoWithId)
+			withJWT.PUT("/person", s.jwtAuthChecker.RequireScope(ProfileWriteScope), s.Router.UpdateCustomerPersonalInfo)
+			withJWT.PUT("/password", s.jwtAuthChecker.RequireSession(), s.Router.ChangePassword)
+			withJWT.GET("/sessions", s.jwtAuthChecker.RequireSession(), s.Router.ListSessions)
+			withJWT.DELETE("/sessions/:id", s.jwtAuthChecker.RequireSession(), s.Router.RevokeSession)
+		}
+		tokenGroup := apiGroup.Group("")
+		tokenGroup.Use(s.jwtAuthChecker.JWTAuth(), s.jwtAuthChecker.RequireSession())
+		{
+			tokenGroup.POST("/tokens", s.Router.CreatePersonalToken)
+			tokenGroup.GET("/tokens", s.Router.ListPersonalTokens)
+			tokenGroup.DELETE("/tokens/:token_id", s.Router.RevokePersonalToken)
+			tokenGroup.POST("/bots", s.Router.CreateBot)
+			tokenGroup.GET("/bots", s.Router.ListBots)
+			tokenGroup.DELETE("/bots/:id", s.Router.DeleteBot)
+			tokenGroup.POST("/bots/:id/tokens", s.Router.CreatePersonalToken)
+			tokenGroup.GET("/bots/:id/tokens", s.Router.ListPersonalTokens)
+			tokenGroup.DELETE("/bots/:id/tokens/:token_id", s.Router.RevokePersonalToken)
+		}
+		adminGroup := apiGroup.Group("/admin")
+		adminGroup.Use(s.jwtAuthChecker.JWTAuth(), s.jwtAuthChecker.RequireSession())
+		{
+			readCustomers := s.jwtAuthChecker.RequirePermission(ReadCustomersPermission)
+			manageCustomers := s.jwtAuthChecker.RequirePermission(ManageCustomersPermission)
+			adminGroup.GET("/customers", readCustomers, s.Router.ListCustomers)
+			adminGroup.GET("/customers/:id", readCustomers, s.Router.GetCustomer)
+			adminGroup.POST("/customers/:id/activate", manageCustomers, s.Router.ActivateCustomer)
+			adminGroup.POST("/customers/:id/deactivate", manageCustomers, s.Router.DeactivateCustomer)
+			adminGroup.POST("/customers/:id/logout", manageCustomers, s.Router.LogoutCustomer)
+			adminGroup.GET("/customers/:id/lockout", readCustomers, s.Router.GetCustomerLoginLockout)
+			adminGroup.DELETE("/customers/:id/lockout", manageCustomers, s.Router.UnlockCustomerLogin)
+			adminGroup.PUT("/customers/:id/roles", s.jwtAuthChecker.RequirePermission(ManageRolesPermission), s.Router.SetCustomerRoles)
+			adminGroup.GET("/audit-logs", s.jwtAuthChecker.RequirePermission(ReadAuditLogsPermission), s.Router.ListAuditLogs)
 		}
 	}
 }
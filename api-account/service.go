@@ -2,8 +2,13 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
@@ -19,8 +24,33 @@ var (
 	ErrAuthentication = errors.New("authentication failed")
 	// ErrCustomerInactive is customer inactive error
 	ErrCustomerInactive = errors.New("customer inactive")
+	// ErrTokenReused is refresh token reuse error
+	ErrTokenReused = errors.New("token reused")
+	// ErrTokenRevoked is token revoked error
+	ErrTokenRevoked = errors.New("token revoked")
+	// ErrInvalidResetToken is invalid, expired or used password reset token error
+	ErrInvalidResetToken = errors.New("invalid reset token")
+	// ErrInvalidVerificationToken is invalid, expired or used email verification token error
+	ErrInvalidVerificationToken = errors.New("invalid verification token")
+	// ErrEmailAlreadyVerified is email already verified error
+	ErrEmailAlreadyVerified = errors.New("email already verified")
+	// ErrTooManyRequests is rate limit exceeded error
+	ErrTooManyRequests = errors.New("too many requests")
+	// ErrInvalidMFACode is invalid TOTP or recovery code error
+	ErrInvalidMFACode = errors.New("invalid mfa code")
+	// ErrMFAAlreadyEnabled is two-factor authentication already enabled error
+	ErrMFAAlreadyEnabled = errors.New("mfa already enabled")
+	// ErrMFANotEnabled is two-factor authentication not enabled error
+	ErrMFANotEnabled = errors.New("mfa not enabled")
+	// ErrMFANotEnrolled is no pending TOTP enrollment error
+	ErrMFANotEnrolled = errors.New("mfa not enrolled")
+	// ErrLoginLocked is too many failed logins error
+	ErrLoginLocked = errors.New("login temporarily locked")
 )
 
+// oneTimeTokenBytes is the entropy of password reset and email verification tokens
+const oneTimeTokenBytes = 32
+
 type CustomerService interface {
 	GetCustomerPersonalInfo(ctx context.Context, customerID uint64) (*CustomerPersonalInfo, error)
 	UpdateCustomerPersonalInfo(ctx context.Context, customerID uint64, personalInfo *CustomerPersonalInfo) error
@@ -62,32 +92,90 @@ func (svc *CustomerServiceImpl) UpdateCustomerPersonalInfo(ctx context.Context,
 // JWTAuthService defines jwt authentication interface
 type JWTAuthService interface {
 	Auth(ctx context.Context, authPayload *AuthPayload) (*AuthResponse, error)
-	SignUp(ctx context.Context, customer *Customer) (string, string, error)
-	Login(ctx context.Context, email string, password string) (string, string, error)
+	SignUp(ctx context.Context, customer *Customer, client *ClientInfo) (string, string, error)
+	Login(ctx context.Context, email string, password string, client *ClientInfo) (*LoginResult, error)
+	LoginMFA(ctx context.Context, mfaToken string, code string, client *ClientInfo) (string, string, error)
+	IssueLogin(ctx context.Context, customerID uint64, client *ClientInfo) (*LoginResult, error)
 	RefreshToken(ctx context.Context, refreshToken string) (string, string, error)
+	Logout(ctx context.Context, auth *AuthResponse) error
+	LogoutAll(ctx context.Context, customerID uint64) error
+	ChangePassword(ctx context.Context, auth *AuthResponse, currentPassword string, newPassword string) (string, string, error)
+	ForgotPassword(ctx context.Context, email string) error
+	ResetPassword(ctx context.Context, resetToken string, password string) error
+	VerifyEmail(ctx context.Context, verificationToken string) error
+	ResendVerificationEmail(ctx context.Context, customerID uint64) error
+	EnrollTOTP(ctx context.Context, customerID uint64) (*TOTPEnrollment, error)
+	ConfirmTOTP(ctx context.Context, customerID uint64, code string) ([]string, error)
+	DisableTOTP(ctx context.Context, customerID uint64, code string) error
+	RegenerateRecoveryCodes(ctx context.Context, customerID uint64, code string) ([]string, error)
+	GetLoginLockout(ctx context.Context, customerID uint64) (*LoginLockout, error)
+	UnlockLogin(ctx context.Context, customerID uint64) error
+	ListSessions(ctx context.Context, auth *AuthResponse) ([]*Session, error)
+	RevokeSession(ctx context.Context, auth *AuthResponse, sessionID uint64) error
 }
 
 // JWTAuthServiceImpl implements JWTAuthService interface
 type JWTAuthServiceImpl struct {
-	jwtSecret                string
+	keySet                   *KeySet
+	hasher                   *PasswordHasher
+	passwordPolicy           *PasswordPolicy
 	accessTokenExpireSecond  int64
 	refreshTokenExpireSecond int64
 	jwtAuthRepo              JWTAuthRepository
 	sf                       IDGenerator
+	revocationCache          *TTLCache
+	mailer                   Mailer
+	resetTokenExpireSecond   int64
+	resetURL                 string
+	verificationConfig       *EmailVerificationConfig
+	mfaConfig                *MFAConfig
+	mfaAttempts              *TTLCache
+	uniformLoginError        bool
+	accountLoginLimit        *LoginLimit
+	ipLoginThrottle          *LoginThrottle
+	unknownLoginThrottle     *LoginThrottle
 }
 
 // NewJWTAuthService is the factory of JWTAuthService
-func NewJWTAuthService(config *Config, jwtAuthRepo JWTAuthRepository, sf IDGenerator) JWTAuthService {
+// failed logins of emails without an account are throttled like those of accounts, so that throttling cannot tell them apart
+func NewJWTAuthService(config *Config, jwtAuthRepo JWTAuthRepository, sf IDGenerator, mailer Mailer, keySet *KeySet, hasher *PasswordHasher, passwordPolicy *PasswordPolicy) JWTAuthService {
+	throttleConfig := config.LoginThrottleConfig
+	accountLoginLimit := &LoginLimit{
+		Window:           time.Duration(throttleConfig.WindowSecond) * time.Second,
+		BackoffThreshold: throttleConfig.AccountBackoffThreshold,
+		BackoffBase:      time.Duration(throttleConfig.BackoffBaseSecond) * time.Second,
+		BackoffMax:       time.Duration(throttleConfig.BackoffMaxSecond) * time.Second,
+		LockoutThreshold: throttleConfig.AccountLockoutThreshold,
+		Lockout:          time.Duration(throttleConfig.LockoutSecond) * time.Second,
+	}
+	ipLoginLimit := *accountLoginLimit
+	ipLoginLimit.BackoffThreshold = throttleConfig.IPBackoffThreshold
+	ipLoginLimit.LockoutThreshold = throttleConfig.IPLockoutThreshold
 	return &JWTAuthServiceImpl{
-		jwtSecret:                config.JWTConfig.Secret,
+		keySet:                   keySet,
+		hasher:                   hasher,
+		passwordPolicy:           passwordPolicy,
 		accessTokenExpireSecond:  config.JWTConfig.AccessTokenExpireSecond,
 		refreshTokenExpireSecond: config.JWTConfig.RefreshTokenExpireSecond,
 		jwtAuthRepo:              jwtAuthRepo,
 		sf:                       sf,
+		revocationCache:          NewTTLCache(time.Duration(config.JWTConfig.RevocationCacheSecond) * time.Second),
+		mailer:                   mailer,
+		resetTokenExpireSecond:   config.PasswordResetConfig.TokenExpireSecond,
+		resetURL:                 config.PasswordResetConfig.URL,
+		verificationConfig:       config.EmailVerificationConfig,
+		mfaConfig:                config.MFAConfig,
+		mfaAttempts:              NewTTLCache(time.Duration(config.MFAConfig.PendingTokenExpireSecond) * time.Second),
+		uniformLoginError:        throttleConfig.UniformError,
+		accountLoginLimit:        accountLoginLimit,
+		ipLoginThrottle:          NewLoginThrottle(&ipLoginLimit),
+		unknownLoginThrottle:     NewLoginThrottle(accountLoginLimit),
 	}
 }
 
 // Auth authenticates an user by checking access token
+// a token is rejected once it is revoked by a logout, or issued before the customer logged out everywhere;
+// revocation state is cached for RevocationCacheSecond, so other instances may accept a revoked token that long
 func (svc *JWTAuthServiceImpl) Auth(ctx context.Context, authPayload *AuthPayload) (*AuthResponse, error) {
 	token, err := svc.parseToken(authPayload.AccessToken)
 	if err != nil {
@@ -105,18 +193,325 @@ func (svc *JWTAuthServiceImpl) Auth(ctx context.Context, authPayload *AuthPayloa
 		return nil, ErrInvalidToken
 	}
 
-	if claims.Refresh {
+	if claims.Refresh || claims.MFAPending || claims.IssuedAt == nil || claims.ExpiresAt == nil {
 		return nil, ErrInvalidToken
 	}
+	tokenID, err := strconv.ParseUint(claims.ID, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	status, err := svc.getCustomerTokenStatus(ctx, claims.CustomerID)
+	if err != nil {
+		if err == ErrCustomerNotFound {
+			return nil, ErrInvalidToken
+		}
+		log.Error(err.Error())
+		return nil, err
+	}
+	if !status.Active {
+		return nil, ErrCustomerInactive
+	}
+	if claims.issuedAtMilli() < status.TokensValidAfter {
+		return nil, ErrTokenRevoked
+	}
+	revoked, err := svc.isTokenRevoked(ctx, tokenID)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
 
 	return &AuthResponse{
-		CustomerID: claims.CustomerID,
-		Expired:    false,
+		CustomerID:    claims.CustomerID,
+		TokenID:       tokenID,
+		SessionID:     claims.SessionID,
+		ExpiresAt:     claims.ExpiresAt.Unix(),
+		EmailVerified: status.EmailVerified,
+		MFAEnabled:    status.TOTPEnabled,
+		Roles:         claims.Roles,
+		Expired:       false,
 	}, nil
 }
 
+// Logout revokes the presented access token and the refresh token family it was issued with
+func (svc *JWTAuthServiceImpl) Logout(ctx context.Context, auth *AuthResponse) error {
+	if err := svc.jwtAuthRepo.RevokeToken(ctx, auth.TokenID, auth.CustomerID, auth.ExpiresAt); err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	svc.revocationCache.Delete(tokenCacheKey(auth.TokenID))
+	if auth.SessionID == 0 {
+		return nil
+	}
+	if err := svc.jwtAuthRepo.RevokeRefreshTokenFamily(ctx, auth.SessionID); err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+// LogoutAll revokes every token issued to a customer so far
+func (svc *JWTAuthServiceImpl) LogoutAll(ctx context.Context, customerID uint64) error {
+	if err := svc.jwtAuthRepo.RevokeAllTokens(ctx, customerID, time.Now().UnixMilli()); err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	svc.revocationCache.Delete(customerCacheKey(customerID))
+	return nil
+}
+
+// ChangePassword sets a new password after checking the current one
+// every other session of the customer is revoked, and the current session continues with the returned token pair
+func (svc *JWTAuthServiceImpl) ChangePassword(ctx context.Context, auth *AuthResponse, currentPassword string, newPassword string) (string, string, error) {
+	credentials, err := svc.jwtAuthRepo.GetCustomerCredentialsByID(ctx, auth.CustomerID)
+	if err != nil {
+		if err != ErrCustomerNotFound {
+			log.Error(err.Error())
+		}
+		return "", "", err
+	}
+	ok, _, err := svc.hasher.Verify(currentPassword, credentials.PasswordHash)
+	if err != nil {
+		log.Error(err.Error())
+		return "", "", err
+	}
+	if !ok {
+		return "", "", ErrAuthentication
+	}
+	if err := svc.jwtAuthRepo.ChangePassword(ctx, auth.CustomerID, newPassword, auth.SessionID, time.Now().UnixMilli(),
+		func(info *CustomerPersonalInfo) error {
+			return svc.passwordPolicy.Check(newPassword, info)
+		}); err != nil {
+		if !errors.Is(err, ErrWeakPassword) && err != ErrCustomerNotFound {
+			log.Error(err.Error())
+		}
+		return "", "", err
+	}
+	svc.revocationCache.Delete(customerCacheKey(auth.CustomerID))
+	return svc.newTokenPair(ctx, auth.CustomerID, auth.SessionID)
+}
+
+// ForgotPassword mails a single-use password reset link to the customer owning the email
+// it succeeds whether or not the email is registered, so that it cannot be used to probe for accounts
+func (svc *JWTAuthServiceImpl) ForgotPassword(ctx context.Context, email string) error {
+	exist, credentials, err := svc.jwtAuthRepo.GetCustomerCredentials(ctx, email)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	// bots have no password to reset, and their emails receive no mail
+	if !exist || !credentials.Active || credentials.Bot {
+		return nil
+	}
+
+	tokenID, err := svc.sf.NextID()
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	resetToken, tokenHash, err := newOneTimeToken()
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	expiresAt := time.Now().Add(time.Duration(svc.resetTokenExpireSecond) * time.Second)
+	if err := svc.jwtAuthRepo.CreatePasswordResetToken(ctx, &PasswordResetTokenRecord{
+		ID:         tokenID,
+		CustomerID: credentials.ID,
+		TokenHash:  tokenHash,
+		ExpiresAt:  expiresAt.Unix(),
+	}); err != nil {
+		log.Error(err.Error())
+		return err
+	}
+
+	mail := &Mail{
+		To:      email,
+		Subject: "Reset your Sendify password",
+		Body: fmt.Sprintf("Someone requested a password reset for your Sendify account.\n\n"+
+			"Open the link below to choose a new password. It expires at %s and can be used once.\n\n%s\n\n"+
+			"If you did not request this, you can ignore this email.",
+			expiresAt.UTC().Format(time.RFC1123), tokenLink(svc.resetURL, resetToken)),
+	}
+	// mails are sent in the background so that response times do not reveal whether the email is registered
+	go func() {
+		if err := svc.mailer.Send(context.Background(), mail); err != nil {
+			log.Errorf("failed to send password reset mail to customer %d: %v", credentials.ID, err)
+		}
+	}()
+	return nil
+}
+
+// ResetPassword sets a new password with a password reset token and revokes every existing session of the customer
+func (svc *JWTAuthServiceImpl) ResetPassword(ctx context.Context, resetToken string, password string) error {
+	customerID, err := svc.jwtAuthRepo.ResetPassword(ctx, hashOneTimeToken(resetToken), password, time.Now().UnixMilli(),
+		func(info *CustomerPersonalInfo) error {
+			return svc.passwordPolicy.Check(password, info)
+		})
+	if err != nil {
+		if err == ErrPasswordResetTokenNotFound {
+			return ErrInvalidResetToken
+		}
+		if errors.Is(err, ErrWeakPassword) {
+			return err
+		}
+		log.Error(err.Error())
+		return err
+	}
+	svc.revocationCache.Delete(customerCacheKey(customerID))
+	return nil
+}
+
+// VerifyEmail marks the customer a verification token was sent to as verified
+func (svc *JWTAuthServiceImpl) VerifyEmail(ctx context.Context, verificationToken string) error {
+	customerID, err := svc.jwtAuthRepo.VerifyEmail(ctx, hashOneTimeToken(verificationToken), time.Now().UnixMilli())
+	if err != nil {
+		if err == ErrEmailVerificationTokenNotFound {
+			return ErrInvalidVerificationToken
+		}
+		log.Error(err.Error())
+		return err
+	}
+	svc.revocationCache.Delete(customerCacheKey(customerID))
+	return nil
+}
+
+// ResendVerificationEmail mails a new verification link to an unverified customer
+// at most ResendLimit mails, including the one sent on signup, are sent within ResendWindowSecond
+func (svc *JWTAuthServiceImpl) ResendVerificationEmail(ctx context.Context, customerID uint64) error {
+	email, err := svc.jwtAuthRepo.GetCustomerEmail(ctx, customerID)
+	if err != nil {
+		if err != ErrCustomerNotFound {
+			log.Error(err.Error())
+		}
+		return err
+	}
+	if email.EmailVerified {
+		return ErrEmailAlreadyVerified
+	}
+	since := time.Now().Add(-time.Duration(svc.verificationConfig.ResendWindowSecond) * time.Second)
+	count, err := svc.jwtAuthRepo.CountEmailVerificationTokens(ctx, customerID, since.UnixMilli())
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	if count >= svc.verificationConfig.ResendLimit {
+		return ErrTooManyRequests
+	}
+	if err := svc.sendVerificationEmail(ctx, customerID, email.Email); err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+// sendVerificationEmail issues a verification token for an email and mails it in the background
+func (svc *JWTAuthServiceImpl) sendVerificationEmail(ctx context.Context, customerID uint64, email string) error {
+	tokenID, err := svc.sf.NextID()
+	if err != nil {
+		return err
+	}
+	verificationToken, tokenHash, err := newOneTimeToken()
+	if err != nil {
+		return err
+	}
+	expiresAt := time.Now().Add(time.Duration(svc.verificationConfig.TokenExpireSecond) * time.Second)
+	if err := svc.jwtAuthRepo.CreateEmailVerificationToken(ctx, &EmailVerificationTokenRecord{
+		ID:         tokenID,
+		CustomerID: customerID,
+		Email:      email,
+		TokenHash:  tokenHash,
+		ExpiresAt:  expiresAt.Unix(),
+	}); err != nil {
+		return err
+	}
+
+	mail := &Mail{
+		To:      email,
+		Subject: "Verify your Sendify email",
+		Body: fmt.Sprintf("Welcome to Sendify!\n\n"+
+			"Open the link below to verify your email. It expires at %s.\n\n%s\n\n"+
+			"If you did not sign up, you can ignore this email.",
+			expiresAt.UTC().Format(time.RFC1123), tokenLink(svc.verificationConfig.URL, verificationToken)),
+	}
+	go func() {
+		if err := svc.mailer.Send(context.Background(), mail); err != nil {
+			log.Errorf("failed to send verification mail to customer %d: %v", customerID, err)
+		}
+	}()
+	return nil
+}
+
+// newOneTimeToken generates a random token for links sent by mail, together with the hash to store
+func newOneTimeToken() (string, []byte, error) {
+	buf := make([]byte, oneTimeTokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	return token, hashOneTimeToken(token), nil
+}
+
+func hashOneTimeToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// tokenLink appends a token to a link as the token query parameter
+func tokenLink(link string, token string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return link + "?token=" + url.QueryEscape(token)
+	}
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func (svc *JWTAuthServiceImpl) getCustomerTokenStatus(ctx context.Context, customerID uint64) (*CustomerTokenStatus, error) {
+	key := customerCacheKey(customerID)
+	if status, ok := svc.revocationCache.Get(key); ok {
+		return status.(*CustomerTokenStatus), nil
+	}
+	status, err := svc.jwtAuthRepo.GetCustomerTokenStatus(ctx, customerID)
+	if err != nil {
+		return nil, err
+	}
+	svc.revocationCache.Set(key, status)
+	return status, nil
+}
+
+func (svc *JWTAuthServiceImpl) isTokenRevoked(ctx context.Context, tokenID uint64) (bool, error) {
+	key := tokenCacheKey(tokenID)
+	if revoked, ok := svc.revocationCache.Get(key); ok {
+		return revoked.(bool), nil
+	}
+	revoked, err := svc.jwtAuthRepo.IsTokenRevoked(ctx, tokenID)
+	if err != nil {
+		return false, err
+	}
+	svc.revocationCache.Set(key, revoked)
+	return revoked, nil
+}
+
+func customerCacheKey(customerID uint64) string {
+	return "customer:" + strconv.FormatUint(customerID, 10)
+}
+
+func tokenCacheKey(tokenID uint64) string {
+	return "token:" + strconv.FormatUint(tokenID, 10)
+}
+
 // SignUp creates a new customer and returns a token pair
-func (svc *JWTAuthServiceImpl) SignUp(ctx context.Context, customer *Customer) (string, string, error) {
+// the customer stays unverified until it follows the link of the verification mail
+func (svc *JWTAuthServiceImpl) SignUp(ctx context.Context, customer *Customer, client *ClientInfo) (string, string, error) {
+	if err := svc.passwordPolicy.Check(customer.Password, customer.PersonalInfo); err != nil {
+		return "", "", err
+	}
 	sonyflakeID, err := svc.sf.NextID()
 	if err != nil {
 		return "", "", err
@@ -129,29 +524,219 @@ func (svc *JWTAuthServiceImpl) SignUp(ctx context.Context, customer *Customer) (
 		}
 		return "", "", err
 	}
-	return svc.newTokenPair(customer.ID)
+	if err := svc.sendVerificationEmail(ctx, customer.ID, customer.PersonalInfo.Email); err != nil {
+		// the customer can ask for another mail
+		log.Errorf("failed to issue verification token for customer %d: %v", customer.ID, err)
+	}
+	return svc.startSession(ctx, customer.ID, client)
 }
 
 // Login authenticate the user and returns a new token pair if succeed
-func (svc *JWTAuthServiceImpl) Login(ctx context.Context, email string, password string) (string, string, error) {
+// customers with two-factor authentication get a pending token instead, to be exchanged by LoginMFA
+func (svc *JWTAuthServiceImpl) Login(ctx context.Context, email string, password string, client *ClientInfo) (*LoginResult, error) {
+	now := time.Now().UnixMilli()
+	if wait := svc.ipLoginThrottle.RetryAfter(client.IP, now); wait > 0 {
+		return nil, &LoginLockedError{RetryAfter: wait}
+	}
 	exist, credentials, err := svc.jwtAuthRepo.GetCustomerCredentials(ctx, email)
 	if err != nil {
 		log.Error(err.Error())
-		return "", "", err
+		return nil, err
 	}
-	if !exist {
-		return "", "", ErrCustomerNotFound
+	// bots cannot log in, so they fail like emails without an account
+	if !exist || credentials.Bot {
+		if wait := svc.unknownLoginThrottle.RetryAfter(email, now); wait > 0 {
+			return nil, &LoginLockedError{RetryAfter: wait}
+		}
+		svc.hasher.VerifyDummy(password)
+		svc.unknownLoginThrottle.Fail(email, now)
+		svc.failLoginFromIP(client.IP, now)
+		return nil, svc.loginError(ErrCustomerNotFound)
+	}
+	if credentials.LockedUntil > now {
+		return nil, &LoginLockedError{RetryAfter: time.Duration(credentials.LockedUntil-now) * time.Millisecond}
+	}
+	ok, rehash, err := svc.hasher.Verify(password, credentials.PasswordHash)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	if !ok {
+		lockout, err := svc.jwtAuthRepo.RecordFailedLogin(ctx, credentials.ID, func(lockout *LoginLockout) {
+			svc.accountLoginLimit.Fail(lockout, now)
+		})
+		if err != nil {
+			log.Error(err.Error())
+			return nil, err
+		}
+		if svc.accountLoginLimit.lockedOut(lockout.FailedLogins) {
+			log.Warnf("locked logins of customer %d after %d failed logins", credentials.ID, lockout.FailedLogins)
+		}
+		svc.failLoginFromIP(client.IP, now)
+		return nil, ErrAuthentication
+	}
+	if !credentials.Active {
+		return nil, svc.loginError(ErrCustomerInactive)
+	}
+	if credentials.FailedLogins > 0 {
+		if err := svc.jwtAuthRepo.ResetFailedLogins(ctx, credentials.ID); err != nil {
+			log.Error(err.Error())
+			return nil, err
+		}
+	}
+	if rehash {
+		// the current hash keeps working, so the login goes on if it cannot be replaced
+		if err := svc.jwtAuthRepo.RehashPassword(ctx, credentials.ID, credentials.PasswordHash, password); err != nil {
+			log.Errorf("failed to rehash password of customer %d: %v", credentials.ID, err)
+		}
+	}
+	return svc.issueLogin(ctx, credentials, client)
+}
+
+// GetLoginLockout returns the failed login state of a customer
+func (svc *JWTAuthServiceImpl) GetLoginLockout(ctx context.Context, customerID uint64) (*LoginLockout, error) {
+	lockout, err := svc.jwtAuthRepo.GetLoginLockout(ctx, customerID)
+	if err != nil {
+		if err != ErrCustomerNotFound {
+			log.Error(err.Error())
+		}
+		return nil, err
+	}
+	return lockout, nil
+}
+
+// UnlockLogin forgets the failed logins of a customer before its lockout expires
+func (svc *JWTAuthServiceImpl) UnlockLogin(ctx context.Context, customerID uint64) error {
+	if _, err := svc.GetLoginLockout(ctx, customerID); err != nil {
+		return err
+	}
+	if err := svc.jwtAuthRepo.ResetFailedLogins(ctx, customerID); err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	log.Infof("unlocked logins of customer %d", customerID)
+	return nil
+}
+
+func (svc *JWTAuthServiceImpl) failLoginFromIP(clientIP string, now int64) {
+	lockout := svc.ipLoginThrottle.Fail(clientIP, now)
+	if svc.ipLoginThrottle.limit.lockedOut(lockout.FailedLogins) {
+		log.Warnf("locked logins from %s after %d failed logins", clientIP, lockout.FailedLogins)
+	}
+}
+
+// loginError hides why a login failed if errors have to be uniform
+func (svc *JWTAuthServiceImpl) loginError(err error) error {
+	if svc.uniformLoginError {
+		return ErrAuthentication
+	}
+	return err
+}
+
+// IssueLogin signs in a customer authenticated by other means than its password, such as an identity provider
+func (svc *JWTAuthServiceImpl) IssueLogin(ctx context.Context, customerID uint64, client *ClientInfo) (*LoginResult, error) {
+	credentials, err := svc.jwtAuthRepo.GetCustomerCredentialsByID(ctx, customerID)
+	if err != nil {
+		if err != ErrCustomerNotFound {
+			log.Error(err.Error())
+		}
+		return nil, err
 	}
 	if !credentials.Active {
+		return nil, ErrCustomerInactive
+	}
+	return svc.issueLogin(ctx, credentials, client)
+}
+
+func (svc *JWTAuthServiceImpl) issueLogin(ctx context.Context, credentials *CustomerCredentials, client *ClientInfo) (*LoginResult, error) {
+	if credentials.TOTPEnabled {
+		mfaToken, err := svc.newMFAToken(credentials.ID)
+		if err != nil {
+			log.Error(err.Error())
+			return nil, err
+		}
+		return &LoginResult{
+			MFAToken: mfaToken,
+		}, nil
+	}
+	accessToken, refreshToken, err := svc.startSession(ctx, credentials.ID, client)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginResult{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// LoginMFA exchanges the pending token of a two-step login and a TOTP or recovery code for a token pair
+// a pending token can be exchanged once, and accepts at most MaxAttempts codes
+func (svc *JWTAuthServiceImpl) LoginMFA(ctx context.Context, mfaToken string, code string, client *ClientInfo) (string, string, error) {
+	token, err := svc.parseToken(mfaToken)
+	if err != nil {
+		v := err.(*jwt.ValidationError)
+		if v.Errors == jwt.ValidationErrorExpired {
+			return "", "", ErrTokenExpired
+		}
+		return "", "", ErrInvalidToken
+	}
+	claims, ok := token.Claims.(*JWTClaims)
+	if !(ok && token.Valid) || !claims.MFAPending || claims.IssuedAt == nil || claims.ExpiresAt == nil {
+		return "", "", ErrInvalidToken
+	}
+	tokenID, err := strconv.ParseUint(claims.ID, 10, 64)
+	if err != nil {
+		return "", "", ErrInvalidToken
+	}
+	if svc.mfaAttempts.Increment(tokenCacheKey(tokenID)) > svc.mfaConfig.MaxAttempts {
+		return "", "", ErrTooManyRequests
+	}
+	revoked, err := svc.jwtAuthRepo.IsTokenRevoked(ctx, tokenID)
+	if err != nil {
+		log.Error(err.Error())
+		return "", "", err
+	}
+	if revoked {
+		return "", "", ErrInvalidToken
+	}
+
+	customerID := claims.CustomerID
+	status, err := svc.jwtAuthRepo.GetCustomerTokenStatus(ctx, customerID)
+	if err != nil {
+		if err == ErrCustomerNotFound {
+			return "", "", ErrInvalidToken
+		}
+		log.Error(err.Error())
+		return "", "", err
+	}
+	if !status.Active {
 		return "", "", ErrCustomerInactive
 	}
-	if CheckPasswordHash(password, credentials.BcryptedPassword) {
-		return svc.newTokenPair(credentials.ID)
+	if claims.issuedAtMilli() < status.TokensValidAfter {
+		return "", "", ErrTokenRevoked
 	}
-	return "", "", ErrAuthentication
+	mfa, err := svc.jwtAuthRepo.GetCustomerMFA(ctx, customerID)
+	if err != nil {
+		log.Error(err.Error())
+		return "", "", err
+	}
+	if !mfa.TOTPEnabled {
+		return "", "", ErrInvalidToken
+	}
+	if err := svc.verifySecondFactor(ctx, customerID, mfa, code, true); err != nil {
+		return "", "", err
+	}
+	if err := svc.jwtAuthRepo.RevokeToken(ctx, tokenID, customerID, claims.ExpiresAt.Unix()); err != nil {
+		log.Error(err.Error())
+		return "", "", err
+	}
+	svc.mfaAttempts.Delete(tokenCacheKey(tokenID))
+	return svc.startSession(ctx, customerID, client)
 }
 
 // RefreshToken checks the given refresh token and return a new token pair if the refresh token is valid
+// refresh tokens are single-use: the presented token is rotated, and presenting an already rotated token
+// is treated as theft and revokes every token of its family
 func (svc *JWTAuthServiceImpl) RefreshToken(ctx context.Context, refreshToken string) (string, string, error) {
 	token, err := svc.parseToken(refreshToken)
 	if err != nil {
@@ -171,6 +756,25 @@ func (svc *JWTAuthServiceImpl) RefreshToken(ctx context.Context, refreshToken st
 		return "", "", ErrInvalidToken
 	}
 
+	tokenID, err := strconv.ParseUint(claims.ID, 10, 64)
+	if err != nil {
+		return "", "", ErrInvalidToken
+	}
+	record, err := svc.jwtAuthRepo.GetRefreshToken(ctx, tokenID)
+	if err != nil {
+		if err == ErrRefreshTokenNotFound {
+			return "", "", ErrInvalidToken
+		}
+		log.Error(err.Error())
+		return "", "", err
+	}
+	if record.Revoked || record.CustomerID != claims.CustomerID {
+		return "", "", ErrInvalidToken
+	}
+	if record.Used {
+		return "", "", svc.revokeRefreshTokenFamily(ctx, record)
+	}
+
 	customerID := claims.CustomerID
 	exist, active, err := svc.jwtAuthRepo.CheckCustomer(ctx, customerID)
 	if err != nil {
@@ -183,47 +787,351 @@ func (svc *JWTAuthServiceImpl) RefreshToken(ctx context.Context, refreshToken st
 		return "", "", ErrCustomerInactive
 	}
 
-	return svc.newTokenPair(customerID)
+	used, err := svc.jwtAuthRepo.UseRefreshToken(ctx, tokenID)
+	if err != nil {
+		log.Error(err.Error())
+		return "", "", err
+	}
+	if !used {
+		// another request rotated the same token first
+		return "", "", svc.revokeRefreshTokenFamily(ctx, record)
+	}
+	if err := svc.jwtAuthRepo.TouchSession(ctx, record.FamilyID, time.Now().UnixMilli()); err != nil {
+		log.Error(err.Error())
+		return "", "", err
+	}
+
+	return svc.newTokenPair(ctx, customerID, record.FamilyID)
 }
 
-func (svc *JWTAuthServiceImpl) newTokenPair(customerID uint64) (string, string, error) {
+func (svc *JWTAuthServiceImpl) revokeRefreshTokenFamily(ctx context.Context, record *RefreshTokenRecord) error {
+	log.Warnf("refresh token %d of customer %d reused, revoking token family %d", record.ID, record.CustomerID, record.FamilyID)
+	if err := svc.jwtAuthRepo.RevokeRefreshTokenFamily(ctx, record.FamilyID); err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	return ErrTokenReused
+}
+
+// EnrollTOTP starts a TOTP enrollment and returns the secret to add to an authenticator app
+// two-factor authentication is only enabled once ConfirmTOTP receives a code generated from the secret
+func (svc *JWTAuthServiceImpl) EnrollTOTP(ctx context.Context, customerID uint64) (*TOTPEnrollment, error) {
+	mfa, err := svc.jwtAuthRepo.GetCustomerMFA(ctx, customerID)
+	if err != nil {
+		if err != ErrCustomerNotFound {
+			log.Error(err.Error())
+		}
+		return nil, err
+	}
+	if mfa.TOTPEnabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	if err := svc.jwtAuthRepo.SetTOTPSecret(ctx, customerID, secret); err != nil {
+		if err == ErrMFAStateConflict {
+			return nil, ErrMFAAlreadyEnabled
+		}
+		log.Error(err.Error())
+		return nil, err
+	}
+	return &TOTPEnrollment{
+		Secret: secret,
+		URI:    totpURI(svc.mfaConfig.Issuer, mfa.Email, secret),
+	}, nil
+}
+
+// ConfirmTOTP enables two-factor authentication with a code of the pending enrollment and returns new recovery codes
+func (svc *JWTAuthServiceImpl) ConfirmTOTP(ctx context.Context, customerID uint64, code string) ([]string, error) {
+	if svc.mfaAttempts.Increment(customerCacheKey(customerID)) > svc.mfaConfig.MaxAttempts {
+		return nil, ErrTooManyRequests
+	}
+	mfa, err := svc.jwtAuthRepo.GetCustomerMFA(ctx, customerID)
+	if err != nil {
+		if err != ErrCustomerNotFound {
+			log.Error(err.Error())
+		}
+		return nil, err
+	}
+	if mfa.TOTPEnabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	if mfa.TOTPSecret == "" {
+		return nil, ErrMFANotEnrolled
+	}
+	step, ok := validateTOTP(mfa.TOTPSecret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+	codes, records, err := svc.newRecoveryCodes()
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	if err := svc.jwtAuthRepo.EnableTOTP(ctx, customerID, step, records); err != nil {
+		if err == ErrMFAStateConflict {
+			return nil, ErrMFAAlreadyEnabled
+		}
+		log.Error(err.Error())
+		return nil, err
+	}
+	svc.mfaAttempts.Delete(customerCacheKey(customerID))
+	svc.revocationCache.Delete(customerCacheKey(customerID))
+	return codes, nil
+}
+
+// DisableTOTP turns off two-factor authentication after checking a TOTP or recovery code
+func (svc *JWTAuthServiceImpl) DisableTOTP(ctx context.Context, customerID uint64, code string) error {
+	if svc.mfaAttempts.Increment(customerCacheKey(customerID)) > svc.mfaConfig.MaxAttempts {
+		return ErrTooManyRequests
+	}
+	mfa, err := svc.jwtAuthRepo.GetCustomerMFA(ctx, customerID)
+	if err != nil {
+		if err != ErrCustomerNotFound {
+			log.Error(err.Error())
+		}
+		return err
+	}
+	if !mfa.TOTPEnabled {
+		return ErrMFANotEnabled
+	}
+	if err := svc.verifySecondFactor(ctx, customerID, mfa, code, true); err != nil {
+		return err
+	}
+	if err := svc.jwtAuthRepo.DisableTOTP(ctx, customerID); err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	svc.mfaAttempts.Delete(customerCacheKey(customerID))
+	svc.revocationCache.Delete(customerCacheKey(customerID))
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces every recovery code of a customer after checking a TOTP code
+func (svc *JWTAuthServiceImpl) RegenerateRecoveryCodes(ctx context.Context, customerID uint64, code string) ([]string, error) {
+	if svc.mfaAttempts.Increment(customerCacheKey(customerID)) > svc.mfaConfig.MaxAttempts {
+		return nil, ErrTooManyRequests
+	}
+	mfa, err := svc.jwtAuthRepo.GetCustomerMFA(ctx, customerID)
+	if err != nil {
+		if err != ErrCustomerNotFound {
+			log.Error(err.Error())
+		}
+		return nil, err
+	}
+	if !mfa.TOTPEnabled {
+		return nil, ErrMFANotEnabled
+	}
+	if err := svc.verifySecondFactor(ctx, customerID, mfa, code, false); err != nil {
+		return nil, err
+	}
+	codes, records, err := svc.newRecoveryCodes()
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	if err := svc.jwtAuthRepo.ReplaceRecoveryCodes(ctx, customerID, records); err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	svc.mfaAttempts.Delete(customerCacheKey(customerID))
+	return codes, nil
+}
+
+// verifySecondFactor accepts a TOTP code that was not used before, or an unused recovery code if allowed
+func (svc *JWTAuthServiceImpl) verifySecondFactor(ctx context.Context, customerID uint64, mfa *CustomerMFA, code string, allowRecovery bool) error {
+	if step, ok := validateTOTP(mfa.TOTPSecret, code, time.Now()); ok {
+		if step <= mfa.TOTPLastStep {
+			return ErrInvalidMFACode
+		}
+		used, err := svc.jwtAuthRepo.UseTOTPStep(ctx, customerID, step)
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		if !used {
+			return ErrInvalidMFACode
+		}
+		return nil
+	}
+	if !allowRecovery {
+		return ErrInvalidMFACode
+	}
+	used, err := svc.jwtAuthRepo.UseRecoveryCode(ctx, customerID, hashRecoveryCode(code))
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	if !used {
+		return ErrInvalidMFACode
+	}
+	log.Infof("customer %d used a recovery code", customerID)
+	return nil
+}
+
+func (svc *JWTAuthServiceImpl) newRecoveryCodes() ([]string, []*RecoveryCodeRecord, error) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, nil, err
+	}
+	records := make([]*RecoveryCodeRecord, 0, len(codes))
+	for _, code := range codes {
+		id, err := svc.sf.NextID()
+		if err != nil {
+			return nil, nil, err
+		}
+		records = append(records, &RecoveryCodeRecord{
+			ID:       id,
+			CodeHash: hashRecoveryCode(code),
+		})
+	}
+	return codes, records, nil
+}
+
+// newMFAToken issues the pending token of a two-step login
+func (svc *JWTAuthServiceImpl) newMFAToken(customerID uint64) (string, error) {
+	tokenID, err := svc.sf.NextID()
+	if err != nil {
+		return "", err
+	}
 	now := time.Now()
-	accessTokenExpiresAt := now.Add(time.Duration(svc.accessTokenExpireSecond) * time.Second)
-	accessToken, err := newJWT(customerID, accessTokenExpiresAt, svc.jwtSecret, false)
+	return svc.keySet.Sign(&JWTClaims{
+		CustomerID:    customerID,
+		MFAPending:    true,
+		IssuedAtMilli: now.UnixMilli(),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        strconv.FormatUint(tokenID, 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Duration(svc.mfaConfig.PendingTokenExpireSecond) * time.Second)),
+		},
+	})
+}
+
+// startSession records a new session of a customer from client, and issues the token pair starting its refresh token family
+func (svc *JWTAuthServiceImpl) startSession(ctx context.Context, customerID uint64, client *ClientInfo) (string, string, error) {
+	sessionID, err := svc.sf.NextID()
 	if err != nil {
 		log.Error(err.Error())
 		return "", "", err
 	}
-	refreshTokenExpiresAt := now.Add(time.Duration(svc.refreshTokenExpireSecond) * time.Second)
-	refreshToken, err := newJWT(customerID, refreshTokenExpiresAt, svc.jwtSecret, true)
-	if err != nil {
+	if err := svc.jwtAuthRepo.CreateSession(ctx, &SessionRecord{
+		ID:         sessionID,
+		CustomerID: customerID,
+		UserAgent:  client.UserAgent,
+		IP:         client.IP,
+	}, time.Now().Unix()); err != nil {
 		log.Error(err.Error())
 		return "", "", err
 	}
-	return accessToken, refreshToken, nil
+	return svc.newTokenPair(ctx, customerID, sessionID)
 }
 
-func newJWT(customerID uint64, expiresAt time.Time, jwtSecret string, refresh bool) (string, error) {
-	jwtClaims := &JWTClaims{
-		CustomerID: customerID,
-		Refresh:    refresh,
+// ListSessions lists the sessions of a customer that can still be refreshed
+func (svc *JWTAuthServiceImpl) ListSessions(ctx context.Context, auth *AuthResponse) ([]*Session, error) {
+	records, err := svc.jwtAuthRepo.ListSessions(ctx, auth.CustomerID, time.Now().Unix())
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	sessions := make([]*Session, len(records))
+	for i, record := range records {
+		sessions[i] = &Session{
+			ID:              record.ID,
+			UserAgent:       record.UserAgent,
+			IP:              record.IP,
+			Current:         record.ID == auth.SessionID,
+			LastRefreshedAt: record.LastRefreshedAt,
+			CreatedAt:       record.CreatedAt,
+		}
+	}
+	return sessions, nil
+}
+
+// RevokeSession revokes a session of a customer, so that it cannot be refreshed anymore
+// access tokens already issued to another session stay valid until they expire, like after Logout;
+// revoking the current session also revokes the presented access token
+func (svc *JWTAuthServiceImpl) RevokeSession(ctx context.Context, auth *AuthResponse, sessionID uint64) error {
+	if err := svc.jwtAuthRepo.RevokeSession(ctx, auth.CustomerID, sessionID, time.Now().Unix()); err != nil {
+		if err != ErrSessionNotFound {
+			log.Error(err.Error())
+		}
+		return err
+	}
+	log.Infof("customer %d revoked session %d", auth.CustomerID, sessionID)
+	if sessionID == auth.SessionID {
+		return svc.Logout(ctx, auth)
+	}
+	return nil
+}
+
+// newTokenPair issues an access token and a refresh token
+// the refresh token joins the rotation family of the given session
+// the access token carries the current roles of the customer, so granted roles apply from the next refresh on
+func (svc *JWTAuthServiceImpl) newTokenPair(ctx context.Context, customerID uint64, familyID uint64) (string, string, error) {
+	roles, err := svc.jwtAuthRepo.GetCustomerRoles(ctx, customerID)
+	if err != nil {
+		log.Error(err.Error())
+		return "", "", err
+	}
+	accessTokenID, err := svc.sf.NextID()
+	if err != nil {
+		log.Error(err.Error())
+		return "", "", err
+	}
+	refreshTokenID, err := svc.sf.NextID()
+	if err != nil {
+		log.Error(err.Error())
+		return "", "", err
+	}
+
+	now := time.Now()
+	accessTokenExpiresAt := now.Add(time.Duration(svc.accessTokenExpireSecond) * time.Second)
+	accessToken, err := svc.keySet.Sign(&JWTClaims{
+		CustomerID:    customerID,
+		SessionID:     familyID,
+		Roles:         customerRoles(roles),
+		IssuedAtMilli: now.UnixMilli(),
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			ID:        strconv.FormatUint(accessTokenID, 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(accessTokenExpiresAt),
 		},
+	})
+	if err != nil {
+		log.Error(err.Error())
+		return "", "", err
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwtClaims)
-	accessToken, err := token.SignedString([]byte(jwtSecret))
+	refreshTokenExpiresAt := now.Add(time.Duration(svc.refreshTokenExpireSecond) * time.Second)
+	refreshToken, err := svc.keySet.Sign(&JWTClaims{
+		CustomerID:    customerID,
+		SessionID:     familyID,
+		Refresh:       true,
+		IssuedAtMilli: now.UnixMilli(),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        strconv.FormatUint(refreshTokenID, 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(refreshTokenExpiresAt),
+		},
+	})
 	if err != nil {
-		return "", err
+		log.Error(err.Error())
+		return "", "", err
+	}
+	if err := svc.jwtAuthRepo.CreateRefreshToken(ctx, &RefreshTokenRecord{
+		ID:         refreshTokenID,
+		FamilyID:   familyID,
+		CustomerID: customerID,
+		ExpiresAt:  refreshTokenExpiresAt.Unix(),
+	}); err != nil {
+		log.Error(err.Error())
+		return "", "", err
 	}
-	return accessToken, nil
+	return accessToken, refreshToken, nil
 }
 
 func (svc *JWTAuthServiceImpl) parseToken(accessToken string) (*jwt.Token, error) {
-	return jwt.ParseWithClaims(accessToken, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(svc.jwtSecret), nil
-	})
+	return jwt.ParseWithClaims(accessToken, &JWTClaims{}, svc.keySet.Keyfunc)
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// LoginLockedError is returned when a login is rejected because of too many failed logins
+// it unwraps to ErrLoginLocked, and tells when the next login is accepted
+type LoginLockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginLockedError) Error() string {
+	return ErrLoginLocked.Error()
+}
+
+func (e *LoginLockedError) Unwrap() error {
+	return ErrLoginLocked
+}
+
+// LoginLimit decides how long logins are delayed after failed ones
+// each failure from BackoffThreshold on doubles the delay from BackoffBase up to BackoffMax,
+// and LockoutThreshold failures lock logins for Lockout; failures are forgotten Window after the last one
+// a zero threshold disables its stage
+type LoginLimit struct {
+	Window           time.Duration
+	BackoffThreshold int
+	BackoffBase      time.Duration
+	BackoffMax       time.Duration
+	LockoutThreshold int
+	Lockout          time.Duration
+}
+
+// Fail records a failed login at now (in milliseconds) and locks further logins as long as the limit requires
+// the count starts over once the window has passed, or a lockout has expired
+func (limit *LoginLimit) Fail(lockout *LoginLockout, now int64) {
+	if lockout.LastFailedLoginAt <= now-limit.Window.Milliseconds() || limit.lockedOut(lockout.FailedLogins) && lockout.LockedUntil <= now {
+		lockout.FailedLogins = 0
+	}
+	lockout.FailedLogins++
+	lockout.LastFailedLoginAt = now
+	if delay := limit.delay(lockout.FailedLogins); delay > 0 {
+		lockout.LockedUntil = now + delay.Milliseconds()
+	}
+}
+
+func (limit *LoginLimit) lockedOut(failures int) bool {
+	return limit.LockoutThreshold > 0 && failures >= limit.LockoutThreshold
+}
+
+func (limit *LoginLimit) delay(failures int) time.Duration {
+	if limit.lockedOut(failures) {
+		return limit.Lockout
+	}
+	if limit.BackoffThreshold <= 0 || failures < limit.BackoffThreshold {
+		return 0
+	}
+	// the delay stops doubling long before it could overflow
+	exponent := failures - limit.BackoffThreshold
+	if exponent > 30 {
+		return limit.BackoffMax
+	}
+	delay := limit.BackoffBase << exponent
+	if delay > limit.BackoffMax {
+		return limit.BackoffMax
+	}
+	return delay
+}
+
+// retryAfter returns how long logins stay locked after now (in milliseconds)
+func retryAfter(lockout *LoginLockout, now int64) time.Duration {
+	if lockout.LockedUntil <= now {
+		return 0
+	}
+	return time.Duration(lockout.LockedUntil-now) * time.Millisecond
+}
+
+// LoginThrottle tracks failed logins in memory by an arbitrary key, such as a client IP
+// its state is per instance, so a client spreading logins over instances gets proportionally more attempts
+type LoginThrottle struct {
+	mu       sync.Mutex
+	limit    *LoginLimit
+	lockouts map[string]*LoginLockout
+}
+
+// NewLoginThrottle is the factory of LoginThrottle
+// forgotten failures are purged in the background every window
+func NewLoginThrottle(limit *LoginLimit) *LoginThrottle {
+	throttle := &LoginThrottle{
+		limit:    limit,
+		lockouts: make(map[string]*LoginLockout),
+	}
+	if limit.Window > 0 {
+		go throttle.purge()
+	}
+	return throttle
+}
+
+// RetryAfter returns how long logins of key stay locked after now (in milliseconds)
+func (t *LoginThrottle) RetryAfter(key string, now int64) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lockout, ok := t.lockouts[key]
+	if !ok {
+		return 0
+	}
+	return retryAfter(lockout, now)
+}
+
+// Fail records a failed login of key at now (in milliseconds) and returns its updated state
+func (t *LoginThrottle) Fail(key string, now int64) LoginLockout {
+	if t.limit.Window <= 0 {
+		return LoginLockout{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lockout, ok := t.lockouts[key]
+	if !ok {
+		lockout = &LoginLockout{}
+		t.lockouts[key] = lockout
+	}
+	t.limit.Fail(lockout, now)
+	return *lockout
+}
+
+func (t *LoginThrottle) purge() {
+	ticker := time.NewTicker(t.limit.Window)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		ms := now.UnixMilli()
+		t.mu.Lock()
+		for key, lockout := range t.lockouts {
+			if lockout.LastFailedLoginAt <= ms-t.limit.Window.Milliseconds() && lockout.LockedUntil <= ms {
+				delete(t.lockouts, key)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the base32 encoded SHA-1 secret of the RFC 6238 test vectors, "12345678901234567890"
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	key, err := totpEncoding.DecodeString(rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the RFC lists 8 digit codes, of which 6 digit codes are the last 6 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(key, tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("totpCode(%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	key, err := totpEncoding.DecodeString(rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1234567890, 0)
+	step := now.Unix() / totpPeriod
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		wantStep int64
+		wantOk   bool
+	}{
+		{"current step", rfc6238Secret, totpCode(key, step), step, true},
+		{"previous step", rfc6238Secret, totpCode(key, step-1), step - 1, true},
+		{"next step", rfc6238Secret, totpCode(key, step+1), step + 1, true},
+		{"beyond skew in the past", rfc6238Secret, totpCode(key, step-totpSkew-1), 0, false},
+		{"beyond skew in the future", rfc6238Secret, totpCode(key, step+totpSkew+1), 0, false},
+		{"lowercase secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", totpCode(key, step), step, true},
+		{"wrong code", rfc6238Secret, "000000", 0, false},
+		{"short code", rfc6238Secret, totpCode(key, step)[:5], 0, false},
+		{"malformed secret", "not base32!", totpCode(key, step), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, gotOk := validateTOTP(tt.secret, tt.code, now)
+			if gotStep != tt.wantStep || gotOk != tt.wantOk {
+				t.Errorf("validateTOTP() = (%d, %v), want (%d, %v)", gotStep, gotOk, tt.wantStep, tt.wantOk)
+			}
+		})
+	}
+}
@@ -28,6 +28,7 @@ const port = process.env.PORT || 3000
 nsp.on('connection', (socket) => {
   const userId = socket.request.headers['x-user-id']
   const username = socket.request.headers['x-username']
+  const restricted = socket.request.headers['x-user-restricted'] || 'false'
 
   socket.on('join', (options, callback) => {
     const user = {
@@ -57,7 +58,7 @@ nsp.on('connection', (socket) => {
     callback()
   })
 
-  socket.on('sendMessage', ({ content, type, s3_url, filesize, room, channelId }, callback) => {
+  socket.on('sendMessage', ({ content, type, s3_url, filesize, attachment, room, channelId }, callback) => {
     const filter = new Filter()
 
     if (filter.isProfane(content)) {
@@ -66,15 +67,20 @@ nsp.on('connection', (socket) => {
 
     let data = {
       channel_id: BigInt(channelId),
-      user_id: BigInt(userId),
       type: type,
       content: content,
     }
     if (type === 'file' || type === 'img') {
-      data.content = `${s3_url}#${data.content}#${filesize}`
+      data.attachment = attachment
     }
     axios
-      .post(`${STORE_API}/api/message`, toJson(data))
+      .post(`${STORE_API}/api/message`, toJson(data), {
+        headers: {
+          'Content-Type': 'application/json',
+          'X-User-Id': userId,
+          'X-User-Restricted': restricted,
+        },
+      })
       .then((res) => {
         if (res.data.msg !== 'ok') {
           throw new Error(res.data.msg)
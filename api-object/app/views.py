@@ -36,9 +36,13 @@ def files():
     img_ext_list = [".png", ".jpg", ".jpeg"]
     fid = str(uuid.uuid4())
 
+    width = height = None
     if file_ext in img_ext_list:
-        content_type = "image/" + file_ext
+        content_type = "image/" + file_ext.lstrip(".")
         object_type = "img"
+        with Image.open(file.stream) as img:
+            width, height = img.size
+        file.stream.seek(0)
     else:
         content_type = "application/octet-stream"
         object_type = "file"
@@ -50,8 +54,13 @@ def files():
     data = {
         "type": object_type,
         "s3_url": s3_host + "/" + s3_bucket + "/" + fid,
-        "orginal_filename": file.filename
+        "object_key": fid,
+        "orginal_filename": file.filename,
+        "mime_type": content_type
     }
+    if width is not None:
+        data["width"] = width
+        data["height"] = height
     resp = make_response(data, 200)
     resp.headers["X-User-Id"] = user_id
     resp.headers["X-Channel-Id"] = channel_id
@@ -3,7 +3,10 @@ package main
 import (
 	"errors"
 	"net/http"
+	"regexp"
+	"sort"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -13,6 +16,8 @@ var (
 	ErrInvalidParam = errors.New("invalid parameter")
 	// ErrUnautorized is unauthorized error
 	ErrUnautorized = errors.New("unauthorized")
+	// ErrForbidden is forbidden error
+	ErrForbidden = errors.New("forbidden")
 	// ErrServer is server error
 	ErrServer = errors.New("server error")
 )
@@ -36,16 +41,61 @@ type Channels struct {
 	Channels []*Channel `json:"channels"`
 }
 
+type ChannelMembers struct {
+	Members []*ChannelMember `json:"members"`
+}
+
+// ChannelInvitation is the channel invitation request payload
+type ChannelInvitation struct {
+	UserID uint64 `json:"user_id" binding:"required"`
+}
+
+// DirectChannelMembers is the direct message request payload
+// the caller is always a member, so UserIDs only lists the other participants
+type DirectChannelMembers struct {
+	UserIDs []uint64 `json:"user_ids" binding:"required,min=1"`
+}
+
 type Messages struct {
+	Messages   []*Message `json:"messages"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+// SearchResults is a page of search hits
+// Total counts the matches in the search index, less the stale hits left out of this page; it is approximate
+// when stale hits of deleted messages, whose removal from the index failed, sit on other pages
+type SearchResults struct {
+	Total    uint64     `json:"total"`
 	Messages []*Message `json:"messages"`
 }
 
+type MessageEdits struct {
+	Edits []*MessageEdit `json:"edits"`
+}
+
+// MessageContent is the message edit request payload
+type MessageContent struct {
+	Content string `json:"content" binding:"required"`
+}
+
+// emojiShortcode matches reaction shortcodes such as "+1" or "thumbs_up"
+var emojiShortcode = regexp.MustCompile(`^[a-z0-9_+-]{1,32}$`)
+
+const (
+	maxDirectMembers    = 8
+	defaultMessageLimit = 50
+	maxMessageLimit     = 200
+	defaultSearchLimit  = 20
+	maxSearchLimit      = 100
+)
+
 func CreateChannel(c *gin.Context) {
 	var channel Channel
 	if err := c.ShouldBindJSON(&channel); err != nil {
 		response(c, http.StatusBadRequest, ErrInvalidParam)
 		return
 	}
+	channel.UserID = c.GetUint64(UserKey)
 	err := createChannel(c.Request.Context(), &channel)
 	switch err {
 	case nil:
@@ -59,13 +109,16 @@ func CreateChannel(c *gin.Context) {
 }
 
 func DeleteChannel(c *gin.Context) {
-	id := c.Param("id")
-	channelID, err := strconv.ParseUint(id, 10, 64)
-	if err != nil {
-		response(c, http.StatusBadRequest, ErrInvalidParam)
+	channel, ok := getChannelParam(c)
+	if !ok {
 		return
 	}
-	err = deleteChannel(c.Request.Context(), channelID)
+	// moderators delete channels of others, but direct channels belong to nobody
+	if channel.Direct || (channel.UserID != c.GetUint64(UserKey) && !canModerate(c)) {
+		response(c, http.StatusForbidden, ErrForbidden)
+		return
+	}
+	err := deleteChannel(c.Request.Context(), channel.ID)
 	switch err {
 	case nil:
 		c.JSON(http.StatusNoContent, OkMsg)
@@ -78,7 +131,184 @@ func DeleteChannel(c *gin.Context) {
 }
 
 func ListChannels(c *gin.Context) {
-	channels, err := listChannels(c.Request.Context())
+	channels, err := listChannels(c.Request.Context(), c.GetUint64(UserKey))
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, Channels{
+			Channels: channels,
+		})
+		return
+	default:
+		logger.ContextLogger.Error(err.Error())
+		response(c, http.StatusInternalServerError, ErrServer)
+		return
+	}
+}
+
+// ListPublicChannels lists the public channels the caller can join
+func ListPublicChannels(c *gin.Context) {
+	channels, err := listPublicChannels(c.Request.Context())
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, Channels{
+			Channels: channels,
+		})
+		return
+	default:
+		logger.ContextLogger.Error(err.Error())
+		response(c, http.StatusInternalServerError, ErrServer)
+		return
+	}
+}
+
+func JoinChannel(c *gin.Context) {
+	channel, ok := getChannelParam(c)
+	if !ok {
+		return
+	}
+	// private channels can only be entered by invitation
+	if channel.Private {
+		response(c, http.StatusForbidden, ErrForbidden)
+		return
+	}
+	err := addChannelMember(c.Request.Context(), channel.ID, c.GetUint64(UserKey))
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, OkMsg)
+		return
+	default:
+		logger.ContextLogger.Error(err.Error())
+		response(c, http.StatusInternalServerError, ErrServer)
+		return
+	}
+}
+
+func LeaveChannel(c *gin.Context) {
+	channel, ok := getChannelParam(c)
+	if !ok {
+		return
+	}
+	// direct message members are fixed by the conversation ID
+	if channel.Direct {
+		response(c, http.StatusForbidden, ErrForbidden)
+		return
+	}
+	err := removeChannelMember(c.Request.Context(), channel.ID, c.GetUint64(UserKey))
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, OkMsg)
+		return
+	default:
+		logger.ContextLogger.Error(err.Error())
+		response(c, http.StatusInternalServerError, ErrServer)
+		return
+	}
+}
+
+func InviteChannelMember(c *gin.Context) {
+	var invitation ChannelInvitation
+	if err := c.ShouldBindJSON(&invitation); err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	channel, ok := getChannelParam(c)
+	if !ok {
+		return
+	}
+	if channel.Direct {
+		response(c, http.StatusForbidden, ErrForbidden)
+		return
+	}
+	member, err := isChannelMember(c.Request.Context(), channel.ID, c.GetUint64(UserKey))
+	if err != nil {
+		logger.ContextLogger.Error(err.Error())
+		response(c, http.StatusInternalServerError, ErrServer)
+		return
+	}
+	if !member {
+		response(c, http.StatusForbidden, ErrForbidden)
+		return
+	}
+	err = addChannelMember(c.Request.Context(), channel.ID, invitation.UserID)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, OkMsg)
+		return
+	default:
+		logger.ContextLogger.Error(err.Error())
+		response(c, http.StatusInternalServerError, ErrServer)
+		return
+	}
+}
+
+func ListChannelMembers(c *gin.Context) {
+	channel, ok := getChannelParam(c)
+	if !ok {
+		return
+	}
+	if !authorizeChannel(c, channel) {
+		return
+	}
+	members, err := listChannelMembers(c.Request.Context(), channel.ID)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, ChannelMembers{
+			Members: members,
+		})
+		return
+	default:
+		logger.ContextLogger.Error(err.Error())
+		response(c, http.StatusInternalServerError, ErrServer)
+		return
+	}
+}
+
+// OpenDirectChannel finds or creates the direct message conversation between the caller and the given users
+func OpenDirectChannel(c *gin.Context) {
+	var payload DirectChannelMembers
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	userID := c.GetUint64(UserKey)
+	members := directChannelMembers(userID, payload.UserIDs)
+	if len(members) < 2 || len(members) > maxDirectMembers {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	channelID := directChannelID(members)
+	channel, err := getChannel(c.Request.Context(), channelID)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, channel)
+		return
+	case ErrChannelNotFound:
+	default:
+		logger.ContextLogger.Error(err.Error())
+		response(c, http.StatusInternalServerError, ErrServer)
+		return
+	}
+	channel = &Channel{
+		ID:      channelID,
+		UserID:  userID,
+		Private: true,
+		Direct:  true,
+		Members: members,
+	}
+	err = createDirectChannel(c.Request.Context(), channel)
+	switch err {
+	case nil:
+		c.JSON(http.StatusCreated, channel)
+		return
+	default:
+		logger.ContextLogger.Error(err.Error())
+		response(c, http.StatusInternalServerError, ErrServer)
+		return
+	}
+}
+
+func ListDirectChannels(c *gin.Context) {
+	channels, err := listDirectChannels(c.Request.Context(), c.GetUint64(UserKey))
 	switch err {
 	case nil:
 		c.JSON(http.StatusOK, Channels{
@@ -98,9 +328,43 @@ func CreateMessage(c *gin.Context) {
 		response(c, http.StatusBadRequest, ErrInvalidParam)
 		return
 	}
+	message.UserID = c.GetUint64(UserKey)
+	switch err := validateMessage(&message); err {
+	case nil:
+	case ErrInvalidAttachment:
+		response(c, http.StatusBadRequest, ErrInvalidAttachment)
+		return
+	default:
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	if _, ok := getReadableChannel(c, message.ChannelID); !ok {
+		return
+	}
+	if message.ParentID != 0 {
+		// replies can only start from a live top-level message of the same channel
+		parent, err := getMessage(c.Request.Context(), message.ChannelID, message.ParentID)
+		switch err {
+		case nil:
+		case ErrMessageNotFound:
+			response(c, http.StatusBadRequest, ErrInvalidParent)
+			return
+		default:
+			logger.ContextLogger.Error(err.Error())
+			response(c, http.StatusInternalServerError, ErrServer)
+			return
+		}
+		if parent.Deleted || parent.ParentID != 0 {
+			response(c, http.StatusBadRequest, ErrInvalidParent)
+			return
+		}
+	}
 	err := createMessage(c.Request.Context(), &message)
 	switch err {
 	case nil:
+		if err := indexMessage(&message); err != nil {
+			logger.ContextLogger.Error(err.Error())
+		}
 		c.JSON(http.StatusCreated, OkMsg)
 		return
 	default:
@@ -111,16 +375,134 @@ func CreateMessage(c *gin.Context) {
 }
 
 func ListMessages(c *gin.Context) {
-	channelID, err := strconv.ParseUint(c.Query("channel-id"), 10, 64)
+	query, err := parseMessageQuery(c)
 	if err != nil {
 		response(c, http.StatusBadRequest, ErrInvalidParam)
 		return
 	}
-	messages, err := listMessages(c.Request.Context(), channelID)
+	if _, ok := getReadableChannel(c, query.ChannelID); !ok {
+		return
+	}
+	messages, nextCursor, err := listMessages(c.Request.Context(), query)
+	if err == nil {
+		if err := saveMigratedAttachments(c.Request.Context(), messages); err != nil {
+			logger.ContextLogger.Error(err.Error())
+		}
+	}
+	if err == nil {
+		err = attachReactions(c.Request.Context(), query.ChannelID, messages, c.GetUint64(UserKey))
+	}
+	if err == nil {
+		err = attachThreads(c.Request.Context(), query.ChannelID, messages)
+	}
 	switch err {
 	case nil:
 		c.JSON(http.StatusOK, Messages{
-			Messages: messages,
+			Messages:   messages,
+			NextCursor: nextCursor.String(),
+		})
+		return
+	default:
+		logger.ContextLogger.Error(err.Error())
+		response(c, http.StatusInternalServerError, ErrServer)
+		return
+	}
+}
+
+func ListReplies(c *gin.Context) {
+	var query MessageQuery
+	if err := parsePageQuery(c, &query); err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	parent, ok := getReadableMessage(c)
+	if !ok {
+		return
+	}
+	query.ChannelID = parent.ChannelID
+	query.ParentID = parent.ID
+	messages, nextCursor, err := listReplies(c.Request.Context(), &query)
+	if err == nil {
+		if err := saveMigratedAttachments(c.Request.Context(), messages); err != nil {
+			logger.ContextLogger.Error(err.Error())
+		}
+	}
+	if err == nil {
+		err = attachReactions(c.Request.Context(), query.ChannelID, messages, c.GetUint64(UserKey))
+	}
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, Messages{
+			Messages:   messages,
+			NextCursor: nextCursor.String(),
+		})
+		return
+	default:
+		logger.ContextLogger.Error(err.Error())
+		response(c, http.StatusInternalServerError, ErrServer)
+		return
+	}
+}
+
+func EditMessage(c *gin.Context) {
+	var payload MessageContent
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	message, ok := getOwnMessage(c)
+	if !ok {
+		return
+	}
+	if message.Type != TextMessage {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	err := editMessage(c.Request.Context(), message, payload.Content)
+	switch err {
+	case nil:
+		if err := indexMessage(message); err != nil {
+			logger.ContextLogger.Error(err.Error())
+		}
+		c.JSON(http.StatusOK, message)
+		return
+	default:
+		logger.ContextLogger.Error(err.Error())
+		response(c, http.StatusInternalServerError, ErrServer)
+		return
+	}
+}
+
+func DeleteMessage(c *gin.Context) {
+	message, ok := getModeratedMessage(c)
+	if !ok {
+		return
+	}
+	err := deleteMessage(c.Request.Context(), message)
+	switch err {
+	case nil:
+		if err := unindexMessage(message); err != nil {
+			logger.ContextLogger.Error(err.Error())
+		}
+		c.JSON(http.StatusNoContent, OkMsg)
+		return
+	default:
+		logger.ContextLogger.Error(err.Error())
+		response(c, http.StatusInternalServerError, ErrServer)
+		return
+	}
+}
+
+func ListMessageEdits(c *gin.Context) {
+	message, ok := getOwnMessage(c)
+	if !ok {
+		return
+	}
+	edits, err := listMessageEdits(c.Request.Context(), message.ChannelID, message.ID)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, MessageEdits{
+			Edits: edits,
 		})
 		return
 	default:
@@ -130,6 +512,370 @@ func ListMessages(c *gin.Context) {
 	}
 }
 
+func AddReaction(c *gin.Context) {
+	emoji := c.Param("emoji")
+	if !emojiShortcode.MatchString(emoji) {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	message, ok := getReadableMessage(c)
+	if !ok {
+		return
+	}
+	err := addReaction(c.Request.Context(), message, emoji, c.GetUint64(UserKey))
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, OkMsg)
+		return
+	default:
+		logger.ContextLogger.Error(err.Error())
+		response(c, http.StatusInternalServerError, ErrServer)
+		return
+	}
+}
+
+func RemoveReaction(c *gin.Context) {
+	emoji := c.Param("emoji")
+	if !emojiShortcode.MatchString(emoji) {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	message, ok := getReadableMessage(c)
+	if !ok {
+		return
+	}
+	err := removeReaction(c.Request.Context(), message, emoji, c.GetUint64(UserKey))
+	switch err {
+	case nil:
+		c.JSON(http.StatusNoContent, OkMsg)
+		return
+	default:
+		logger.ContextLogger.Error(err.Error())
+		response(c, http.StatusInternalServerError, ErrServer)
+		return
+	}
+}
+
+// SearchMessages runs a full-text search over the messages of the channels the caller can read
+func SearchMessages(c *gin.Context) {
+	query, err := parseSearchQuery(c)
+	if err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return
+	}
+	userID := c.GetUint64(UserKey)
+	channels, err := listChannels(c.Request.Context(), userID)
+	if err != nil {
+		logger.ContextLogger.Error(err.Error())
+		response(c, http.StatusInternalServerError, ErrServer)
+		return
+	}
+	directChannels, err := listDirectChannels(c.Request.Context(), userID)
+	if err != nil {
+		logger.ContextLogger.Error(err.Error())
+		response(c, http.StatusInternalServerError, ErrServer)
+		return
+	}
+	readable := make(map[uint64]bool, len(channels)+len(directChannels))
+	for _, channel := range append(channels, directChannels...) {
+		readable[channel.ID] = true
+		query.ChannelIDs = append(query.ChannelIDs, channel.ID)
+	}
+	if query.ChannelID != 0 && !readable[query.ChannelID] {
+		response(c, http.StatusForbidden, ErrForbidden)
+		return
+	}
+	if len(query.ChannelIDs) == 0 {
+		c.JSON(http.StatusOK, SearchResults{})
+		return
+	}
+
+	hits, total, err := searchMessages(query)
+	if err != nil {
+		logger.ContextLogger.Error(err.Error())
+		response(c, http.StatusInternalServerError, ErrServer)
+		return
+	}
+	messages := make([]*Message, 0, len(hits))
+	for _, hit := range hits {
+		// the index only locates messages, their current state is read from the store
+		message, err := getMessage(c.Request.Context(), hit[0], hit[1])
+		if err != nil && err != ErrMessageNotFound {
+			logger.ContextLogger.Error(err.Error())
+			response(c, http.StatusInternalServerError, ErrServer)
+			return
+		}
+		if err == ErrMessageNotFound || message.Deleted {
+			// the message was deleted but not removed from the index, which is repaired for later searches
+			if err := unindexMessage(&Message{ChannelID: hit[0], ID: hit[1]}); err != nil {
+				logger.ContextLogger.Error(err.Error())
+			}
+			if total > 0 {
+				total--
+			}
+			continue
+		}
+		messages = append(messages, message)
+	}
+	c.JSON(http.StatusOK, SearchResults{
+		Total:    total,
+		Messages: messages,
+	})
+}
+
+// getOwnMessage loads the live message addressed by the channel_id and id path parameters
+// it writes the error response and returns false unless the message belongs to the caller
+func getOwnMessage(c *gin.Context) (*Message, bool) {
+	message, ok := getMessageParam(c)
+	if !ok {
+		return nil, false
+	}
+	if message.UserID != c.GetUint64(UserKey) {
+		response(c, http.StatusForbidden, ErrForbidden)
+		return nil, false
+	}
+	return message, true
+}
+
+// getModeratedMessage loads the live message addressed by the channel_id and id path parameters
+// it writes the error response and returns false unless the caller wrote the message or can moderate
+func getModeratedMessage(c *gin.Context) (*Message, bool) {
+	message, ok := getMessageParam(c)
+	if !ok {
+		return nil, false
+	}
+	if message.UserID != c.GetUint64(UserKey) && !canModerate(c) {
+		response(c, http.StatusForbidden, ErrForbidden)
+		return nil, false
+	}
+	return message, true
+}
+
+// getReadableMessage loads the live message addressed by the channel_id and id path parameters
+// it writes the error response and returns false unless the caller may read its channel
+func getReadableMessage(c *gin.Context) (*Message, bool) {
+	message, ok := getMessageParam(c)
+	if !ok {
+		return nil, false
+	}
+	if _, ok := getReadableChannel(c, message.ChannelID); !ok {
+		return nil, false
+	}
+	return message, true
+}
+
+func getMessageParam(c *gin.Context) (*Message, bool) {
+	channelID, err := strconv.ParseUint(c.Param("channel_id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return nil, false
+	}
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return nil, false
+	}
+	message, err := getMessage(c.Request.Context(), channelID, id)
+	switch err {
+	case nil:
+	case ErrMessageNotFound:
+		response(c, http.StatusNotFound, ErrMessageNotFound)
+		return nil, false
+	default:
+		logger.ContextLogger.Error(err.Error())
+		response(c, http.StatusInternalServerError, ErrServer)
+		return nil, false
+	}
+	if message.Deleted {
+		response(c, http.StatusNotFound, ErrMessageNotFound)
+		return nil, false
+	}
+	return message, true
+}
+
+// getChannelParam loads the channel addressed by the id path parameter
+// it writes the error response and returns false if the channel cannot be loaded
+func getChannelParam(c *gin.Context) (*Channel, bool) {
+	channelID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, ErrInvalidParam)
+		return nil, false
+	}
+	return loadChannel(c, channelID)
+}
+
+// getReadableChannel loads a channel and checks that the caller may read and post to it
+func getReadableChannel(c *gin.Context, channelID uint64) (*Channel, bool) {
+	channel, ok := loadChannel(c, channelID)
+	if !ok {
+		return nil, false
+	}
+	if !authorizeChannel(c, channel) {
+		return nil, false
+	}
+	return channel, true
+}
+
+func loadChannel(c *gin.Context, channelID uint64) (*Channel, bool) {
+	channel, err := getChannel(c.Request.Context(), channelID)
+	switch err {
+	case nil:
+		return channel, true
+	case ErrChannelNotFound:
+		response(c, http.StatusNotFound, ErrChannelNotFound)
+		return nil, false
+	default:
+		logger.ContextLogger.Error(err.Error())
+		response(c, http.StatusInternalServerError, ErrServer)
+		return nil, false
+	}
+}
+
+// authorizeChannel only lets members access a channel, public channels have to be joined first
+func authorizeChannel(c *gin.Context, channel *Channel) bool {
+	member, err := isChannelMember(c.Request.Context(), channel.ID, c.GetUint64(UserKey))
+	if err != nil {
+		logger.ContextLogger.Error(err.Error())
+		response(c, http.StatusInternalServerError, ErrServer)
+		return false
+	}
+	if !member {
+		response(c, http.StatusForbidden, ErrForbidden)
+		return false
+	}
+	return true
+}
+
+// directChannelMembers returns the sorted and deduplicated member IDs of a direct message conversation
+func directChannelMembers(userID uint64, userIDs []uint64) []uint64 {
+	seen := map[uint64]bool{
+		userID: true,
+	}
+	members := []uint64{userID}
+	for _, id := range userIDs {
+		if id == 0 || seen[id] {
+			continue
+		}
+		seen[id] = true
+		members = append(members, id)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i] < members[j]
+	})
+	return members
+}
+
+// parseMessageQuery reads channel-id, before, after, limit and cursor query parameters
+// a cursor is only valid together with the same channel-id, before and after it was returned for
+func parseMessageQuery(c *gin.Context) (*MessageQuery, error) {
+	var (
+		query MessageQuery
+		err   error
+	)
+	query.ChannelID, err = strconv.ParseUint(c.Query("channel-id"), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if err := parsePageQuery(c, &query); err != nil {
+		return nil, err
+	}
+	return &query, nil
+}
+
+// parsePageQuery reads the before, after, limit and cursor query parameters
+func parsePageQuery(c *gin.Context, query *MessageQuery) error {
+	var err error
+	if before := c.Query("before"); before != "" {
+		query.Before, err = strconv.ParseUint(before, 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+	if after := c.Query("after"); after != "" {
+		query.After, err = strconv.ParseUint(after, 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+	query.Limit = defaultMessageLimit
+	if limit := c.Query("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			return err
+		}
+		if query.Limit <= 0 || query.Limit > maxMessageLimit {
+			return ErrInvalidParam
+		}
+	}
+	if cursor := c.Query("cursor"); cursor != "" {
+		query.Cursor, err = parseMessageCursor(cursor)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseSearchQuery reads the q, channel-id, user-id, type, since, until, limit and offset query parameters
+// since and until are unix timestamps in seconds
+func parseSearchQuery(c *gin.Context) (*SearchQuery, error) {
+	var (
+		query SearchQuery
+		err   error
+	)
+	query.Text = c.Query("q")
+	if query.Text == "" {
+		return nil, ErrInvalidParam
+	}
+	if channelID := c.Query("channel-id"); channelID != "" {
+		query.ChannelID, err = strconv.ParseUint(channelID, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if userID := c.Query("user-id"); userID != "" {
+		query.UserID, err = strconv.ParseUint(userID, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	query.Type = c.Query("type")
+	if since := c.Query("since"); since != "" {
+		sec, err := strconv.ParseInt(since, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		query.Since = time.Unix(sec, 0)
+	}
+	if until := c.Query("until"); until != "" {
+		sec, err := strconv.ParseInt(until, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		query.Until = time.Unix(sec, 0)
+	}
+	query.Limit = defaultSearchLimit
+	if limit := c.Query("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			return nil, err
+		}
+		if query.Limit <= 0 || query.Limit > maxSearchLimit {
+			return nil, ErrInvalidParam
+		}
+	}
+	if offset := c.Query("offset"); offset != "" {
+		query.Offset, err = strconv.Atoi(offset)
+		if err != nil {
+			return nil, err
+		}
+		if query.Offset < 0 {
+			return nil, ErrInvalidParam
+		}
+	}
+	return &query, nil
+}
+
 func response(c *gin.Context, httpCode int, err error) {
 	message := err.Error()
 	c.JSON(httpCode, ErrResponse{
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// TextMessage is a plain text message
+	TextMessage = "text"
+	// FileMessage is a message carrying an uploaded file
+	FileMessage = "file"
+	// ImageMessage is a message carrying an uploaded image
+	ImageMessage = "img"
+
+	defaultMIMEType = "application/octet-stream"
+)
+
+// ErrInvalidAttachment is invalid attachment error
+var ErrInvalidAttachment = errors.New("invalid attachment")
+
+// Attachment describes the uploaded object of a file or image message
+type Attachment struct {
+	URL       string `json:"url" cql:"url"`
+	ObjectKey string `json:"object_key" cql:"object_key"`
+	Filename  string `json:"filename" cql:"filename"`
+	Size      int64  `json:"size" cql:"size"`
+	MIMEType  string `json:"mime_type" cql:"mime_type"`
+	Width     int    `json:"width,omitempty" cql:"width"`
+	Height    int    `json:"height,omitempty" cql:"height"`
+}
+
+// prettySizeUnits are the units of the human readable sizes in legacy packed contents
+var prettySizeUnits = map[string]float64{
+	"B":  1,
+	"kB": 1e3,
+	"MB": 1e6,
+	"GB": 1e9,
+	"TB": 1e12,
+	"PB": 1e15,
+}
+
+// validateMessage checks that a new message carries exactly what its type requires
+// file and image messages without a caption use the filename as their content
+func validateMessage(message *Message) error {
+	switch message.Type {
+	case TextMessage:
+		if message.Attachment != nil || message.Content == "" {
+			return ErrInvalidParam
+		}
+		return nil
+	case FileMessage, ImageMessage:
+		if err := validateAttachment(message.Type, message.Attachment); err != nil {
+			return err
+		}
+		if message.Content == "" {
+			message.Content = message.Attachment.Filename
+		}
+		return nil
+	default:
+		return ErrInvalidParam
+	}
+}
+
+func validateAttachment(msgType string, attachment *Attachment) error {
+	if attachment == nil || attachment.Filename == "" || attachment.Size < 0 {
+		return ErrInvalidAttachment
+	}
+	u, err := url.Parse(attachment.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidAttachment
+	}
+	if attachment.ObjectKey == "" {
+		attachment.ObjectKey = path.Base(u.Path)
+	}
+	if attachment.MIMEType == "" {
+		attachment.MIMEType = mimeTypeOf(attachment.Filename)
+	}
+	if _, _, err := mime.ParseMediaType(attachment.MIMEType); err != nil {
+		return ErrInvalidAttachment
+	}
+	switch msgType {
+	case ImageMessage:
+		if !strings.HasPrefix(attachment.MIMEType, "image/") || attachment.Width < 0 || attachment.Height < 0 {
+			return ErrInvalidAttachment
+		}
+	default:
+		if attachment.Width != 0 || attachment.Height != 0 {
+			return ErrInvalidAttachment
+		}
+	}
+	return nil
+}
+
+// parseLegacyAttachment converts the "url#filename#size" content that file and image messages used to be packed in
+// the filename may itself contain '#', so the url and size are split off at the first and last one
+// it reports whether the message was converted
+func parseLegacyAttachment(message *Message) bool {
+	if message.Attachment != nil || message.Deleted || (message.Type != FileMessage && message.Type != ImageMessage) {
+		return false
+	}
+	first := strings.Index(message.Content, "#")
+	last := strings.LastIndex(message.Content, "#")
+	if first < 0 || first == last {
+		return false
+	}
+	rawURL, filename, size := message.Content[:first], message.Content[first+1:last], message.Content[last+1:]
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	message.Attachment = &Attachment{
+		URL:       rawURL,
+		ObjectKey: path.Base(u.Path),
+		Filename:  filename,
+		Size:      parsePrettySize(size),
+		MIMEType:  mimeTypeOf(filename),
+	}
+	message.Content = filename
+	return true
+}
+
+// parsePrettySize parses sizes such as "1.23 MB" and returns 0 if the size cannot be read
+func parsePrettySize(size string) int64 {
+	fields := strings.Fields(size)
+	if len(fields) != 2 {
+		return 0
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0
+	}
+	unit, ok := prettySizeUnits[fields[1]]
+	if !ok {
+		return 0
+	}
+	return int64(value * unit)
+}
+
+func mimeTypeOf(filename string) string {
+	if mimeType := mime.TypeByExtension(strings.ToLower(path.Ext(filename))); mimeType != "" {
+		return mimeType
+	}
+	return defaultMIMEType
+}
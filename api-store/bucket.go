@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+
+	"github.com/minghsu0107/sendify/store/internal/bucketing"
+)
+
+// ErrInvalidCursor is invalid cursor error
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// MessageCursor marks where a page of messages stopped
+// Bucket is the partition bucket to resume from, and PageState the position inside it
+type MessageCursor struct {
+	Bucket    int
+	PageState []byte
+}
+
+// String encodes the cursor for clients, a nil cursor encodes as an empty string
+func (cursor *MessageCursor) String() string {
+	if cursor == nil {
+		return ""
+	}
+	buf := make([]byte, 4+len(cursor.PageState))
+	binary.BigEndian.PutUint32(buf, uint32(cursor.Bucket))
+	copy(buf[4:], cursor.PageState)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func parseMessageCursor(s string) (*MessageCursor, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(buf) < 4 {
+		return nil, ErrInvalidCursor
+	}
+	return &MessageCursor{
+		Bucket:    int(binary.BigEndian.Uint32(buf)),
+		PageState: buf[4:],
+	}, nil
+}
+
+// listMessageBuckets returns the buckets a message query has to walk, in walking order
+// the timeline walks from the newest bucket down, or upwards when reading after a cursor message
+func listMessageBuckets(ctx context.Context, query *MessageQuery) ([]int, error) {
+	ascending := query.After != 0
+	var buckets []int
+	scanner := session.Query(`SELECT bucket FROM channel_message_buckets WHERE channel_id = ?`, query.ChannelID).
+		WithContext(ctx).Iter().Scanner()
+	for scanner.Next() {
+		var bucket int
+		if err := scanner.Scan(&bucket); err != nil {
+			return nil, err
+		}
+		if query.Before != 0 && bucket > bucketing.MessageBucket(query.Before) {
+			continue
+		}
+		if query.After != 0 && bucket < bucketing.MessageBucket(query.After) {
+			continue
+		}
+		if query.Cursor != nil && ((!ascending && bucket > query.Cursor.Bucket) || (ascending && bucket < query.Cursor.Bucket)) {
+			continue
+		}
+		buckets = append(buckets, bucket)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	// buckets are clustered newest first
+	if ascending {
+		for i, j := 0, len(buckets)-1; i < j; i, j = i+1, j-1 {
+			buckets[i], buckets[j] = buckets[j], buckets[i]
+		}
+	}
+	return buckets, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMessageCursor(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor *MessageCursor
+	}{
+		{"without page state", &MessageCursor{Bucket: 202203}},
+		{"with page state", &MessageCursor{Bucket: 202112, PageState: []byte{0x00, 0xff, 0x10, 0x2a}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.cursor.String()
+			got, err := parseMessageCursor(s)
+			if err != nil {
+				t.Fatalf("parseMessageCursor(%q) error = %v", s, err)
+			}
+			if got.Bucket != tt.cursor.Bucket || !bytes.Equal(got.PageState, tt.cursor.PageState) {
+				t.Errorf("parseMessageCursor(%q) = %+v, want %+v", s, got, tt.cursor)
+			}
+		})
+	}
+}
+
+func TestNilMessageCursor(t *testing.T) {
+	var cursor *MessageCursor
+	if s := cursor.String(); s != "" {
+		t.Errorf("String() = %q, want empty", s)
+	}
+}
+
+func TestParseMessageCursorInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+	}{
+		{"empty", ""},
+		{"too short", "AAAA"},
+		{"not base64", "!!!!!!!!"},
+		{"padded base64", "AAMXQw=="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseMessageCursor(tt.s); err != ErrInvalidCursor {
+				t.Errorf("parseMessageCursor(%q) error = %v, want %v", tt.s, err, ErrInvalidCursor)
+			}
+		})
+	}
+}
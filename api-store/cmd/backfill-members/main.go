@@ -0,0 +1,136 @@
+// Command backfill-members gives channels created before channel membership their members.
+// Such channels have no private flag and nobody in channel_members, so after the upgrade nobody could read them.
+// It marks them public, and joins their owner and everyone who posted in them, each as of their first message.
+// Run it after the 003-channel-members upgrade, and after migrate has copied messages into channel_messages.
+// It is idempotent and can be re-run, channels that already have a private flag are left alone.
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/gocql/gocql"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	cassandraHost     string = os.Getenv("CASSANDRA_HOST")
+	cassandraUser     string = os.Getenv("CASSANDRA_USER")
+	cassandraPassword string = os.Getenv("CASSANDRA_PASSWORD")
+
+	pageSize = flag.Int("page-size", 1000, "number of rows read per page")
+	dryRun   = flag.Bool("dry-run", false, "only log the channels and members that would be written")
+)
+
+func main() {
+	flag.Parse()
+
+	cluster := gocql.NewCluster(cassandraHost)
+	cluster.RetryPolicy = &gocql.SimpleRetryPolicy{
+		NumRetries: 3,
+	}
+	cluster.Keyspace = "sendify"
+	cluster.Consistency = gocql.Quorum
+	cluster.Authenticator = gocql.PasswordAuthenticator{
+		Username: cassandraUser,
+		Password: cassandraPassword,
+	}
+	session, err := cluster.CreateSession()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer session.Close()
+
+	var (
+		channelID uint64
+		ownerID   *uint64
+		private   *bool
+		direct    *bool
+	)
+	iter := session.Query(`SELECT id, user_id, private, direct FROM channels`).PageSize(*pageSize).Iter()
+	channels, members := 0, 0
+	for iter.Scan(&channelID, &ownerID, &private, &direct) {
+		// channels with a private flag were created with their members
+		if private != nil || (direct != nil && *direct) {
+			continue
+		}
+		joined, err := listPosters(session, channelID)
+		if err != nil {
+			log.Fatalf("failed to list the posters of channel %d: %v", channelID, err)
+		}
+		if ownerID != nil {
+			if _, ok := joined[*ownerID]; !ok {
+				joined[*ownerID] = time.Now()
+			}
+		}
+		log.Infof("channel %d becomes public with %d members", channelID, len(joined))
+		channels++
+		members += len(joined)
+		if *dryRun {
+			continue
+		}
+
+		// one batch per member keeps batches small however many posted in the channel
+		for userID, joinedTime := range joined {
+			batch := session.NewBatch(gocql.LoggedBatch)
+			batch.Query("INSERT INTO channel_members (channel_id, user_id, joined_timestamp) VALUES (?, ?, ?)",
+				channelID,
+				userID,
+				joinedTime)
+			batch.Query("INSERT INTO user_channels (user_id, channel_id) VALUES (?, ?)",
+				userID,
+				channelID)
+			if err := session.ExecuteBatch(batch); err != nil {
+				log.Fatalf("failed to join user %d to channel %d: %v", userID, channelID, err)
+			}
+		}
+		// the flag goes last, so that a channel whose members failed to be written is picked up again
+		if err := session.Query("UPDATE channels SET private = false WHERE id = ?", channelID).Exec(); err != nil {
+			log.Fatalf("failed to mark channel %d public: %v", channelID, err)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("backfilled %d members of %d channels", members, channels)
+}
+
+// listPosters returns everyone who posted in a channel, with the time of their first message
+func listPosters(session *gocql.Session, channelID uint64) (map[uint64]time.Time, error) {
+	var buckets []int
+	scanner := session.Query(`SELECT bucket FROM channel_message_buckets WHERE channel_id = ?`, channelID).Iter().Scanner()
+	for scanner.Next() {
+		var bucket int
+		if err := scanner.Scan(&bucket); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, bucket)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	posters := make(map[uint64]time.Time)
+	for _, bucket := range buckets {
+		scanner := session.Query(`SELECT user_id, insert_timestamp FROM channel_messages WHERE channel_id = ? AND bucket = ?`,
+			channelID,
+			bucket).PageSize(*pageSize).Iter().Scanner()
+		for scanner.Next() {
+			var (
+				userID  uint64
+				msgTime time.Time
+			)
+			if err := scanner.Scan(&userID, &msgTime); err != nil {
+				return nil, err
+			}
+			if first, ok := posters[userID]; !ok || msgTime.Before(first) {
+				posters[userID] = msgTime
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return posters, nil
+}
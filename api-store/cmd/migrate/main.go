@@ -0,0 +1,169 @@
+// Command migrate copies the messages of the legacy channel-partitioned messages table
+// into channel_messages, which is partitioned by channel and monthly bucket.
+// Columns that later changes added to messages are copied only if the legacy table has them,
+// so it also migrates keyspaces that never had those columns added.
+// It is idempotent and can be re-run until the legacy table is dropped.
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/minghsu0107/sendify/store/internal/bucketing"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	cassandraHost     string = os.Getenv("CASSANDRA_HOST")
+	cassandraUser     string = os.Getenv("CASSANDRA_USER")
+	cassandraPassword string = os.Getenv("CASSANDRA_PASSWORD")
+
+	sourceTable = flag.String("source", "messages", "legacy table to copy messages from")
+	pageSize    = flag.Int("page-size", 1000, "number of rows read per page")
+
+	// baseColumns are the columns every version of the legacy messages table has
+	baseColumns = []string{"channel_id", "id", "user_id", "type", "content", "insert_timestamp"}
+	// optionalColumns were added to the legacy messages table by later schema changes
+	optionalColumns = []string{"attachment", "edited_timestamp", "deleted", "parent_id", "also_in_channel", "last_reply_timestamp"}
+)
+
+const keyspace = "sendify"
+
+type attachment struct {
+	URL       string `cql:"url"`
+	ObjectKey string `cql:"object_key"`
+	Filename  string `cql:"filename"`
+	Size      int64  `cql:"size"`
+	MIMEType  string `cql:"mime_type"`
+	Width     int    `cql:"width"`
+	Height    int    `cql:"height"`
+}
+
+func main() {
+	flag.Parse()
+
+	cluster := gocql.NewCluster(cassandraHost)
+	cluster.RetryPolicy = &gocql.SimpleRetryPolicy{
+		NumRetries: 3,
+	}
+	cluster.Keyspace = keyspace
+	cluster.Consistency = gocql.Quorum
+	cluster.Authenticator = gocql.PasswordAuthenticator{
+		Username: cassandraUser,
+		Password: cassandraPassword,
+	}
+	session, err := cluster.CreateSession()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer session.Close()
+
+	existing, err := listColumns(session, *sourceTable)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(existing) == 0 {
+		log.Fatalf("table %s not found in keyspace %s", *sourceTable, keyspace)
+	}
+
+	// nullable columns are scanned into pointers so that nulls are written back as nulls,
+	// and columns missing from the legacy table stay nil
+	var (
+		channelID     uint64
+		id            uint64
+		userID        *uint64
+		msgType       *string
+		content       *string
+		attach        *attachment
+		msgTime       *time.Time
+		editedTime    *time.Time
+		deleted       *bool
+		parentID      *uint64
+		alsoInChannel *bool
+		lastReplyTime *time.Time
+	)
+	dests := map[string]interface{}{
+		"channel_id":           &channelID,
+		"id":                   &id,
+		"user_id":              &userID,
+		"type":                 &msgType,
+		"content":              &content,
+		"attachment":           &attach,
+		"insert_timestamp":     &msgTime,
+		"edited_timestamp":     &editedTime,
+		"deleted":              &deleted,
+		"parent_id":            &parentID,
+		"also_in_channel":      &alsoInChannel,
+		"last_reply_timestamp": &lastReplyTime,
+	}
+	columns := append([]string{}, baseColumns...)
+	for _, column := range optionalColumns {
+		if existing[column] {
+			columns = append(columns, column)
+		} else {
+			log.Infof("%s has no %s column, it is left empty", *sourceTable, column)
+		}
+	}
+	scanDests := make([]interface{}, len(columns))
+	for i, column := range columns {
+		scanDests[i] = dests[column]
+	}
+
+	iter := session.Query(`SELECT ` + strings.Join(columns, ", ") + ` FROM ` + *sourceTable).
+		PageSize(*pageSize).Iter()
+	count := 0
+	for iter.Scan(scanDests...) {
+		bucket := bucketing.MessageBucket(id)
+		batch := session.NewBatch(gocql.LoggedBatch)
+		batch.Query("INSERT INTO channel_message_buckets (channel_id, bucket) VALUES (?, ?)",
+			channelID,
+			bucket)
+		batch.Query("INSERT INTO channel_messages (channel_id, bucket, id, user_id, type, content, attachment, insert_timestamp, edited_timestamp, deleted, parent_id, also_in_channel, last_reply_timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			channelID,
+			bucket,
+			id,
+			userID,
+			msgType,
+			content,
+			attach,
+			msgTime,
+			editedTime,
+			deleted,
+			parentID,
+			alsoInChannel,
+			lastReplyTime)
+		if err := session.ExecuteBatch(batch); err != nil {
+			log.Fatalf("failed to migrate message %d of channel %d: %v", id, channelID, err)
+		}
+		count++
+		if count%10000 == 0 {
+			log.Infof("migrated %d messages", count)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("migrated %d messages from %s", count, *sourceTable)
+}
+
+// listColumns returns the columns a table of the keyspace has, or none if the table does not exist
+func listColumns(session *gocql.Session, table string) (map[string]bool, error) {
+	columns := make(map[string]bool)
+	scanner := session.Query(`SELECT column_name FROM system_schema.columns WHERE keyspace_name = ? AND table_name = ?`,
+		keyspace,
+		table).Iter().Scanner()
+	for scanner.Next() {
+		var column string
+		if err := scanner.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns[column] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return columns, nil
+}
@@ -0,0 +1,98 @@
+// Command reindex rebuilds the full-text search index of api-store from channel_messages.
+// api-store only indexes messages as they are created, edited and deleted, so run it once after search is
+// first deployed to backfill older messages, and whenever the index is lost or out of sync with cassandra.
+// The index can only be opened by one process at a time: stop api-store first, or build a new index with
+// -index and point SEARCH_INDEX_PATH of api-store at it. It is idempotent and can be re-run at any time.
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/minghsu0107/sendify/store/internal/searchdoc"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	cassandraHost     string = os.Getenv("CASSANDRA_HOST")
+	cassandraUser     string = os.Getenv("CASSANDRA_USER")
+	cassandraPassword string = os.Getenv("CASSANDRA_PASSWORD")
+
+	indexPath = flag.String("index", os.Getenv("SEARCH_INDEX_PATH"), "search index to write to, created if missing")
+	pageSize  = flag.Int("page-size", 1000, "number of rows read per page")
+	batchSize = flag.Int("batch-size", 1000, "number of messages written to the index at once")
+)
+
+func main() {
+	flag.Parse()
+	if *indexPath == "" {
+		*indexPath = "search.bleve"
+	}
+
+	index, err := searchdoc.Open(*indexPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer index.Close()
+
+	cluster := gocql.NewCluster(cassandraHost)
+	cluster.RetryPolicy = &gocql.SimpleRetryPolicy{
+		NumRetries: 3,
+	}
+	cluster.Keyspace = "sendify"
+	cluster.Consistency = gocql.Quorum
+	cluster.Authenticator = gocql.PasswordAuthenticator{
+		Username: cassandraUser,
+		Password: cassandraPassword,
+	}
+	session, err := cluster.CreateSession()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer session.Close()
+
+	var (
+		channelID uint64
+		id        uint64
+		userID    uint64
+		msgType   string
+		content   string
+		msgTime   time.Time
+		deleted   bool
+	)
+	// the scan walks every bucket of every channel
+	iter := session.Query(`SELECT channel_id, id, user_id, type, content, insert_timestamp, deleted FROM channel_messages`).
+		PageSize(*pageSize).Iter()
+	batch := index.NewBatch()
+	indexed, removed := 0, 0
+	for iter.Scan(&channelID, &id, &userID, &msgType, &content, &msgTime, &deleted) {
+		docID := searchdoc.ID(channelID, id)
+		if deleted {
+			batch.Delete(docID)
+			removed++
+		} else {
+			if err := batch.Index(docID, searchdoc.New(channelID, userID, msgType, content, msgTime)); err != nil {
+				log.Fatalf("failed to index message %d of channel %d: %v", id, channelID, err)
+			}
+			indexed++
+		}
+		if batch.Size() >= *batchSize {
+			if err := index.Batch(batch); err != nil {
+				log.Fatal(err)
+			}
+			batch.Reset()
+		}
+		if (indexed+removed)%10000 == 0 {
+			log.Infof("reindexed %d messages", indexed+removed)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if err := index.Batch(batch); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("indexed %d messages and removed %d deleted messages from %s", indexed, removed, *indexPath)
+}
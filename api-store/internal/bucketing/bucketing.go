@@ -0,0 +1,19 @@
+// Package bucketing partitions messages by channel and month, and is shared by api-store and its commands
+package bucketing
+
+import (
+	"time"
+
+	"github.com/sony/sonyflake"
+)
+
+// SonyflakeEpoch is the default start time of sonyflake, which api-store keeps for message IDs
+var SonyflakeEpoch = time.Date(2014, 9, 1, 0, 0, 0, 0, time.UTC)
+
+// MessageBucket returns the month a message was created in as yyyymm, read from its sonyflake ID
+// messages are partitioned by channel and bucket so that no partition grows without bound
+func MessageBucket(id uint64) int {
+	elapsed := time.Duration(sonyflake.Decompose(id)["time"]) * 10 * time.Millisecond
+	t := SonyflakeEpoch.Add(elapsed)
+	return t.Year()*100 + int(t.Month())
+}
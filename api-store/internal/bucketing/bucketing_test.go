@@ -0,0 +1,34 @@
+package bucketing
+
+import (
+	"testing"
+	"time"
+)
+
+// sonyflakeID builds a sonyflake ID created at t, whose time is the upper bits above the sequence and machine ID
+func sonyflakeID(t time.Time, low uint64) uint64 {
+	return uint64(t.Sub(SonyflakeEpoch)/(10*time.Millisecond))<<24 | low
+}
+
+func TestMessageBucket(t *testing.T) {
+	tests := []struct {
+		name string
+		t    time.Time
+		want int
+	}{
+		{"epoch", SonyflakeEpoch, 201409},
+		{"start of month", time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC), 202203},
+		{"end of month", time.Date(2022, 3, 31, 23, 59, 59, 990000000, time.UTC), 202203},
+		{"end of year", time.Date(2021, 12, 31, 23, 59, 59, 0, time.UTC), 202112},
+		{"start of year", time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC), 202201},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, low := range []uint64{0, 1<<24 - 1} {
+				if got := MessageBucket(sonyflakeID(tt.t, low)); got != tt.want {
+					t.Errorf("MessageBucket() = %d, want %d", got, tt.want)
+				}
+			}
+		})
+	}
+}
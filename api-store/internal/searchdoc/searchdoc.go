@@ -0,0 +1,95 @@
+// Package searchdoc defines how messages are indexed for full-text search,
+// and is shared by api-store and the reindex command so that both write the same documents
+package searchdoc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/standard"
+	"github.com/blevesearch/bleve/v2/mapping"
+)
+
+// fields of the indexed documents
+const (
+	ChannelIDField = "channel_id"
+	UserIDField    = "user_id"
+	TypeField      = "type"
+	ContentField   = "content"
+	TimestampField = "timestamp"
+)
+
+// Document is the indexed form of a message
+type Document struct {
+	ChannelID string    `json:"channel_id"`
+	UserID    string    `json:"user_id"`
+	Type      string    `json:"type"`
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// New builds the document of a message
+func New(channelID, userID uint64, msgType, content string, timestamp time.Time) *Document {
+	return &Document{
+		ChannelID: strconv.FormatUint(channelID, 10),
+		UserID:    strconv.FormatUint(userID, 10),
+		Type:      msgType,
+		Content:   content,
+		Timestamp: timestamp,
+	}
+}
+
+// Open opens the index at path, or creates it if it does not exist yet
+func Open(path string) (bleve.Index, error) {
+	index, err := bleve.Open(path)
+	if err == bleve.ErrorIndexPathDoesNotExist {
+		index, err = bleve.New(path, NewMapping())
+	}
+	return index, err
+}
+
+// NewMapping returns the mapping of the documents
+// identifiers and types are matched as keywords, and only content is analyzed as text
+func NewMapping() mapping.IndexMapping {
+	keywordField := bleve.NewTextFieldMapping()
+	keywordField.Analyzer = keyword.Name
+	contentField := bleve.NewTextFieldMapping()
+	contentField.Analyzer = standard.Name
+
+	messageMapping := bleve.NewDocumentMapping()
+	messageMapping.AddFieldMappingsAt(ChannelIDField, keywordField)
+	messageMapping.AddFieldMappingsAt(UserIDField, keywordField)
+	messageMapping.AddFieldMappingsAt(TypeField, keywordField)
+	messageMapping.AddFieldMappingsAt(ContentField, contentField)
+	messageMapping.AddFieldMappingsAt(TimestampField, bleve.NewDateTimeFieldMapping())
+
+	indexMapping := bleve.NewIndexMapping()
+	indexMapping.DefaultMapping = messageMapping
+	return indexMapping
+}
+
+// ID returns the document ID of a message
+func ID(channelID, messageID uint64) string {
+	return fmt.Sprintf("%d:%d", channelID, messageID)
+}
+
+// ParseID returns the channel and message IDs of a document ID
+func ParseID(id string) (uint64, uint64, error) {
+	parts := strings.SplitN(id, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("malformed search document id: %s", id)
+	}
+	channelID, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	messageID, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return channelID, messageID, nil
+}
@@ -0,0 +1,53 @@
+package searchdoc
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+func TestID(t *testing.T) {
+	channelID, messageID, err := ParseID(ID(42, 1<<40))
+	if err != nil || channelID != 42 || messageID != 1<<40 {
+		t.Errorf("ParseID(ID(42, 1<<40)) = %d, %d, %v", channelID, messageID, err)
+	}
+	for _, id := range []string{"", "42", "42:", ":1", "a:1", "42:b"} {
+		if _, _, err := ParseID(id); err == nil {
+			t.Errorf("ParseID(%q) returned no error", id)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "search.bleve")
+	index, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Index(ID(1, 2), New(1, 3, "TEXT", "hello world", time.Unix(1600000000, 0))); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopening keeps the documents
+	index, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	contentQuery := bleve.NewMatchQuery("hello")
+	contentQuery.SetField(ContentField)
+	userQuery := bleve.NewTermQuery("3")
+	userQuery.SetField(UserIDField)
+	result, err := index.Search(bleve.NewSearchRequest(bleve.NewConjunctionQuery(contentQuery, userQuery)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Total != 1 || result.Hits[0].ID != ID(1, 2) {
+		t.Errorf("search returned %d hits, want %s", result.Total, ID(1, 2))
+	}
+}
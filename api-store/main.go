@@ -28,18 +28,37 @@ func init() {
 }
 
 func main() {
+	initStore()
+	initSearchIndex()
 	if httpPort == "" {
 		httpPort = "80"
 	}
 	apiGroup := engine.Group("/api")
+	apiGroup.Use(AuthMiddleware())
 
-	apiGroup.POST("/channel", CreateChannel)
+	apiGroup.POST("/channel", WriteAccessMiddleware(), CreateChannel)
 	apiGroup.DELETE("/channel/:id", DeleteChannel)
+	apiGroup.POST("/channel/:id/join", WriteAccessMiddleware(), JoinChannel)
+	apiGroup.POST("/channel/:id/leave", LeaveChannel)
+	apiGroup.POST("/channel/:id/invite", WriteAccessMiddleware(), InviteChannelMember)
+	apiGroup.GET("/channel/:id/members", ListChannelMembers)
 	apiGroup.GET("/channels", ListChannels)
+	apiGroup.GET("/channels/public", ListPublicChannels)
 
-	apiGroup.POST("/message", CreateMessage)
+	apiGroup.POST("/dm", WriteAccessMiddleware(), OpenDirectChannel)
+	apiGroup.GET("/dms", ListDirectChannels)
+
+	apiGroup.POST("/message", WriteAccessMiddleware(), CreateMessage)
+	apiGroup.PATCH("/message/:channel_id/:id", WriteAccessMiddleware(), EditMessage)
+	apiGroup.DELETE("/message/:channel_id/:id", DeleteMessage)
+	apiGroup.GET("/message/:channel_id/:id/edits", ListMessageEdits)
+	apiGroup.GET("/message/:channel_id/:id/replies", ListReplies)
+	apiGroup.PUT("/message/:channel_id/:id/reactions/:emoji", WriteAccessMiddleware(), AddReaction)
+	apiGroup.DELETE("/message/:channel_id/:id/reactions/:emoji", RemoveReaction)
 	apiGroup.GET("/messages", ListMessages)
 
+	apiGroup.GET("/search", SearchMessages)
+
 	logger.ContextLogger.Infof("listening on port %s", httpPort)
 	engine.Run(fmt.Sprintf(":%s", httpPort))
 }
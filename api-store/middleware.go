@@ -2,12 +2,37 @@ package main
 
 import (
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// UserIDHeader carries the ID of the user authenticated by the forwardauth middleware
+	UserIDHeader = "X-User-Id"
+	// UserKey is the key name for retrieving the authenticated user id in a gin context
+	UserKey = "user_id"
+	// UserRestrictedHeader is set to "true" by the forwardauth middleware for users with read-only access,
+	// such as users who have not verified their email yet
+	UserRestrictedHeader = "X-User-Restricted"
+	// RestrictedKey is the key name for retrieving whether the authenticated user is restricted in a gin context
+	RestrictedKey = "restricted"
+	// UserRolesHeader carries the comma separated roles of the user authenticated by the forwardauth middleware
+	UserRolesHeader = "X-User-Roles"
+	// RolesKey is the key name for retrieving the roles of the authenticated user in a gin context
+	RolesKey = "roles"
+)
+
+const (
+	// AdminRole is the role of users who administer every channel
+	AdminRole = "admin"
+	// ModeratorRole is the role of users who moderate every channel
+	ModeratorRole = "moderator"
+)
+
 // CORSMiddleware adds CORS headers to each response
 func CORSMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -26,6 +51,59 @@ func CORSMiddleware() gin.HandlerFunc {
 	}
 }
 
+// AuthMiddleware rejects requests without the user ID header set by the forwardauth middleware
+// api-store is only reachable through the reverse proxy or from services on the internal network,
+// so the header cannot be forged by end users
+func AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.ParseUint(c.GetHeader(UserIDHeader), 10, 64)
+		if err != nil || userID == 0 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, ErrResponse{
+				Message: ErrUnautorized.Error(),
+			})
+			return
+		}
+		c.Set(UserKey, userID)
+		c.Set(RestrictedKey, c.GetHeader(UserRestrictedHeader) == "true")
+		var roles []string
+		if header := c.GetHeader(UserRolesHeader); header != "" {
+			roles = strings.Split(header, ",")
+		}
+		c.Set(RolesKey, roles)
+		c.Next()
+	}
+}
+
+// hasRole checks whether the authenticated user has any of roles
+func hasRole(c *gin.Context, roles ...string) bool {
+	for _, userRole := range c.GetStringSlice(RolesKey) {
+		for _, role := range roles {
+			if userRole == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// canModerate checks whether the authenticated user may delete channels and messages of others
+func canModerate(c *gin.Context) bool {
+	return hasRole(c, AdminRole, ModeratorRole)
+}
+
+// WriteAccessMiddleware rejects restricted users from routes that create channels, memberships or content
+func WriteAccessMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetBool(RestrictedKey) {
+			c.AbortWithStatusJSON(http.StatusForbidden, ErrResponse{
+				Message: ErrForbidden.Error(),
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
 // LogMiddleware is the logging middleware
 func LogMiddleware(logger *log.Entry) gin.HandlerFunc {
 	return func(c *gin.Context) {
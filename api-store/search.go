@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+	"github.com/minghsu0107/sendify/store/internal/searchdoc"
+)
+
+var (
+	// searchIndexPath is the local directory of the search index, which only one process can open;
+	// api-store therefore runs as a single replica, since other replicas would not see the messages it indexes
+	searchIndexPath string = os.Getenv("SEARCH_INDEX_PATH")
+
+	searchIndex bleve.Index
+)
+
+// SearchQuery filters a full-text message search
+// ChannelIDs holds the channels the caller can read, and ChannelID optionally narrows the search to one of them
+type SearchQuery struct {
+	Text       string
+	ChannelIDs []uint64
+	ChannelID  uint64
+	UserID     uint64
+	Type       string
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+	Offset     int
+}
+
+// initSearchIndex opens the search index, or creates it if it does not exist yet
+func initSearchIndex() {
+	if searchIndexPath == "" {
+		searchIndexPath = "search.bleve"
+	}
+	var err error
+	searchIndex, err = searchdoc.Open(searchIndexPath)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// indexMessage adds or replaces a message in the search index
+// messages are only indexed as they change, run cmd/reindex to backfill older messages or rebuild a lost index
+func indexMessage(message *Message) error {
+	return searchIndex.Index(searchdoc.ID(message.ChannelID, message.ID),
+		searchdoc.New(message.ChannelID, message.UserID, message.Type, message.Content, time.Unix(message.Timestamp, 0)))
+}
+
+func unindexMessage(message *Message) error {
+	return searchIndex.Delete(searchdoc.ID(message.ChannelID, message.ID))
+}
+
+// searchMessages returns the (channel id, message id) pairs matching the query, best match first,
+// together with the total number of matches
+func searchMessages(q *SearchQuery) ([][2]uint64, uint64, error) {
+	contentQuery := bleve.NewMatchQuery(q.Text)
+	contentQuery.SetField(searchdoc.ContentField)
+	conjuncts := []query.Query{contentQuery}
+
+	channelIDs := q.ChannelIDs
+	if q.ChannelID != 0 {
+		channelIDs = []uint64{q.ChannelID}
+	}
+	channelQueries := make([]query.Query, 0, len(channelIDs))
+	for _, channelID := range channelIDs {
+		channelQueries = append(channelQueries, newTermQuery(searchdoc.ChannelIDField, strconv.FormatUint(channelID, 10)))
+	}
+	conjuncts = append(conjuncts, bleve.NewDisjunctionQuery(channelQueries...))
+
+	if q.UserID != 0 {
+		conjuncts = append(conjuncts, newTermQuery(searchdoc.UserIDField, strconv.FormatUint(q.UserID, 10)))
+	}
+	if q.Type != "" {
+		conjuncts = append(conjuncts, newTermQuery(searchdoc.TypeField, q.Type))
+	}
+	if !q.Since.IsZero() || !q.Until.IsZero() {
+		dateQuery := bleve.NewDateRangeQuery(q.Since, q.Until)
+		dateQuery.SetField(searchdoc.TimestampField)
+		conjuncts = append(conjuncts, dateQuery)
+	}
+
+	request := bleve.NewSearchRequestOptions(bleve.NewConjunctionQuery(conjuncts...), q.Limit, q.Offset, false)
+	request.SortBy([]string{"-_score", "-" + searchdoc.TimestampField})
+	result, err := searchIndex.Search(request)
+	if err != nil {
+		return nil, 0, err
+	}
+	hits := make([][2]uint64, 0, len(result.Hits))
+	for _, hit := range result.Hits {
+		channelID, messageID, err := searchdoc.ParseID(hit.ID)
+		if err != nil {
+			return nil, 0, err
+		}
+		hits = append(hits, [2]uint64{channelID, messageID})
+	}
+	return hits, result.Total, nil
+}
+
+func newTermQuery(field, term string) *query.TermQuery {
+	termQuery := bleve.NewTermQuery(term)
+	termQuery.SetField(field)
+	return termQuery
+}
@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
+	"hash/fnv"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/gocql/gocql"
+	"github.com/minghsu0107/sendify/store/internal/bucketing"
 	"github.com/sony/sonyflake"
 )
 
@@ -17,23 +21,79 @@ var (
 
 	sf      *sonyflake.Sonyflake
 	session *gocql.Session
+
+	// ErrChannelNotFound is channel not found error
+	ErrChannelNotFound = errors.New("channel not found")
+	// ErrMessageNotFound is message not found error
+	ErrMessageNotFound = errors.New("message not found")
+	// ErrInvalidParent is invalid thread parent error
+	ErrInvalidParent = errors.New("invalid parent message")
 )
 
+const messageColumns = `id, user_id, type, content, attachment, insert_timestamp, edited_timestamp, deleted, parent_id, also_in_channel, last_reply_timestamp`
+
 type Channel struct {
-	ID   uint64 `json:"id"`
-	Name string `json:"name" binding:"required"`
+	ID      uint64   `json:"id"`
+	Name    string   `json:"name" binding:"required"`
+	UserID  uint64   `json:"user_id"`
+	Private bool     `json:"private"`
+	Direct  bool     `json:"direct,omitempty"`
+	Members []uint64 `json:"members,omitempty"`
+}
+
+// ChannelMember is a user who joined or was invited to a channel
+type ChannelMember struct {
+	UserID    uint64 `json:"user_id"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// MessageQuery selects a page of messages in a channel, or of replies in a thread if ParentID is set
+// Before and After are exclusive message ID cursors, and Cursor resumes a previous query
+type MessageQuery struct {
+	ChannelID uint64
+	ParentID  uint64
+	Before    uint64
+	After     uint64
+	Limit     int
+	Cursor    *MessageCursor
 }
 
 type Message struct {
-	ChannelID uint64 `json:"channel_id" binding:"required"`
-	ID        uint64 `json:"id"`
-	UserID    uint64 `json:"user_id" binding:"required"`
-	Type      string `json:"type" binding:"required"`
-	Content   string `json:"content" binding:"required"`
+	ChannelID       uint64      `json:"channel_id" binding:"required"`
+	ID              uint64      `json:"id"`
+	UserID          uint64      `json:"user_id"`
+	Type            string      `json:"type" binding:"required"`
+	Content         string      `json:"content"`
+	Attachment      *Attachment `json:"attachment,omitempty"`
+	Timestamp       int64       `json:"timestamp"`
+	EditedTimestamp int64       `json:"edited_timestamp,omitempty"`
+	Deleted         bool        `json:"deleted,omitempty"`
+	Reactions       []*Reaction `json:"reactions,omitempty"`
+	// ParentID is the thread a reply belongs to, and AlsoInChannel shows the reply on the channel timeline too
+	ParentID           uint64 `json:"parent_id,omitempty"`
+	AlsoInChannel      bool   `json:"also_in_channel,omitempty"`
+	ReplyCount         int64  `json:"reply_count,omitempty"`
+	LastReplyTimestamp int64  `json:"last_reply_timestamp,omitempty"`
+
+	// migrated is set when a legacy packed attachment was parsed on read and should be saved back
+	migrated bool
+}
+
+// Reaction aggregates the reactions with the same emoji on a message
+type Reaction struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+	Me    bool   `json:"me"`
+}
+
+// MessageEdit is a previous revision of an edited message
+type MessageEdit struct {
+	Content   string `json:"content"`
 	Timestamp int64  `json:"timestamp"`
 }
 
-func init() {
+// initStore connects to cassandra, it is called by main rather than init so that tests can run without cassandra
+func initStore() {
 	var err error
 	sf, err = newSonyFlake()
 	if err != nil {
@@ -56,42 +116,153 @@ func init() {
 	}
 }
 
+// createChannel creates a channel and makes its creator the first member
 func createChannel(ctx context.Context, channel *Channel) error {
 	id, err := sf.NextID()
 	if err != nil {
 		return err
 	}
 	channel.ID = id
-	if err := session.Query("INSERT INTO channels (id, name) VALUES (?, ?)",
+	batch := session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query("INSERT INTO channels (id, name, user_id, private) VALUES (?, ?, ?, ?)",
 		channel.ID,
-		channel.Name).WithContext(ctx).Exec(); err != nil {
+		channel.Name,
+		channel.UserID,
+		channel.Private)
+	addChannelMemberQueries(batch, channel.ID, channel.UserID, time.Now())
+	if err := session.ExecuteBatch(batch); err != nil {
 		return err
 	}
 	return nil
 }
 
+// createDirectChannel stores a direct message conversation under its deterministic ID
+// writing the same conversation twice is harmless since all columns are derived from its members
+func createDirectChannel(ctx context.Context, channel *Channel) error {
+	now := time.Now()
+	batch := session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query("INSERT INTO channels (id, name, user_id, private, direct, member_ids) VALUES (?, ?, ?, ?, ?, ?)",
+		channel.ID,
+		channel.Name,
+		channel.UserID,
+		channel.Private,
+		channel.Direct,
+		channel.Members)
+	for _, userID := range channel.Members {
+		addChannelMemberQueries(batch, channel.ID, userID, now)
+	}
+	return session.ExecuteBatch(batch)
+}
+
+func getChannel(ctx context.Context, channelID uint64) (*Channel, error) {
+	var (
+		name      string
+		userID    uint64
+		private   bool
+		direct    bool
+		memberIDs []uint64
+	)
+	if err := session.Query(`SELECT name, user_id, private, direct, member_ids FROM channels WHERE id = ?`, channelID).
+		WithContext(ctx).Scan(&name, &userID, &private, &direct, &memberIDs); err != nil {
+		if err == gocql.ErrNotFound {
+			return nil, ErrChannelNotFound
+		}
+		return nil, err
+	}
+	return &Channel{
+		ID:      channelID,
+		Name:    name,
+		UserID:  userID,
+		Private: private,
+		Direct:  direct,
+		Members: memberIDs,
+	}, nil
+}
+
 func deleteChannel(ctx context.Context, channelID uint64) error {
-	if err := session.Query("DELETE FROM channels WHERE id = ?", channelID).WithContext(ctx).Exec(); err != nil {
+	members, err := listChannelMembers(ctx, channelID)
+	if err != nil {
+		return err
+	}
+	batch := session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query("DELETE FROM channels WHERE id = ?", channelID)
+	batch.Query("DELETE FROM channel_members WHERE channel_id = ?", channelID)
+	for _, member := range members {
+		batch.Query("DELETE FROM user_channels WHERE user_id = ? AND channel_id = ?", member.UserID, channelID)
+	}
+	if err := session.ExecuteBatch(batch); err != nil {
 		return err
 	}
 	return nil
 }
 
-func listChannels(ctx context.Context) ([]*Channel, error) {
+// listChannels returns the public and private channels the user is a member of
+// direct message conversations are listed separately by listDirectChannels
+func listChannels(ctx context.Context, userID uint64) ([]*Channel, error) {
+	joined, err := listUserChannelIDs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(joined) == 0 {
+		return nil, nil
+	}
+	channelIDs := make([]uint64, 0, len(joined))
+	for channelID := range joined {
+		channelIDs = append(channelIDs, channelID)
+	}
+	var channels []*Channel
+	scanner := session.Query(`SELECT id, name, user_id, private, direct FROM channels WHERE id IN ?`, channelIDs).
+		WithContext(ctx).Iter().Scanner()
+	for scanner.Next() {
+		var (
+			id      uint64
+			name    string
+			ownerID uint64
+			private bool
+			direct  bool
+		)
+		if err := scanner.Scan(&id, &name, &ownerID, &private, &direct); err != nil {
+			return nil, err
+		}
+		if direct {
+			continue
+		}
+		channels = append(channels, &Channel{
+			ID:      id,
+			Name:    name,
+			UserID:  ownerID,
+			Private: private,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return channels, nil
+}
+
+// listPublicChannels returns every public channel, which anyone can join
+func listPublicChannels(ctx context.Context) ([]*Channel, error) {
 	var channels []*Channel
-	scanner := session.Query(`SELECT id, name FROM channels`).WithContext(ctx).Iter().Scanner()
+	scanner := session.Query(`SELECT id, name, user_id, private, direct FROM channels`).WithContext(ctx).Iter().Scanner()
 	for scanner.Next() {
 		var (
-			id   uint64
-			name string
+			id      uint64
+			name    string
+			ownerID uint64
+			private bool
+			direct  bool
 		)
-		err := scanner.Scan(&id, &name)
-		if err != nil {
+		if err := scanner.Scan(&id, &name, &ownerID, &private, &direct); err != nil {
 			return nil, err
 		}
+		if direct || private {
+			continue
+		}
 		channels = append(channels, &Channel{
-			ID:   id,
-			Name: name,
+			ID:      id,
+			Name:    name,
+			UserID:  ownerID,
+			Private: private,
 		})
 	}
 	if err := scanner.Err(); err != nil {
@@ -100,53 +271,572 @@ func listChannels(ctx context.Context) ([]*Channel, error) {
 	return channels, nil
 }
 
+// listDirectChannels returns the direct message conversations the user takes part in
+func listDirectChannels(ctx context.Context, userID uint64) ([]*Channel, error) {
+	joined, err := listUserChannelIDs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(joined) == 0 {
+		return nil, nil
+	}
+	channelIDs := make([]uint64, 0, len(joined))
+	for channelID := range joined {
+		channelIDs = append(channelIDs, channelID)
+	}
+	var channels []*Channel
+	scanner := session.Query(`SELECT id, name, user_id, direct, member_ids FROM channels WHERE id IN ?`, channelIDs).
+		WithContext(ctx).Iter().Scanner()
+	for scanner.Next() {
+		var (
+			id        uint64
+			name      string
+			ownerID   uint64
+			direct    bool
+			memberIDs []uint64
+		)
+		if err := scanner.Scan(&id, &name, &ownerID, &direct, &memberIDs); err != nil {
+			return nil, err
+		}
+		if !direct {
+			continue
+		}
+		channels = append(channels, &Channel{
+			ID:      id,
+			Name:    name,
+			UserID:  ownerID,
+			Private: true,
+			Direct:  true,
+			Members: memberIDs,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return channels, nil
+}
+
+func isChannelMember(ctx context.Context, channelID, userID uint64) (bool, error) {
+	var id uint64
+	if err := session.Query(`SELECT user_id FROM channel_members WHERE channel_id = ? AND user_id = ?`,
+		channelID,
+		userID).WithContext(ctx).Scan(&id); err != nil {
+		if err == gocql.ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func addChannelMember(ctx context.Context, channelID, userID uint64) error {
+	batch := session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	addChannelMemberQueries(batch, channelID, userID, time.Now())
+	return session.ExecuteBatch(batch)
+}
+
+func removeChannelMember(ctx context.Context, channelID, userID uint64) error {
+	batch := session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query("DELETE FROM channel_members WHERE channel_id = ? AND user_id = ?", channelID, userID)
+	batch.Query("DELETE FROM user_channels WHERE user_id = ? AND channel_id = ?", userID, channelID)
+	return session.ExecuteBatch(batch)
+}
+
+func listChannelMembers(ctx context.Context, channelID uint64) ([]*ChannelMember, error) {
+	var members []*ChannelMember
+	scanner := session.Query(`SELECT user_id, joined_timestamp FROM channel_members WHERE channel_id = ?`, channelID).
+		WithContext(ctx).Iter().Scanner()
+	for scanner.Next() {
+		var (
+			userID     uint64
+			joinedTime time.Time
+		)
+		if err := scanner.Scan(&userID, &joinedTime); err != nil {
+			return nil, err
+		}
+		members = append(members, &ChannelMember{
+			UserID:    userID,
+			Timestamp: joinedTime.Unix(),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func listUserChannelIDs(ctx context.Context, userID uint64) (map[uint64]bool, error) {
+	channelIDs := make(map[uint64]bool)
+	scanner := session.Query(`SELECT channel_id FROM user_channels WHERE user_id = ?`, userID).
+		WithContext(ctx).Iter().Scanner()
+	for scanner.Next() {
+		var channelID uint64
+		if err := scanner.Scan(&channelID); err != nil {
+			return nil, err
+		}
+		channelIDs[channelID] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return channelIDs, nil
+}
+
+// addChannelMemberQueries keeps channel_members and its user_channels lookup table in sync
+func addChannelMemberQueries(batch *gocql.Batch, channelID, userID uint64, joinedTime time.Time) {
+	batch.Query("INSERT INTO channel_members (channel_id, user_id, joined_timestamp) VALUES (?, ?, ?)",
+		channelID,
+		userID,
+		joinedTime)
+	batch.Query("INSERT INTO user_channels (user_id, channel_id) VALUES (?, ?)",
+		userID,
+		channelID)
+}
+
+// createMessage stores a message, and registers it in its parent's thread if it is a reply
 func createMessage(ctx context.Context, message *Message) error {
 	id, err := sf.NextID()
 	if err != nil {
 		return err
 	}
 	message.ID = id
-	if err := session.Query("INSERT INTO messages (channel_id, id, user_id, type, content, insert_timestamp) VALUES (?, ?, ?, ?, ?, ?)",
+	now := time.Now()
+	message.Timestamp = now.Unix()
+	bucket := bucketing.MessageBucket(message.ID)
+	batch := session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query("INSERT INTO channel_message_buckets (channel_id, bucket) VALUES (?, ?)",
+		message.ChannelID,
+		bucket)
+	if message.ParentID == 0 {
+		message.AlsoInChannel = false
+		batch.Query("INSERT INTO channel_messages (channel_id, bucket, id, user_id, type, content, attachment, insert_timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			message.ChannelID,
+			bucket,
+			message.ID,
+			message.UserID,
+			message.Type,
+			message.Content,
+			message.Attachment,
+			now)
+		return session.ExecuteBatch(batch)
+	}
+
+	batch.Query("INSERT INTO channel_messages (channel_id, bucket, id, user_id, type, content, attachment, insert_timestamp, parent_id, also_in_channel) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
 		message.ChannelID,
+		bucket,
 		message.ID,
 		message.UserID,
 		message.Type,
 		message.Content,
-		time.Now()).WithContext(ctx).Exec(); err != nil {
+		message.Attachment,
+		now,
+		message.ParentID,
+		message.AlsoInChannel)
+	batch.Query("INSERT INTO message_replies (channel_id, parent_id, id) VALUES (?, ?, ?)",
+		message.ChannelID,
+		message.ParentID,
+		message.ID)
+	batch.Query("UPDATE channel_messages SET last_reply_timestamp = ? WHERE channel_id = ? AND bucket = ? AND id = ?",
+		now,
+		message.ChannelID,
+		bucketing.MessageBucket(message.ParentID),
+		message.ParentID)
+	if err := session.ExecuteBatch(batch); err != nil {
 		return err
 	}
-	return nil
+	// counters cannot be updated in a logged batch together with regular tables
+	return session.Query("UPDATE message_threads SET reply_count = reply_count + 1 WHERE channel_id = ? AND parent_id = ?",
+		message.ChannelID,
+		message.ParentID).WithContext(ctx).Exec()
 }
 
-func listMessages(ctx context.Context, channelID uint64) ([]*Message, error) {
+// listMessages returns a page of the channel timeline, walking its buckets in turn
+// replies that were not also posted to the channel are left out, so a page may hold fewer than Limit messages
+func listMessages(ctx context.Context, query *MessageQuery) ([]*Message, *MessageCursor, error) {
+	buckets, err := listMessageBuckets(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	stmt := `SELECT ` + messageColumns + ` FROM channel_messages WHERE channel_id = ? AND bucket = ?`
+	if query.Before != 0 {
+		stmt += ` AND id < ?`
+	}
+	if query.After != 0 {
+		// walk forward from the cursor so that no message newer than it is skipped
+		stmt += ` AND id > ? ORDER BY id ASC`
+	}
+
+	var (
+		messages  []*Message
+		pageState []byte
+	)
+	if query.Cursor != nil && len(buckets) > 0 && buckets[0] == query.Cursor.Bucket {
+		pageState = query.Cursor.PageState
+	}
+	remaining := query.Limit
+	for i, bucket := range buckets {
+		values := []interface{}{query.ChannelID, bucket}
+		if query.Before != 0 {
+			values = append(values, query.Before)
+		}
+		if query.After != 0 {
+			values = append(values, query.After)
+		}
+		iter := session.Query(stmt, values...).WithContext(ctx).
+			PageSize(remaining).PageState(pageState).Iter()
+		nextPageState := iter.PageState()
+		scanner := iter.Scanner()
+		for scanner.Next() {
+			remaining--
+			message, err := scanMessage(query.ChannelID, scanner.Scan)
+			if err != nil {
+				return nil, nil, err
+			}
+			if message.ParentID != 0 && !message.AlsoInChannel {
+				continue
+			}
+			messages = append(messages, message)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, nil, err
+		}
+		if len(nextPageState) > 0 {
+			return messages, &MessageCursor{
+				Bucket:    bucket,
+				PageState: nextPageState,
+			}, nil
+		}
+		if remaining <= 0 {
+			if i+1 < len(buckets) {
+				return messages, &MessageCursor{
+					Bucket: buckets[i+1],
+				}, nil
+			}
+			break
+		}
+		pageState = nil
+	}
+	return messages, nil, nil
+}
+
+// listReplies returns a page of the replies in a thread, oldest first
+func listReplies(ctx context.Context, query *MessageQuery) ([]*Message, *MessageCursor, error) {
+	stmt := `SELECT id FROM message_replies WHERE channel_id = ? AND parent_id = ?`
+	values := []interface{}{query.ChannelID, query.ParentID}
+	if query.Before != 0 {
+		stmt += ` AND id < ?`
+		values = append(values, query.Before)
+	}
+	if query.After != 0 {
+		stmt += ` AND id > ?`
+		values = append(values, query.After)
+	}
+	var pageState []byte
+	if query.Cursor != nil {
+		pageState = query.Cursor.PageState
+	}
+	iter := session.Query(stmt, values...).WithContext(ctx).
+		PageSize(query.Limit).PageState(pageState).Iter()
+	var nextCursor *MessageCursor
+	if nextPageState := iter.PageState(); len(nextPageState) > 0 {
+		nextCursor = &MessageCursor{
+			PageState: nextPageState,
+		}
+	}
+	replyIDs := make(map[int][]uint64)
+	scanner := iter.Scanner()
+	for scanner.Next() {
+		var id uint64
+		if err := scanner.Scan(&id); err != nil {
+			return nil, nil, err
+		}
+		bucket := bucketing.MessageBucket(id)
+		replyIDs[bucket] = append(replyIDs[bucket], id)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
 	var messages []*Message
-	scanner := session.Query(`SELECT id, user_id, type, content, insert_timestamp FROM messages WHERE channel_id = ?`, channelID).WithContext(ctx).Iter().Scanner()
+	for bucket, ids := range replyIDs {
+		scanner = session.Query(`SELECT `+messageColumns+` FROM channel_messages WHERE channel_id = ? AND bucket = ? AND id IN ?`,
+			query.ChannelID,
+			bucket,
+			ids).WithContext(ctx).Iter().Scanner()
+		for scanner.Next() {
+			message, err := scanMessage(query.ChannelID, scanner.Scan)
+			if err != nil {
+				return nil, nil, err
+			}
+			messages = append(messages, message)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].ID < messages[j].ID
+	})
+	return messages, nextCursor, nil
+}
+
+func getMessage(ctx context.Context, channelID, id uint64) (*Message, error) {
+	message, err := scanMessage(channelID, session.Query(`SELECT `+messageColumns+` FROM channel_messages WHERE channel_id = ? AND bucket = ? AND id = ?`,
+		channelID,
+		bucketing.MessageBucket(id),
+		id).WithContext(ctx).Scan)
+	if err != nil {
+		if err == gocql.ErrNotFound {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	return message, nil
+}
+
+// editMessage replaces the content of a message and keeps its prior content in the edit history
+func editMessage(ctx context.Context, message *Message, content string) error {
+	now := time.Now()
+	batch := session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query("INSERT INTO message_edits (channel_id, message_id, edited_timestamp, content) VALUES (?, ?, ?, ?)",
+		message.ChannelID,
+		message.ID,
+		now,
+		message.Content)
+	batch.Query("UPDATE channel_messages SET content = ?, edited_timestamp = ? WHERE channel_id = ? AND bucket = ? AND id = ?",
+		content,
+		now,
+		message.ChannelID,
+		bucketing.MessageBucket(message.ID),
+		message.ID)
+	if err := session.ExecuteBatch(batch); err != nil {
+		return err
+	}
+	message.Content = content
+	message.EditedTimestamp = now.Unix()
+	return nil
+}
+
+// deleteMessage turns a message into a tombstone and drops its attachment, edit history and reactions
+func deleteMessage(ctx context.Context, message *Message) error {
+	now := time.Now()
+	batch := session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query("UPDATE channel_messages SET content = '', attachment = null, deleted = true, edited_timestamp = ? WHERE channel_id = ? AND bucket = ? AND id = ?",
+		now,
+		message.ChannelID,
+		bucketing.MessageBucket(message.ID),
+		message.ID)
+	batch.Query("DELETE FROM message_edits WHERE channel_id = ? AND message_id = ?",
+		message.ChannelID,
+		message.ID)
+	batch.Query("DELETE FROM message_reactions WHERE channel_id = ? AND message_id = ?",
+		message.ChannelID,
+		message.ID)
+	if err := session.ExecuteBatch(batch); err != nil {
+		return err
+	}
+	if message.ParentID == 0 {
+		return nil
+	}
+	// the tombstone stays in the thread but no longer counts as a reply
+	return session.Query("UPDATE message_threads SET reply_count = reply_count - 1 WHERE channel_id = ? AND parent_id = ?",
+		message.ChannelID,
+		message.ParentID).WithContext(ctx).Exec()
+}
+
+func listMessageEdits(ctx context.Context, channelID, messageID uint64) ([]*MessageEdit, error) {
+	var edits []*MessageEdit
+	scanner := session.Query(`SELECT edited_timestamp, content FROM message_edits WHERE channel_id = ? AND message_id = ?`,
+		channelID,
+		messageID).WithContext(ctx).Iter().Scanner()
 	for scanner.Next() {
 		var (
-			id      uint64
-			userID  uint64
-			msgType string
-			content string
-			msgTime time.Time
+			editedTime time.Time
+			content    string
 		)
-		err := scanner.Scan(&id, &userID, &msgType, &content, &msgTime)
-		if err != nil {
+		if err := scanner.Scan(&editedTime, &content); err != nil {
 			return nil, err
 		}
-
-		messages = append(messages, &Message{
-			ChannelID: channelID,
-			ID:        id,
-			UserID:    userID,
-			Type:      msgType,
+		edits = append(edits, &MessageEdit{
 			Content:   content,
-			Timestamp: msgTime.Unix(),
+			Timestamp: editedTime.Unix(),
 		})
 	}
 	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
-	return messages, nil
+	return edits, nil
+}
+
+func addReaction(ctx context.Context, message *Message, emoji string, userID uint64) error {
+	return session.Query("INSERT INTO message_reactions (channel_id, message_id, emoji, user_id, reacted_timestamp) VALUES (?, ?, ?, ?, ?)",
+		message.ChannelID,
+		message.ID,
+		emoji,
+		userID,
+		time.Now()).WithContext(ctx).Exec()
+}
+
+func removeReaction(ctx context.Context, message *Message, emoji string, userID uint64) error {
+	return session.Query("DELETE FROM message_reactions WHERE channel_id = ? AND message_id = ? AND emoji = ? AND user_id = ?",
+		message.ChannelID,
+		message.ID,
+		emoji,
+		userID).WithContext(ctx).Exec()
+}
+
+// attachReactions loads the reactions of a page of messages in one query
+// and aggregates them per emoji, flagging the ones added by the given user
+func attachReactions(ctx context.Context, channelID uint64, messages []*Message, userID uint64) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	byID := make(map[uint64]*Message, len(messages))
+	messageIDs := make([]uint64, 0, len(messages))
+	for _, message := range messages {
+		byID[message.ID] = message
+		messageIDs = append(messageIDs, message.ID)
+	}
+	scanner := session.Query(`SELECT message_id, emoji, user_id FROM message_reactions WHERE channel_id = ? AND message_id IN ?`,
+		channelID,
+		messageIDs).WithContext(ctx).Iter().Scanner()
+	for scanner.Next() {
+		var (
+			messageID uint64
+			emoji     string
+			reactorID uint64
+		)
+		if err := scanner.Scan(&messageID, &emoji, &reactorID); err != nil {
+			return err
+		}
+		message, ok := byID[messageID]
+		if !ok || message.Deleted {
+			continue
+		}
+		// rows are clustered by emoji, so reactions with the same emoji are adjacent
+		n := len(message.Reactions)
+		if n == 0 || message.Reactions[n-1].Emoji != emoji {
+			message.Reactions = append(message.Reactions, &Reaction{
+				Emoji: emoji,
+			})
+			n++
+		}
+		message.Reactions[n-1].Count++
+		if reactorID == userID {
+			message.Reactions[n-1].Me = true
+		}
+	}
+	return scanner.Err()
+}
+
+// attachThreads loads the reply counts of the top-level messages in a page in one query
+func attachThreads(ctx context.Context, channelID uint64, messages []*Message) error {
+	byID := make(map[uint64]*Message, len(messages))
+	var parentIDs []uint64
+	for _, message := range messages {
+		if message.ParentID != 0 || message.LastReplyTimestamp == 0 {
+			continue
+		}
+		byID[message.ID] = message
+		parentIDs = append(parentIDs, message.ID)
+	}
+	if len(parentIDs) == 0 {
+		return nil
+	}
+	scanner := session.Query(`SELECT parent_id, reply_count FROM message_threads WHERE channel_id = ? AND parent_id IN ?`,
+		channelID,
+		parentIDs).WithContext(ctx).Iter().Scanner()
+	for scanner.Next() {
+		var (
+			parentID   uint64
+			replyCount int64
+		)
+		if err := scanner.Scan(&parentID, &replyCount); err != nil {
+			return err
+		}
+		if message, ok := byID[parentID]; ok {
+			message.ReplyCount = replyCount
+		}
+	}
+	return scanner.Err()
+}
+
+// scanMessage reads a row selected with messageColumns
+func scanMessage(channelID uint64, scan func(dest ...interface{}) error) (*Message, error) {
+	var (
+		id            uint64
+		userID        uint64
+		msgType       string
+		content       string
+		attachment    *Attachment
+		msgTime       time.Time
+		editedTime    time.Time
+		deleted       bool
+		parentID      uint64
+		alsoInChannel bool
+		lastReplyTime time.Time
+	)
+	if err := scan(&id, &userID, &msgType, &content, &attachment, &msgTime, &editedTime, &deleted, &parentID, &alsoInChannel, &lastReplyTime); err != nil {
+		return nil, err
+	}
+	message := &Message{
+		ChannelID:     channelID,
+		ID:            id,
+		UserID:        userID,
+		Type:          msgType,
+		Content:       content,
+		Attachment:    attachment,
+		Timestamp:     msgTime.Unix(),
+		Deleted:       deleted,
+		ParentID:      parentID,
+		AlsoInChannel: alsoInChannel,
+	}
+	if !editedTime.IsZero() {
+		message.EditedTimestamp = editedTime.Unix()
+	}
+	if !lastReplyTime.IsZero() {
+		message.LastReplyTimestamp = lastReplyTime.Unix()
+	}
+	// tombstones written before deletes dropped the attachment may still carry one
+	if deleted {
+		message.Content = ""
+		message.Attachment = nil
+		return message, nil
+	}
+	message.migrated = parseLegacyAttachment(message)
+	return message, nil
+}
+
+// saveMigratedAttachments writes back the attachments parsed from legacy packed contents
+func saveMigratedAttachments(ctx context.Context, messages []*Message) error {
+	for _, message := range messages {
+		if !message.migrated {
+			continue
+		}
+		if err := session.Query("UPDATE channel_messages SET content = ?, attachment = ? WHERE channel_id = ? AND bucket = ? AND id = ?",
+			message.Content,
+			message.Attachment,
+			message.ChannelID,
+			bucketing.MessageBucket(message.ID),
+			message.ID).WithContext(ctx).Exec(); err != nil {
+			return err
+		}
+		message.migrated = false
+	}
+	return nil
+}
+
+// directChannelID derives a conversation ID from its sorted member IDs,
+// so the same members always map to the same conversation
+// the top bit is set to keep it apart from sonyflake IDs, which never use it
+func directChannelID(members []uint64) uint64 {
+	h := fnv.New64a()
+	buf := make([]byte, 8)
+	for _, userID := range members {
+		binary.BigEndian.PutUint64(buf, userID)
+		h.Write(buf)
+	}
+	return h.Sum64() | 1<<63
 }
 
 func newSonyFlake() (*sonyflake.Sonyflake, error) {
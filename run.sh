@@ -5,12 +5,24 @@ export REDIS_PASSWORD=pass.123
 
 sudo -- sh -c -e "echo '127.0.0.1   minio' >> /etc/hosts"
 
+# dev_keys generates the development jwt signing key of api-account, unless it exists
+dev_keys() {
+    if [ ! -f api-account/keys/jwt-dev-ed25519.pem ]; then
+        mkdir -p api-account/keys
+        docker run --rm -v "$(pwd)/api-account/keys:/keys" alpine/openssl \
+            genpkey -algorithm ed25519 -out /keys/jwt-dev-ed25519.pem
+    fi
+}
+
 case "$1" in
     "run")
+        dev_keys
         docker-compose up;;
+    "dev-keys")
+        dev_keys;;
     "stop")
         docker-compose stop;;
     *)
-        echo "command should be 'run' or 'stop'"
+        echo "command should be 'run', 'stop' or 'dev-keys'"
         exit 1;;
 esac
\ No newline at end of file
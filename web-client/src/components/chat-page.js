@@ -22,6 +22,9 @@ function ChatPage({ user, logout, handleRefresh }) {
     id: '',
   })
   const [channels, setChannels] = useState([])
+  const [publicChannels, setPublicChannels] = useState([])
+  const [newChannelPrivate, setNewChannelPrivate] = useState(false)
+  const [inviteeId, setInviteeId] = useState('')
   const [socket, setSocket] = useState(
     socketIOClient('/api/chat', {
       extraHeaders: {
@@ -55,6 +58,7 @@ function ChatPage({ user, logout, handleRefresh }) {
     })
     // fetch channel list
     fetchChannels()
+    fetchPublicChannels()
 
     return () => socket.disconnect()
   }, [])
@@ -75,6 +79,9 @@ function ChatPage({ user, logout, handleRefresh }) {
   const fetchChannels = () => {
     axios
       .get('/api/channels', {
+        headers: {
+          Authorization: `bearer ${user.accessToken}`,
+        },
         transformResponse: (res) => {
           return JSONbig({ storeAsString: true }).parse(res)
         },
@@ -90,6 +97,26 @@ function ChatPage({ user, logout, handleRefresh }) {
       })
   }
 
+  // public channels can be joined by anyone, the ones already joined are listed with the other channels
+  const fetchPublicChannels = () => {
+    axios
+      .get('/api/channels/public', {
+        headers: {
+          Authorization: `bearer ${user.accessToken}`,
+        },
+        transformResponse: (res) => {
+          return JSONbig({ storeAsString: true }).parse(res)
+        },
+      })
+      .then((res) => {
+        setPublicChannels(res.data.channels || [])
+      })
+      .catch((err) => {
+        console.log(err)
+        alert('Fail to get public channels list')
+      })
+  }
+
   const fetchUsernameById = async (userId) => {
     return axios
       .get(`/api/account/name/${userId}`)
@@ -105,6 +132,9 @@ function ChatPage({ user, logout, handleRefresh }) {
   const fetchMsgByChannels = (channelId) => {
     axios
       .get('/api/messages', {
+        headers: {
+          Authorization: `bearer ${user.accessToken}`,
+        },
         params: {
           'channel-id': channelId,
         },
@@ -116,11 +146,10 @@ function ChatPage({ user, logout, handleRefresh }) {
         if (res.data.messages) {
           const msg = res.data.messages
           for (let i = 0; i < msg.length; i++) {
-            if (msg[i].type === 'file' || msg[i].type === 'img') {
-              let objectPayload = msg[i].content.split('#')
-              msg[i].s3_url = objectPayload[0]
-              msg[i].content = objectPayload[1]
-              msg[i].filesize = objectPayload[2]
+            if (msg[i].attachment) {
+              msg[i].s3_url = msg[i].attachment.url
+              msg[i].content = msg[i].attachment.filename
+              msg[i].filesize = prettyBytes(Number(msg[i].attachment.size))
             }
             if (!UserList[msg[i].user_id]) {
               UserList[msg[i].user_id] = await fetchUsernameById(msg[i].user_id)
@@ -146,7 +175,11 @@ function ChatPage({ user, logout, handleRefresh }) {
 
   const handleDeleteChannel = (id) => {
     axios
-      .delete('/api/channel/' + id)
+      .delete('/api/channel/' + id, {
+        headers: {
+          Authorization: `bearer ${user.accessToken}`,
+        },
+      })
       .then(async (res) => {
         fetchChannels()
         setCurrentChannel({ members: [], name: '', id: '' })
@@ -157,6 +190,77 @@ function ChatPage({ user, logout, handleRefresh }) {
       })
   }
 
+  const handleJoinChannel = (channel) => {
+    axios
+      .post(
+        `/api/channel/${channel.id}/join`,
+        {},
+        {
+          headers: {
+            Authorization: `bearer ${user.accessToken}`,
+          },
+        }
+      )
+      .then(() => {
+        fetchChannels()
+        setCurrentChannel({ members: [], name: channel.name, id: channel.id })
+      })
+      .catch((err) => {
+        console.log(err)
+        alert('Fail to join channel')
+      })
+  }
+
+  const handleLeaveChannel = () => {
+    axios
+      .post(
+        `/api/channel/${currentChannel.id}/leave`,
+        {},
+        {
+          headers: {
+            Authorization: `bearer ${user.accessToken}`,
+          },
+        }
+      )
+      .then(() => {
+        fetchChannels()
+        fetchPublicChannels()
+        setCurrentChannel({ members: [], name: '', id: '' })
+      })
+      .catch((err) => {
+        console.log(err)
+        alert('Fail to leave channel')
+      })
+  }
+
+  const handleInviteKeyPress = (e) => {
+    if (e.key !== 'Enter' || inviteeId === '') {
+      return
+    }
+    if (!/^[0-9]+$/.test(inviteeId)) {
+      return alert('User ID must be a number')
+    }
+    // user IDs do not fit in a javascript number, so they are sent as big numbers
+    axios
+      .post(
+        `/api/channel/${currentChannel.id}/invite`,
+        JSONbig.stringify({ user_id: JSONbig.parse(inviteeId) }),
+        {
+          headers: {
+            Authorization: `bearer ${user.accessToken}`,
+            'Content-Type': 'application/json',
+          },
+        }
+      )
+      .then(() => {
+        setInviteeId('')
+      })
+      .catch((err) => {
+        console.log(err)
+        alert('Fail to invite user')
+      })
+  }
+
   const handleInputKeyPress = (e) => {
     if (e.target.value !== '' && e.key === 'Enter') {
       socket.emit(
@@ -185,12 +289,21 @@ function ChatPage({ user, logout, handleRefresh }) {
       return alert('Channel already exists')
     } else if (e.target.value !== '' && e.key === 'Enter') {
       axios
-        .post('/api/channel', { name: e.target.value })
+        .post(
+          '/api/channel',
+          { name: e.target.value, private: newChannelPrivate },
+          {
+            headers: {
+              Authorization: `bearer ${user.accessToken}`,
+            },
+          }
+        )
         .then((res) => {
           if (res.data.msg !== 'ok') {
             throw new Error(res.data.msg)
           } else {
             fetchChannels()
+            fetchPublicChannels()
             e.target.value = ''
           }
         })
@@ -223,6 +336,15 @@ function ChatPage({ user, logout, handleRefresh }) {
               type: res.data.type,
               s3_url: res.data.s3_url,
               filesize: filesize,
+              attachment: {
+                url: res.data.s3_url,
+                object_key: res.data.object_key,
+                filename: res.data.orginal_filename,
+                size: file.size,
+                mime_type: res.data.mime_type,
+                width: res.data.width,
+                height: res.data.height,
+              },
               room: currentChannel.name,
               channelId: currentChannel.id,
             },
@@ -279,15 +401,39 @@ function ChatPage({ user, logout, handleRefresh }) {
                     placeholder='Create new channel'
                     onKeyPress={handleNewChannelKeyPress}
                   />
+                  <div class='form-check'>
+                    <input
+                      id='new-channel-private'
+                      type='checkbox'
+                      class='form-check-input'
+                      checked={newChannelPrivate}
+                      onChange={(e) => setNewChannelPrivate(e.target.checked)}
+                    />
+                    <label for='new-channel-private' class='form-check-label'>
+                      Private, by invitation only
+                    </label>
+                  </div>
                 </li>
-                <li className='sidebar-title'>All Channels</li>
+                <li className='sidebar-title'>My Channels</li>
                 {channels.map((el) => (
                   <SidebarItem
-                    text={el.name}
+                    text={el.private ? `${el.name} (private)` : el.name}
                     onClick={() => setCurrentChannel({ members: [], name: el.name, id: el.id })}
-                    onClickDelete={() => handleDeleteChannel(el.id)}
+                    onClickIcon={() => handleDeleteChannel(el.id)}
                   />
                 ))}
+                <li className='sidebar-title'>Public Channels</li>
+                {publicChannels
+                  .filter((el) => !channels.some((c) => c.id === el.id))
+                  .map((el) => (
+                    <SidebarItem
+                      text={el.name}
+                      icon='bi-box-arrow-in-right'
+                      onClick={() => handleJoinChannel(el)}
+                      onClickIcon={() => handleJoinChannel(el)}
+                    />
+                  ))}
+                <li className='sidebar-title'>Your user ID: {user.userId}</li>
               </ul>
             </div>
             <button className='sidebar-toggler btn x'>
@@ -327,8 +473,17 @@ function ChatPage({ user, logout, handleRefresh }) {
                             })}
                           </span>
                         </div>
-                        <button class='btn btn-sm'>
-                          <i data-feather='x'></i>
+                        <input
+                          type='text'
+                          class='form-control form-control-sm w-auto me-2'
+                          placeholder='Invite by user ID'
+                          value={inviteeId}
+                          onKeyPress={handleInviteKeyPress}
+                          onChange={(e) => setInviteeId(e.target.value)}
+                          disabled={currentChannel.name === ''}
+                        />
+                        <button class='btn btn-sm' onClick={handleLeaveChannel} disabled={currentChannel.name === ''}>
+                          Leave
                         </button>
                       </div>
                     </div>
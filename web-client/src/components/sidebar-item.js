@@ -1,4 +1,4 @@
-function SidebarItem({ text, onClick, onClickDelete }) {
+function SidebarItem({ text, onClick, onClickIcon, icon = 'bi-trash-fill' }) {
   return (
     <li class='sidebar-item'>
       <div class='d-flex ml-4'>
@@ -7,9 +7,9 @@ function SidebarItem({ text, onClick, onClickDelete }) {
             <span># {text}</span>
           </div>
         </div>
-        <div class='sidebar-link' onClick={onClickDelete}>
+        <div class='sidebar-link' onClick={onClickIcon}>
           <span>
-            <i class='bi bi-trash-fill'></i>
+            <i class={`bi ${icon}`}></i>
           </span>
         </div>
       </div>